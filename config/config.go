@@ -27,12 +27,15 @@ import (
 // directly to YAML. Fields that cannot be set in the cloud-config (fields
 // used for internal use) have the YAML tag '-' so that they aren't marshalled.
 type CloudConfig struct {
-	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys"`
-	CoreOS            CoreOS   `yaml:"coreos"`
-	WriteFiles        []File   `yaml:"write_files"`
-	Hostname          string   `yaml:"hostname"`
-	Users             []User   `yaml:"users"`
-	ManageEtcHosts    EtcHosts `yaml:"manage_etc_hosts"`
+	SSHAuthorizedKeys []string    `yaml:"ssh_authorized_keys"`
+	CoreOS            CoreOS      `yaml:"coreos"`
+	WriteFiles        []File      `yaml:"write_files"`
+	Hostname          string      `yaml:"hostname"`
+	Users             []User      `yaml:"users"`
+	ManageEtcHosts    EtcHosts    `yaml:"manage_etc_hosts"`
+	BootCmd           []string    `yaml:"bootcmd"`
+	RunCmd            []string    `yaml:"runcmd"`
+	ErrorPolicy       ErrorPolicy `yaml:"error_policy"`
 }
 
 type CoreOS struct {
@@ -41,6 +44,7 @@ type CoreOS struct {
 	Flannel   Flannel   `yaml:"flannel"`
 	Fleet     Fleet     `yaml:"fleet"`
 	Locksmith Locksmith `yaml:"locksmith"`
+	Network   Network   `yaml:"network"`
 	OEM       OEM       `yaml:"oem"`
 	Update    Update    `yaml:"update"`
 	Units     []Unit    `yaml:"units"`
@@ -59,8 +63,11 @@ func IsCloudConfig(userdata string) bool {
 
 // NewCloudConfig instantiates a new CloudConfig from the given contents (a
 // string of YAML), returning any error encountered. It will ignore unknown
-// fields but log encountering them.
+// fields but log encountering them. The keys of the cloud-config are
+// normalized, replacing dashes with underscores, for this decoding only.
 func NewCloudConfig(contents string) (*CloudConfig, error) {
+	transform := yaml.UnmarshalMappingKeyTransform
+	defer func() { yaml.UnmarshalMappingKeyTransform = transform }()
 	yaml.UnmarshalMappingKeyTransform = func(nameIn string) (nameOut string) {
 		return strings.Replace(nameIn, "-", "_", -1)
 	}
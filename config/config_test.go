@@ -262,6 +262,11 @@ write_files:
     permissions: '0644'
     owner: root:dogepack
 hostname: trontastic
+bootcmd:
+  - echo early
+runcmd:
+  - echo late
+  - touch /tmp/late
 `
 	cfg, err := NewCloudConfig(contents)
 	if err != nil {
@@ -329,6 +334,12 @@ Address=10.209.171.177/19
 	if cfg.CoreOS.Update.RebootStrategy != "reboot" {
 		t.Errorf("Failed to parse locksmith strategy")
 	}
+	if !reflect.DeepEqual(cfg.BootCmd, []string{"echo early"}) {
+		t.Errorf("Failed to parse bootcmd: %q", cfg.BootCmd)
+	}
+	if !reflect.DeepEqual(cfg.RunCmd, []string{"echo late", "touch /tmp/late"}) {
+		t.Errorf("Failed to parse runcmd: %q", cfg.RunCmd)
+	}
 }
 
 // Assert that our interface conversion doesn't panic
@@ -0,0 +1,66 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+const (
+	FailFast = "fail-fast"
+	Continue = "continue"
+	Ignore   = "ignore"
+)
+
+// ErrorPolicy sets, for each section of the cloud-config, whether applying it
+// stops at the first failing item (fail-fast) or attempts every item and
+// reports the failures at the end (continue). Sections which aren't set use
+// the default policy, which is fail-fast unless set otherwise. The exception
+// is the network section, covering the interfaces which aren't configured in
+// time, whose failures are only logged (ignore) unless it is set.
+type ErrorPolicy struct {
+	Default           string `yaml:"default"             valid:"^(fail-fast|continue)$"`
+	BootCmd           string `yaml:"bootcmd"             valid:"^(fail-fast|continue)$"`
+	Hostname          string `yaml:"hostname"            valid:"^(fail-fast|continue)$"`
+	Users             string `yaml:"users"               valid:"^(fail-fast|continue)$"`
+	SSHAuthorizedKeys string `yaml:"ssh_authorized_keys" valid:"^(fail-fast|continue)$"`
+	WriteFiles        string `yaml:"write_files"         valid:"^(fail-fast|continue)$"`
+	Units             string `yaml:"units"               valid:"^(fail-fast|continue)$"`
+	RunCmd            string `yaml:"runcmd"              valid:"^(fail-fast|continue)$"`
+	Network           string `yaml:"network"             valid:"^(fail-fast|continue|ignore)$"`
+}
+
+// Policy returns the policy of the given section, falling back to the
+// default policy.
+func (p ErrorPolicy) Policy(section string) string {
+	if section == "network" {
+		if p.Network == "" {
+			return Ignore
+		}
+		return p.Network
+	}
+	policy := map[string]string{
+		"bootcmd":             p.BootCmd,
+		"hostname":            p.Hostname,
+		"users":               p.Users,
+		"ssh_authorized_keys": p.SSHAuthorizedKeys,
+		"write_files":         p.WriteFiles,
+		"units":               p.Units,
+		"runcmd":              p.RunCmd,
+	}[section]
+	if policy == "" {
+		policy = p.Default
+	}
+	if policy == "" {
+		policy = FailFast
+	}
+	return policy
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+)
+
+func TestErrorPolicyValid(t *testing.T) {
+	tests := []struct {
+		value string
+
+		isValid bool
+	}{
+		{value: "fail-fast", isValid: true},
+		{value: "continue", isValid: true},
+		{value: "ignore", isValid: false},
+	}
+
+	for _, tt := range tests {
+		isValid := (nil == AssertStructValid(ErrorPolicy{Units: tt.value}))
+		if tt.isValid != isValid {
+			t.Errorf("bad assert (%s): want %t, got %t", tt.value, tt.isValid, isValid)
+		}
+	}
+
+	for _, tt := range []struct {
+		value string
+
+		isValid bool
+	}{
+		{value: "fail-fast", isValid: true},
+		{value: "ignore", isValid: true},
+		{value: "skip", isValid: false},
+	} {
+		isValid := (nil == AssertStructValid(ErrorPolicy{Network: tt.value}))
+		if tt.isValid != isValid {
+			t.Errorf("bad network assert (%s): want %t, got %t", tt.value, tt.isValid, isValid)
+		}
+	}
+}
+
+func TestErrorPolicyPolicy(t *testing.T) {
+	tests := []struct {
+		policy  ErrorPolicy
+		section string
+
+		result string
+	}{
+		{policy: ErrorPolicy{}, section: "units", result: FailFast},
+		{policy: ErrorPolicy{}, section: "", result: FailFast},
+		{policy: ErrorPolicy{Default: Continue}, section: "units", result: Continue},
+		{policy: ErrorPolicy{Default: Continue}, section: "", result: Continue},
+		{policy: ErrorPolicy{Default: Continue, Units: FailFast}, section: "units", result: FailFast},
+		{policy: ErrorPolicy{Default: Continue, Units: FailFast}, section: "runcmd", result: Continue},
+		{policy: ErrorPolicy{RunCmd: Continue}, section: "runcmd", result: Continue},
+		{policy: ErrorPolicy{Default: FailFast}, section: "network", result: Ignore},
+		{policy: ErrorPolicy{Network: FailFast}, section: "network", result: FailFast},
+	}
+
+	for _, tt := range tests {
+		if result := tt.policy.Policy(tt.section); tt.result != result {
+			t.Errorf("bad policy (%+v, %q): want %q, got %q", tt.policy, tt.section, tt.result, result)
+		}
+	}
+}
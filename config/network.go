@@ -0,0 +1,69 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+// Network describes the network interfaces of the system, which are
+// configured by systemd-networkd.
+type Network struct {
+	Interfaces []NetworkInterface `yaml:"interfaces"`
+}
+
+// NetworkInterface describes a network interface and its addressing. Physical
+// interfaces are matched by name or MAC address (a physical interface with both
+// is named after its MAC address), while bonds, VLANs and bridges are created.
+// An interface without DHCP or addresses is brought up without any addressing
+// (e.g. a port of a bond or bridge).
+type NetworkInterface struct {
+	Name      string         `yaml:"name"`
+	MAC       string         `yaml:"mac"`
+	MTU       int            `yaml:"mtu"`
+	Type      string         `yaml:"type"       valid:"^(physical|bond|vlan|bridge)$"`
+	DHCP      bool           `yaml:"dhcp"`
+	Addresses []string       `yaml:"addresses"`
+	Gateway   string         `yaml:"gateway"`
+	Routes    []NetworkRoute `yaml:"routes"`
+	DNS       []string       `yaml:"dns"`
+	Bond      NetworkBond    `yaml:"bond"`
+	VLAN      NetworkVLAN    `yaml:"vlan"`
+	Bridge    NetworkBridge  `yaml:"bridge"`
+}
+
+type NetworkRoute struct {
+	Destination string `yaml:"destination"`
+	Gateway     string `yaml:"gateway"`
+}
+
+type NetworkBond struct {
+	Slaves             []string `yaml:"slaves"`
+	Primary            string   `yaml:"primary"`
+	Mode               string   `yaml:"mode"                 valid:"^(balance-rr|active-backup|balance-xor|broadcast|802\\.3ad|balance-tlb|balance-alb|[0-6])$"`
+	MIIMon             string   `yaml:"miimon"               valid:"^[0-9]+$"`
+	LACPRate           string   `yaml:"lacp_rate"            valid:"^(slow|fast|0|1)$"`
+	TransmitHashPolicy string   `yaml:"transmit_hash_policy" valid:"^(layer2|layer3\\+4|layer2\\+3|encap2\\+3|encap3\\+4)$"`
+	UpDelay            string   `yaml:"updelay"              valid:"^[0-9]+$"`
+	DownDelay          string   `yaml:"downdelay"            valid:"^[0-9]+$"`
+	MinLinks           string   `yaml:"min_links"            valid:"^[0-9]+$"`
+}
+
+type NetworkVLAN struct {
+	ID   int    `yaml:"id"`
+	Link string `yaml:"link"`
+}
+
+type NetworkBridge struct {
+	Ports        []string `yaml:"ports"`
+	STP          bool     `yaml:"stp"`
+	ForwardDelay string   `yaml:"forward_delay" valid:"^[0-9]+$"`
+}
@@ -29,3 +29,21 @@ func NewScript(userdata string) (*Script, error) {
 	s := Script(userdata)
 	return &s, nil
 }
+
+// Interpreter returns the interpreter named on the script's "#!" line along
+// with its optional argument. As with the kernel, everything following the
+// interpreter is treated as a single argument. An empty interpreter is
+// returned if the line doesn't name one.
+func (s Script) Interpreter() (string, string) {
+	header := strings.SplitN(string(s), "\n", 2)[0]
+	if !strings.HasPrefix(header, "#!") {
+		return "", ""
+	}
+	header = strings.TrimSpace(strings.TrimPrefix(header, "#!"))
+
+	i := strings.IndexAny(header, " \t")
+	if i < 0 {
+		return header, ""
+	}
+	return header[:i], strings.TrimSpace(header[i:])
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+)
+
+func TestScriptInterpreter(t *testing.T) {
+	tests := []struct {
+		script string
+
+		interpreter string
+		arg         string
+	}{
+		{script: "", interpreter: "", arg: ""},
+		{script: "#cloud-config", interpreter: "", arg: ""},
+		{script: "#!", interpreter: "", arg: ""},
+		{script: "#!/bin/bash\necho hi", interpreter: "/bin/bash", arg: ""},
+		{script: "#! /bin/bash\r\necho hi", interpreter: "/bin/bash", arg: ""},
+		{script: "#!/bin/sh -e\n", interpreter: "/bin/sh", arg: "-e"},
+		{script: "#!/usr/bin/env python\n", interpreter: "/usr/bin/env", arg: "python"},
+		{script: "#!/usr/bin/env\tpython -u  \n", interpreter: "/usr/bin/env", arg: "python -u"},
+	}
+
+	for _, tt := range tests {
+		interpreter, arg := Script(tt.script).Interpreter()
+		if tt.interpreter != interpreter || tt.arg != arg {
+			t.Errorf("bad interpreter (%q): want (%q, %q), got (%q, %q)", tt.script, tt.interpreter, tt.arg, interpreter, arg)
+		}
+	}
+}
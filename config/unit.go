@@ -14,14 +14,69 @@
 
 package config
 
+import (
+	"fmt"
+	"strings"
+)
+
+// UnitConflicts lists the pairs of options of a unit which contradict each
+// other.
+var UnitConflicts = [][2]string{
+	{"enable", "disable"},
+	{"enable", "mask"},
+	{"enable", "preset"},
+	{"enable", "remove"},
+	{"disable", "preset"},
+	{"mask", "unmask"},
+	{"mask", "preset"},
+	{"mask", "remove"},
+	{"remove", "content"},
+	{"remove", "drop_ins"},
+}
+
 type Unit struct {
 	Name    string       `yaml:"name"`
 	Mask    bool         `yaml:"mask"`
+	Unmask  bool         `yaml:"unmask"`
 	Enable  bool         `yaml:"enable"`
+	Disable bool         `yaml:"disable"`
+	Preset  bool         `yaml:"preset"`
+	Remove  bool         `yaml:"remove"`
 	Runtime bool         `yaml:"runtime"`
 	Content string       `yaml:"content"`
-	Command string       `yaml:"command" valid:"^(start|stop|restart|reload|try-restart|reload-or-restart|reload-or-try-restart)$"`
+	Command string       `yaml:"command" valid:"^(start|stop|restart|reload|try-restart|reload-or-restart|reload-or-try-restart|restart-on-change)$"`
 	DropIns []UnitDropIn `yaml:"drop_ins"`
+
+	Instances []string `yaml:"instances"`
+
+	OncePerInstance bool `yaml:"once_per_instance"`
+	RequireActive   bool `yaml:"require_active"`
+}
+
+// Conflict returns an error naming the first pair of options of the unit
+// which contradict each other, if any. Instances can only be given for
+// template units.
+func (u Unit) Conflict() error {
+	if len(u.Instances) > 0 && !strings.Contains(u.Name, "@") {
+		return fmt.Errorf("%q requires the name of a template unit", "instances")
+	}
+
+	set := map[string]bool{
+		"enable":   u.Enable,
+		"disable":  u.Disable,
+		"mask":     u.Mask,
+		"unmask":   u.Unmask,
+		"preset":   u.Preset,
+		"remove":   u.Remove,
+		"content":  u.Content != "",
+		"drop_ins": len(u.DropIns) > 0,
+	}
+	for _, c := range UnitConflicts {
+		if set[c[0]] && set[c[1]] {
+			return fmt.Errorf("%q cannot be combined with %q", c[0], c[1])
+		}
+	}
+	return nil
 }
 
 type UnitDropIn struct {
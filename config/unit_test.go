@@ -33,6 +33,7 @@ func TestCommandValid(t *testing.T) {
 		{value: "try-restart", isValid: true},
 		{value: "reload-or-restart", isValid: true},
 		{value: "reload-or-try-restart", isValid: true},
+		{value: "restart-on-change", isValid: true},
 		{value: "tryrestart", isValid: false},
 		{value: "unknown", isValid: false},
 	}
@@ -44,3 +45,28 @@ func TestCommandValid(t *testing.T) {
 		}
 	}
 }
+
+func TestUnitConflict(t *testing.T) {
+	tests := []struct {
+		unit Unit
+
+		err string
+	}{
+		{unit: Unit{}},
+		{unit: Unit{Enable: true, Unmask: true, Content: "[Service]"}},
+		{unit: Unit{Disable: true, Remove: true}},
+		{unit: Unit{Enable: true, Mask: true}, err: `"enable" cannot be combined with "mask"`},
+		{unit: Unit{Disable: true, Preset: true}, err: `"disable" cannot be combined with "preset"`},
+		{unit: Unit{Mask: true, Unmask: true}, err: `"mask" cannot be combined with "unmask"`},
+		{unit: Unit{Remove: true, DropIns: []UnitDropIn{{Name: "10-foo.conf"}}}, err: `"remove" cannot be combined with "drop_ins"`},
+		{unit: Unit{Name: "foo@.service", Instances: []string{"a"}}},
+		{unit: Unit{Name: "foo.service", Instances: []string{"a"}}, err: `"instances" requires the name of a template unit`},
+	}
+
+	for _, tt := range tests {
+		err := tt.unit.Conflict()
+		if (err == nil && tt.err != "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("bad conflict (%+v): want %q, got %v", tt.unit, tt.err, err)
+		}
+	}
+}
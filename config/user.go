@@ -30,4 +30,5 @@ type User struct {
 	System               bool     `yaml:"system"`
 	NoLogInit            bool     `yaml:"no_log_init"`
 	Shell                string   `yaml:"shell"`
+	OncePerInstance      bool     `yaml:"once_per_instance"`
 }
@@ -16,6 +16,7 @@ package validate
 
 import (
 	"fmt"
+	"net"
 	"net/url"
 	"path"
 	"reflect"
@@ -28,14 +29,29 @@ type rule func(config node, report *Report)
 
 // Rules contains all of the validation rules.
 var Rules []rule = []rule{
+	checkCommands,
 	checkDiscoveryUrl,
 	checkEncoding,
+	checkNetwork,
 	checkStructure,
+	checkUnits,
 	checkValidity,
 	checkWriteFiles,
 	checkWriteFilesUnderCoreos,
 }
 
+// checkCommands verifies that none of the entries under 'bootcmd' or 'runcmd'
+// are empty.
+func checkCommands(cfg node, report *Report) {
+	for _, name := range []string{"bootcmd", "runcmd"} {
+		for _, c := range cfg.Child(name).children {
+			if c.Kind() == reflect.String && strings.TrimSpace(c.String()) == "" {
+				report.Error(c.line, fmt.Sprintf("command in %q cannot be empty", name))
+			}
+		}
+	}
+}
+
 // checkDiscoveryUrl verifies that the string is a valid url.
 func checkDiscoveryUrl(cfg node, report *Report) {
 	c := cfg.Child("coreos").Child("etcd").Child("discovery")
@@ -121,6 +137,112 @@ func isCompatible(n, g reflect.Kind) bool {
 	}
 }
 
+// checkNetwork verifies that the addresses, routes and MAC addresses of the
+// interfaces under 'coreos.network' can be parsed, that every interface can be
+// identified and that bonds and VLANs name their underlying interfaces.
+func checkNetwork(cfg node, report *Report) {
+	for _, iface := range cfg.Child("coreos").Child("network").Child("interfaces").children {
+		typ := iface.Child("type")
+		physical := !isSet(typ) || typ.String() == "physical"
+		if !isSet(iface.Child("name")) && (!physical || !isSet(iface.Child("mac"))) {
+			report.Error(iface.line, "interface requires a name")
+		}
+		if m := iface.Child("mac"); isSet(m) {
+			if !physical {
+				report.Error(m.line, "only physical interfaces can be matched by MAC address")
+			} else if _, err := net.ParseMAC(m.String()); err != nil {
+				report.Error(m.line, fmt.Sprintf("invalid MAC address %q", m.String()))
+			}
+		}
+		if m := iface.Child("mtu"); m.IsValid() && m.Kind() == reflect.Int && m.Int() < 0 {
+			report.Error(m.line, fmt.Sprintf("invalid MTU %d", m.Int()))
+		}
+		if d := iface.Child("dhcp"); isSet(d) {
+			for _, name := range []string{"addresses", "gateway", "routes", "dns"} {
+				if c := iface.Child(name); isSet(c) {
+					report.Error(c.line, fmt.Sprintf("%q cannot be combined with \"dhcp\"", name))
+				}
+			}
+		}
+		for _, a := range iface.Child("addresses").children {
+			if _, _, err := net.ParseCIDR(a.String()); err != nil {
+				report.Error(a.line, fmt.Sprintf("invalid address %q: prefix length required", a.String()))
+			}
+		}
+		checkIP(iface.Child("gateway"), report)
+		for _, ns := range iface.Child("dns").children {
+			checkIP(ns, report)
+		}
+		for _, r := range iface.Child("routes").children {
+			if d := r.Child("destination"); !d.IsValid() {
+				report.Error(r.line, "route requires a destination")
+			} else if _, _, err := net.ParseCIDR(d.String()); err != nil {
+				report.Error(d.line, fmt.Sprintf("invalid route destination %q", d.String()))
+			}
+			if g := r.Child("gateway"); !g.IsValid() {
+				report.Error(r.line, "route requires a gateway")
+			} else {
+				checkIP(g, report)
+			}
+		}
+		if !isSet(typ) {
+			continue
+		}
+		switch typ.String() {
+		case "bond":
+			if !isSet(iface.Child("bond").Child("slaves")) {
+				report.Error(typ.line, "bond requires slaves")
+			}
+		case "vlan":
+			if !isSet(iface.Child("vlan").Child("link")) {
+				report.Error(typ.line, "vlan requires a link")
+			}
+		}
+	}
+}
+
+// checkIP verifies that the given node, if present, holds an IP address.
+func checkIP(n node, report *Report) {
+	if n.IsValid() && net.ParseIP(n.String()) == nil {
+		report.Error(n.line, fmt.Sprintf("invalid IP address %q", n.String()))
+	}
+}
+
+// checkUnits verifies that none of the units under 'coreos.units' combine
+// options which contradict each other (e.g. 'enable' and 'mask'), and that
+// only template units list instances.
+func checkUnits(cfg node, report *Report) {
+	for _, u := range cfg.Child("coreos").Child("units").children {
+		if i := u.Child("instances"); isSet(i) {
+			if n := u.Child("name"); n.Kind() == reflect.String && !strings.Contains(n.String(), "@") {
+				report.Error(i.line, "instances can only be given for a template unit")
+			}
+		}
+		for _, c := range config.UnitConflicts {
+			a, b := u.Child(c[0]), u.Child(c[1])
+			if isSet(a) && isSet(b) {
+				report.Error(b.line, fmt.Sprintf("%q cannot be combined with %q", c[1], c[0]))
+			}
+		}
+	}
+}
+
+// isSet returns whether or not the given node holds a true boolean or a
+// non-empty string or list.
+func isSet(n node) bool {
+	if !n.IsValid() {
+		return false
+	}
+	switch n.Kind() {
+	case reflect.Bool:
+		return n.Bool()
+	case reflect.String, reflect.Slice:
+		return n.Len() > 0
+	default:
+		return false
+	}
+}
+
 // checkValidity checks the value of every node in the provided config by
 // running config.AssertValid() on it.
 func checkValidity(cfg node, report *Report) {
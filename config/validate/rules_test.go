@@ -19,6 +19,40 @@ import (
 	"testing"
 )
 
+func TestCheckCommands(t *testing.T) {
+	tests := []struct {
+		config string
+
+		entries []Entry
+	}{
+		{},
+		{
+			config: "bootcmd:\n  - echo hi\nruncmd:\n  - echo bye",
+		},
+		{
+			config:  "bootcmd:\n  - echo hi\n  - \"\"",
+			entries: []Entry{{entryError, "command in \"bootcmd\" cannot be empty", 3}},
+		},
+		{
+			config:  "runcmd:\n  - \" \"",
+			entries: []Entry{{entryError, "command in \"runcmd\" cannot be empty", 2}},
+		},
+	}
+
+	for i, tt := range tests {
+		r := Report{}
+		n, err := parseCloudConfig([]byte(tt.config), &r)
+		if err != nil {
+			panic(err)
+		}
+		checkCommands(n, &r)
+
+		if e := r.Entries(); !reflect.DeepEqual(tt.entries, e) {
+			t.Errorf("bad report (%d, %q): want %#v, got %#v", i, tt.config, tt.entries, e)
+		}
+	}
+}
+
 func TestCheckDiscoveryUrl(t *testing.T) {
 	tests := []struct {
 		config string
@@ -277,6 +311,103 @@ func TestCheckStructure(t *testing.T) {
 	}
 }
 
+func TestCheckNetwork(t *testing.T) {
+	tests := []struct {
+		config string
+
+		entries []Entry
+	}{
+		{},
+		{
+			config: "coreos:\n  network:\n    interfaces:\n      - name: eth0\n        addresses:\n          - 10.0.0.2/24\n        gateway: 10.0.0.1\n        dns:\n          - 8.8.8.8",
+		},
+		{
+			config: "coreos:\n  network:\n    interfaces:\n      - mac: 52:54:00:12:34:56\n        dhcp: true",
+		},
+		{
+			config:  "coreos:\n  network:\n    interfaces:\n      - type: bond\n        mac: 52:54:00:12:34:56",
+			entries: []Entry{{entryError, "interface requires a name", 4}, {entryError, "only physical interfaces can be matched by MAC address", 5}, {entryError, "bond requires slaves", 4}},
+		},
+		{
+			config:  "coreos:\n  network:\n    interfaces:\n      - name: eth0\n      - name: eth0.10\n        type: vlan\n        vlan:\n          id: 10\n          link: eth0\n        mac: 52:54:00:12:34:56",
+			entries: []Entry{{entryError, "only physical interfaces can be matched by MAC address", 10}},
+		},
+		{
+			config:  "coreos:\n  network:\n    interfaces:\n      - mac: 52:54:00:12:34\n        addresses:\n          - 10.0.0.2",
+			entries: []Entry{{entryError, "invalid MAC address \"52:54:00:12:34\"", 4}, {entryError, "invalid address \"10.0.0.2\": prefix length required", 6}},
+		},
+		{
+			config:  "coreos:\n  network:\n    interfaces:\n      - name: eth0\n        dhcp: true\n        gateway: 10.0.0.1",
+			entries: []Entry{{entryError, "\"gateway\" cannot be combined with \"dhcp\"", 6}},
+		},
+		{
+			config:  "coreos:\n  network:\n    interfaces:\n      - name: eth0\n        routes:\n          - destination: 10.1.0.0/16\n            gateway: 10.0.0\n          - gateway: 10.0.0.1",
+			entries: []Entry{{entryError, "invalid IP address \"10.0.0\"", 7}, {entryError, "route requires a destination", 8}},
+		},
+		{
+			config:  "coreos:\n  network:\n    interfaces:\n      - name: vlan10\n        type: vlan\n        vlan:\n          id: 10",
+			entries: []Entry{{entryError, "vlan requires a link", 5}},
+		},
+	}
+
+	for i, tt := range tests {
+		r := Report{}
+		n, err := parseCloudConfig([]byte(tt.config), &r)
+		if err != nil {
+			panic(err)
+		}
+		checkNetwork(n, &r)
+
+		if e := r.Entries(); !reflect.DeepEqual(tt.entries, e) {
+			t.Errorf("bad report (%d, %q): want %#v, got %#v", i, tt.config, tt.entries, e)
+		}
+	}
+}
+
+func TestCheckUnits(t *testing.T) {
+	tests := []struct {
+		config string
+
+		entries []Entry
+	}{
+		{},
+		{
+			config: "coreos:\n  units:\n    - name: foo.service\n      enable: true\n      unmask: true",
+		},
+		{
+			config: "coreos:\n  units:\n    - name: foo.service\n      enable: false\n      mask: true",
+		},
+		{
+			config:  "coreos:\n  units:\n    - name: foo.service\n      enable: true\n      mask: true",
+			entries: []Entry{{entryError, "\"mask\" cannot be combined with \"enable\"", 5}},
+		},
+		{
+			config:  "coreos:\n  units:\n    - name: foo.service\n      remove: true\n      drop-ins:\n        - name: 10-foo.conf",
+			entries: []Entry{{entryError, "\"drop_ins\" cannot be combined with \"remove\"", 5}},
+		},
+		{
+			config: "coreos:\n  units:\n    - name: foo@.service\n      instances:\n        - a",
+		},
+		{
+			config:  "coreos:\n  units:\n    - name: foo.service\n      instances:\n        - a",
+			entries: []Entry{{entryError, "instances can only be given for a template unit", 4}},
+		},
+	}
+
+	for i, tt := range tests {
+		r := Report{}
+		n, err := parseCloudConfig([]byte(tt.config), &r)
+		if err != nil {
+			panic(err)
+		}
+		checkUnits(n, &r)
+
+		if e := r.Entries(); !reflect.DeepEqual(tt.entries, e) {
+			t.Errorf("bad report (%d, %q): want %#v, got %#v", i, tt.config, tt.entries, e)
+		}
+	}
+}
+
 func TestCheckValidity(t *testing.T) {
 	tests := []struct {
 		config string
@@ -17,6 +17,8 @@ package validate
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
@@ -29,17 +31,28 @@ import (
 var (
 	yamlLineError = regexp.MustCompile(`^YAML error: line (?P<line>[[:digit:]]+): (?P<msg>.*)$`)
 	yamlError     = regexp.MustCompile(`^YAML error: (?P<msg>.*)$`)
+
+	// defaultPath is the PATH given to services by systemd, which is used to
+	// look up interpreters invoked through env(1).
+	defaultPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
 )
 
 // Validate runs a series of validation tests against the given userdata and
 // returns a report detailing all of the issues. Presently, only cloud-configs
-// can be validated.
+// and the interpreter line of scripts can be validated.
 func Validate(userdataBytes []byte) (Report, error) {
+	return ValidateRoot(userdataBytes, "")
+}
+
+// ValidateRoot runs the same tests as Validate. If root is not empty, the
+// userdata is additionally checked against the filesystem found beneath it
+// (e.g. a script's interpreter needs to exist there).
+func ValidateRoot(userdataBytes []byte, root string) (Report, error) {
 	switch {
 	case len(userdataBytes) == 0:
 		return Report{}, nil
 	case config.IsScript(string(userdataBytes)):
-		return Report{}, nil
+		return validateScript(userdataBytes, root), nil
 	case config.IsCloudConfig(string(userdataBytes)):
 		return validateCloudConfig(userdataBytes, Rules)
 	default:
@@ -49,6 +62,50 @@ func Validate(userdataBytes []byte) (Report, error) {
 	}
 }
 
+// validateScript checks that the script names an interpreter and, if a root
+// is given, that the interpreter is executable beneath it. When the
+// interpreter is env(1), the program it runs is looked up in defaultPath.
+func validateScript(script []byte, root string) (report Report) {
+	interpreter, arg := config.Script(script).Interpreter()
+	if interpreter == "" {
+		report.Error(1, "script does not specify an interpreter")
+		return
+	}
+	if root == "" {
+		return
+	}
+
+	if !isExecutable(path.Join(root, interpreter)) {
+		report.Error(1, fmt.Sprintf("interpreter %q is not an executable file", interpreter))
+		return
+	}
+
+	if path.Base(interpreter) != "env" || arg == "" || strings.HasPrefix(arg, "-") {
+		return
+	}
+	prog := strings.Fields(arg)[0]
+	if path.IsAbs(prog) {
+		if !isExecutable(path.Join(root, prog)) {
+			report.Error(1, fmt.Sprintf("interpreter %q is not an executable file", prog))
+		}
+		return
+	}
+	for _, dir := range defaultPath {
+		if isExecutable(path.Join(root, dir, prog)) {
+			return
+		}
+	}
+	report.Warning(1, fmt.Sprintf("interpreter %q could not be found in %s", prog, strings.Join(defaultPath, ":")))
+	return
+}
+
+// isExecutable returns whether or not the given path is a regular file with
+// at least one of its execute bits set.
+func isExecutable(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+}
+
 // validateCloudConfig runs all of the validation rules in Rules and returns
 // the resulting report and any errors encountered.
 func validateCloudConfig(config []byte, rules []rule) (report Report, err error) {
@@ -73,6 +130,8 @@ func validateCloudConfig(config []byte, rules []rule) (report Report, err error)
 // any parsing issues into the provided report. Unrecoverable errors are
 // returned as an error.
 func parseCloudConfig(cfg []byte, report *Report) (node, error) {
+	transform := yaml.UnmarshalMappingKeyTransform
+	defer func() { yaml.UnmarshalMappingKeyTransform = transform }()
 	yaml.UnmarshalMappingKeyTransform = func(nameIn string) (nameOut string) {
 		return nameIn
 	}
@@ -16,6 +16,9 @@ package validate
 
 import (
 	"errors"
+	"io/ioutil"
+	"os"
+	"path"
 	"reflect"
 	"testing"
 )
@@ -124,6 +127,76 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestValidateScript(t *testing.T) {
+	root, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, f := range []struct {
+		path string
+		perm os.FileMode
+	}{
+		{"bin/sh", 0755},
+		{"usr/bin/env", 0755},
+		{"usr/bin/python", 0755},
+		{"usr/bin/notexec", 0644},
+	} {
+		if err := os.MkdirAll(path.Join(root, path.Dir(f.path)), 0755); err != nil {
+			t.Fatalf("Unable to create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(path.Join(root, f.path), []byte{}, f.perm); err != nil {
+			t.Fatalf("Unable to create file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		script string
+		root   string
+
+		entries []Entry
+	}{
+		{
+			script:  "#!\necho hey",
+			entries: []Entry{{entryError, "script does not specify an interpreter", 1}},
+		},
+		{
+			script: "#!/bin/bash\necho hey",
+		},
+		{
+			script: "#!/bin/sh -e\necho hey",
+			root:   root,
+		},
+		{
+			script:  "#!/bin/bash\necho hey",
+			root:    root,
+			entries: []Entry{{entryError, "interpreter \"/bin/bash\" is not an executable file", 1}},
+		},
+		{
+			script:  "#!/usr/bin/notexec\necho hey",
+			root:    root,
+			entries: []Entry{{entryError, "interpreter \"/usr/bin/notexec\" is not an executable file", 1}},
+		},
+		{
+			script: "#!/usr/bin/env python\nprint 'hey'",
+			root:   root,
+		},
+		{
+			script:  "#!/usr/bin/env ruby\nputs 'hey'",
+			root:    root,
+			entries: []Entry{{entryWarning, "interpreter \"ruby\" could not be found in /usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", 1}},
+		},
+	}
+
+	for i, tt := range tests {
+		r := validateScript([]byte(tt.script), tt.root)
+		if e := r.Entries(); !reflect.DeepEqual(tt.entries, e) {
+			t.Errorf("bad report (%d, %q): want %#v, got %#v", i, tt.script, tt.entries, e)
+		}
+	}
+}
+
 func BenchmarkValidate(b *testing.B) {
 	config := `#cloud-config
 hostname: test
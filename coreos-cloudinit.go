@@ -18,12 +18,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path"
 	"sync"
 	"time"
 
 	"github.com/coreos/coreos-cloudinit/config"
 	"github.com/coreos/coreos-cloudinit/config/validate"
 	"github.com/coreos/coreos-cloudinit/datasource"
+	"github.com/coreos/coreos-cloudinit/datasource/cache"
 	"github.com/coreos/coreos-cloudinit/datasource/configdrive"
 	"github.com/coreos/coreos-cloudinit/datasource/file"
 	"github.com/coreos/coreos-cloudinit/datasource/metadata/cloudsigma"
@@ -61,10 +63,18 @@ var (
 			procCmdLine                 bool
 		}
 		convertNetconf string
+		root           string
 		workspace      string
 		sshKeyName     string
 		oem            string
 		validate       bool
+		plan           bool
+		transactional  bool
+		parallelUnits  int
+		planFormat     string
+		waitForScript  bool
+		scriptTimeout  time.Duration
+		networkTimeout time.Duration
 	}{}
 )
 
@@ -82,9 +92,17 @@ func init() {
 	flag.BoolVar(&flags.sources.procCmdLine, "from-proc-cmdline", false, fmt.Sprintf("Parse %s for '%s=<url>', using the cloud-config served by an HTTP GET to <url>", proc_cmdline.ProcCmdlineLocation, proc_cmdline.ProcCmdlineCloudConfigFlag))
 	flag.StringVar(&flags.oem, "oem", "", "Use the settings specific to the provided OEM")
 	flag.StringVar(&flags.convertNetconf, "convert-netconf", "", "Read the network config provided in cloud-drive and translate it from the specified format into networkd unit files")
+	flag.StringVar(&flags.root, "root", "/", "Apply the cloud-config to the system found in the given directory, without running anything")
 	flag.StringVar(&flags.workspace, "workspace", "/var/lib/coreos-cloudinit", "Base directory coreos-cloudinit should use to store data")
 	flag.StringVar(&flags.sshKeyName, "ssh-key-name", initialize.DefaultSSHKeyName, "Add SSH keys to the system with the given name")
 	flag.BoolVar(&flags.validate, "validate", false, "[EXPERIMENTAL] Validate the user-data but do not apply it to the system")
+	flag.BoolVar(&flags.plan, "plan", false, "Print the changes which would be made to the system, without making them")
+	flag.StringVar(&flags.planFormat, "plan-format", "human", "Format in which the plan is printed: 'human' or 'json'")
+	flag.BoolVar(&flags.transactional, "transactional", false, "Restore the files and units changed by the cloud-config if applying it fails")
+	flag.IntVar(&flags.parallelUnits, "parallel-units", initialize.DefaultUnitParallelism, "Number of unit commands which are run at the same time, in the order given by the dependencies between the units")
+	flag.BoolVar(&flags.waitForScript, "wait-for-script", false, "Wait for a user-data script to exit, recording its output and exit status in the workspace and failing if it fails")
+	flag.DurationVar(&flags.networkTimeout, "network-timeout", initialize.DefaultNetworkTimeout, "Wait up to the given duration for the network interfaces to be configured before running unit commands (0 means no waiting)")
+	flag.DurationVar(&flags.scriptTimeout, "script-timeout", 0, "Kill a user-data script which hasn't exited within the given duration (requires --wait-for-script; 0 means no timeout)")
 }
 
 type oemConfig map[string]string
@@ -135,12 +153,21 @@ func main() {
 		os.Exit(0)
 	}
 
+	switch flags.planFormat {
+	case "human":
+	case "json":
+	default:
+		fmt.Printf("Invalid option to -plan-format: '%s'. Supported options: 'human, json'\n", flags.planFormat)
+		os.Exit(2)
+	}
+
 	switch flags.convertNetconf {
 	case "":
 	case "debian":
 	case "digitalocean":
+	case "netplan":
 	default:
-		fmt.Printf("Invalid option to -convert-netconf: '%s'. Supported options: 'debian, digitalocean'\n", flags.convertNetconf)
+		fmt.Printf("Invalid option to -convert-netconf: '%s'. Supported options: 'debian, digitalocean, netplan'\n", flags.convertNetconf)
 		os.Exit(2)
 	}
 
@@ -150,10 +177,15 @@ func main() {
 		os.Exit(2)
 	}
 
+	offline := path.Clean(flags.root) != "/"
+	cacheDir := path.Join(flags.root, flags.workspace, "cache")
 	ds := selectDatasource(dss)
 	if ds == nil {
 		fmt.Println("No datasources available in time")
-		os.Exit(1)
+		ds = selectCache(cacheDir)
+		if ds == nil {
+			os.Exit(1)
+		}
 	}
 
 	fmt.Printf("Fetching user-data from datasource of type %q\n", ds.Type())
@@ -163,7 +195,7 @@ func main() {
 		failure = true
 	}
 
-	if report, err := validate.Validate(userdataBytes); err == nil {
+	if report, err := validate.ValidateRoot(userdataBytes, flags.root); err == nil {
 		ret := 0
 		for _, e := range report.Entries() {
 			fmt.Println(e)
@@ -186,10 +218,30 @@ func main() {
 		os.Exit(1)
 	}
 
+	if ds.Type() != "cache" && !failure && !offline && !flags.plan {
+		if err := cache.Save(cacheDir, userdataBytes, metadata); err != nil {
+			fmt.Printf("Failed caching user-data and meta-data: %v\n", err)
+		}
+	}
+
 	// Apply environment to user-data
-	env := initialize.NewEnvironment("/", ds.ConfigRoot(), flags.workspace, flags.sshKeyName, metadata)
+	env := initialize.NewEnvironment(flags.root, ds.ConfigRoot(), flags.workspace, flags.sshKeyName, metadata)
 	userdata := env.Apply(string(userdataBytes))
 
+	env.SetTransactional(flags.transactional)
+	env.SetUnitParallelism(flags.parallelUnits)
+	env.SetNetworkTimeout(flags.networkTimeout)
+	if !offline && !system.SystemBusAvailable() {
+		fmt.Println("The system bus is unreachable, applying the cloud-config offline and queueing unit commands")
+		env.SetDetached(true)
+	}
+
+	var plan *initialize.Plan
+	if flags.plan {
+		plan = &initialize.Plan{}
+		env.SetPlan(plan)
+	}
+
 	var ccu *config.CloudConfig
 	var script *config.Script
 	if ud, err := initialize.ParseUserData(userdata); err != nil {
@@ -215,6 +267,8 @@ func main() {
 			ifaces, err = network.ProcessDebianNetconf(metadata.NetworkConfig)
 		case "digitalocean":
 			ifaces, err = network.ProcessDigitalOceanNetconf(metadata.NetworkConfig)
+		case "netplan":
+			ifaces, err = network.ProcessNetplanNetconf(metadata.NetworkConfig)
 		default:
 			err = fmt.Errorf("Unsupported network config format %q", flags.convertNetconf)
 		}
@@ -222,6 +276,7 @@ func main() {
 			fmt.Printf("Failed to generate interfaces: %v\n", err)
 			os.Exit(1)
 		}
+		network.SetLinkMTUs(ifaces, metadata.LinkMTUs)
 	}
 
 	if err = initialize.Apply(cc, ifaces, env); err != nil {
@@ -229,8 +284,20 @@ func main() {
 		os.Exit(1)
 	}
 
-	if script != nil {
-		if err = runScript(*script, env); err != nil {
+	if plan != nil {
+		if script != nil {
+			plan.Commands = append(plan.Commands, "user-data script")
+		}
+		printPlan(plan)
+		os.Exit(0)
+	}
+
+	if script != nil && offline {
+		fmt.Printf("Skipping script since %s is not the running system\n", flags.root)
+	} else if script != nil && env.Offline() {
+		fmt.Println("Skipping script since the system bus is unreachable")
+	} else if script != nil {
+		if err = initialize.RunScript(*script, env, flags.waitForScript, flags.scriptTimeout); err != nil {
 			fmt.Printf("Failed to run script: %v\n", err)
 			os.Exit(1)
 		}
@@ -241,6 +308,20 @@ func main() {
 	}
 }
 
+// printPlan prints the given plan in the format given by the flags.
+func printPlan(plan *initialize.Plan) {
+	if flags.planFormat != "json" {
+		fmt.Print(plan)
+		return
+	}
+	out, err := plan.JSON()
+	if err != nil {
+		fmt.Printf("Failed to encode plan: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(out))
+}
+
 // mergeConfigs merges certain options from md (meta-data from the datasource)
 // onto cc (a CloudConfig derived from user-data), if they are not already set
 // on cc (i.e. user-data always takes precedence)
@@ -296,6 +377,24 @@ func getDatasources() []datasource.Datasource {
 	return dss
 }
 
+// selectCache returns the datasource backed by the user-data and meta-data
+// cached in the given directory during a previous run, or nil if there is
+// none.
+func selectCache(dir string) datasource.Datasource {
+	c := cache.NewDatasource(dir)
+	if !c.IsAvailable() {
+		fmt.Println("No cached user-data and meta-data available")
+		return nil
+	}
+
+	if t, err := c.ModTime(); err == nil {
+		fmt.Printf("Falling back to user-data and meta-data cached at %s (%s ago)\n", t.Format(time.RFC3339), time.Since(t))
+	} else {
+		fmt.Printf("Falling back to cached user-data and meta-data of unknown age: %v\n", err)
+	}
+	return c
+}
+
 // selectDatasource attempts to choose a valid Datasource to use based on its
 // current availability. The first Datasource to report to be available is
 // returned. Datasources will be retried if possible if they are not
@@ -346,19 +445,3 @@ func selectDatasource(sources []datasource.Datasource) datasource.Datasource {
 	close(stop)
 	return s
 }
-
-// TODO(jonboulle): this should probably be refactored and moved into a different module
-func runScript(script config.Script, env *initialize.Environment) error {
-	err := initialize.PrepWorkspace(env.Workspace())
-	if err != nil {
-		fmt.Printf("Failed preparing workspace: %v\n", err)
-		return err
-	}
-	path, err := initialize.PersistScriptInWorkspace(script, env.Workspace())
-	if err == nil {
-		var name string
-		name, err = system.ExecuteScript(path)
-		initialize.PersistUnitNameInWorkspace(name, env.Workspace())
-	}
-	return err
-}
@@ -0,0 +1,130 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/coreos/coreos-cloudinit/datasource"
+)
+
+const (
+	userdataFile = "user-data"
+	metadataFile = "meta-data.json"
+)
+
+// cache is a datasource backed by the user-data and metadata which were last
+// fetched successfully from another datasource.
+type cache struct {
+	dir string
+}
+
+func NewDatasource(dir string) *cache {
+	return &cache{dir}
+}
+
+func (c *cache) IsAvailable() bool {
+	_, err := os.Stat(path.Join(c.dir, metadataFile))
+	return err == nil
+}
+
+func (c *cache) AvailabilityChanges() bool {
+	return false
+}
+
+func (c *cache) ConfigRoot() string {
+	return ""
+}
+
+func (c *cache) FetchMetadata() (metadata datasource.Metadata, err error) {
+	data, err := ioutil.ReadFile(path.Join(c.dir, metadataFile))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &metadata)
+	return
+}
+
+func (c *cache) FetchUserdata() ([]byte, error) {
+	data, err := ioutil.ReadFile(path.Join(c.dir, userdataFile))
+	if os.IsNotExist(err) {
+		return []byte{}, nil
+	}
+	return data, err
+}
+
+func (c *cache) Type() string {
+	return "cache"
+}
+
+// ModTime returns the time at which the cache was last written.
+func (c *cache) ModTime() (time.Time, error) {
+	info, err := os.Stat(path.Join(c.dir, metadataFile))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// Save replaces the contents of the cache with the given user-data and
+// metadata. Since both may contain secrets, the cache is only readable by its
+// owner.
+func Save(dir string, userdata []byte, metadata datasource.Metadata) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return err
+	}
+
+	md, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	// The metadata is written last since its presence marks the cache as
+	// available.
+	if err := writeFile(path.Join(dir, userdataFile), userdata); err != nil {
+		return err
+	}
+	return writeFile(path.Join(dir, metadataFile), md)
+}
+
+// writeFile atomically replaces the file at the given path with one
+// containing data, readable only by its owner.
+func writeFile(p string, data []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(p), "."+path.Base(p))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/coreos-cloudinit/datasource"
+)
+
+func TestSaveAndFetch(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewDatasource(path.Join(dir, "cache"))
+	if c.IsAvailable() {
+		t.Fatalf("bad availability of empty cache: want false, got true")
+	}
+
+	userdata := []byte("#cloud-config\nhostname: host\n")
+	metadata := datasource.Metadata{
+		InstanceID:    "i-0123abcd",
+		PublicIPv4:    net.ParseIP("1.2.3.4"),
+		PrivateIPv6:   net.ParseIP("fe00::"),
+		Hostname:      "host",
+		SSHPublicKeys: map[string]string{"0": "publickey"},
+		NetworkConfig: []byte("network"),
+	}
+	for i := 0; i < 2; i++ {
+		if err := Save(path.Join(dir, "cache"), userdata, metadata); err != nil {
+			t.Fatalf("bad error (%d): want nil, got %v", i, err)
+		}
+	}
+
+	if !c.IsAvailable() {
+		t.Fatalf("bad availability: want true, got false")
+	}
+	if ud, err := c.FetchUserdata(); err != nil || !reflect.DeepEqual(userdata, ud) {
+		t.Fatalf("bad user-data: want %q, got %q (%v)", userdata, ud, err)
+	}
+	if md, err := c.FetchMetadata(); err != nil || !reflect.DeepEqual(metadata, md) {
+		t.Fatalf("bad metadata: want %#v, got %#v (%v)", metadata, md, err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		perm os.FileMode
+	}{
+		{"", 0700},
+		{userdataFile, 0600},
+		{metadataFile, 0600},
+	} {
+		info, err := os.Stat(path.Join(dir, "cache", tt.name))
+		if err != nil {
+			t.Fatalf("Unable to stat %q: %v", tt.name, err)
+		}
+		if info.Mode().Perm() != tt.perm {
+			t.Errorf("bad permissions (%q): want %v, got %v", tt.name, tt.perm, info.Mode().Perm())
+		}
+	}
+
+	infos, err := ioutil.ReadDir(path.Join(dir, "cache"))
+	if err != nil {
+		t.Fatalf("Unable to read cache: %v", err)
+	}
+	if len(infos) != 2 {
+		t.Errorf("bad number of files: want 2, got %d", len(infos))
+	}
+}
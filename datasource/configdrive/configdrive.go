@@ -18,6 +18,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
 	"os"
 	"path"
 
@@ -55,6 +57,7 @@ func (cd *configDrive) FetchMetadata() (metadata datasource.Metadata, err error)
 	var m struct {
 		SSHAuthorizedKeyMap map[string]string `json:"public_keys"`
 		Hostname            string            `json:"hostname"`
+		UUID                string            `json:"uuid"`
 		NetworkConfig       struct {
 			ContentPath string `json:"content_path"`
 		} `json:"network_config"`
@@ -67,15 +70,57 @@ func (cd *configDrive) FetchMetadata() (metadata datasource.Metadata, err error)
 		return
 	}
 
+	metadata.InstanceID = m.UUID
 	metadata.SSHPublicKeys = m.SSHAuthorizedKeyMap
 	metadata.Hostname = m.Hostname
 	if m.NetworkConfig.ContentPath != "" {
-		metadata.NetworkConfig, err = cd.tryReadFile(path.Join(cd.openstackRoot(), m.NetworkConfig.ContentPath))
+		if metadata.NetworkConfig, err = cd.tryReadFile(path.Join(cd.openstackRoot(), m.NetworkConfig.ContentPath)); err != nil {
+			return
+		}
 	}
 
+	metadata.LinkMTUs = cd.fetchLinkMTUs()
 	return
 }
 
+// fetchLinkMTUs returns the MTUs of the links described in network_data.json,
+// keyed by MAC address, if the config drive has one. The MTUs are only a hint,
+// so a network_data.json which can't be read or parsed is logged and yields
+// no MTUs rather than an error.
+func (cd *configDrive) fetchLinkMTUs() map[string]int {
+	data, err := cd.tryReadFile(path.Join(cd.openstackVersionRoot(), "network_data.json"))
+	if err != nil {
+		log.Printf("Ignoring network_data.json: %v", err)
+		return nil
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	var n struct {
+		Links []struct {
+			MAC string `json:"ethernet_mac_address"`
+			MTU int    `json:"mtu"`
+		} `json:"links"`
+	}
+	if err := json.Unmarshal(data, &n); err != nil {
+		log.Printf("Ignoring network_data.json: %v", err)
+		return nil
+	}
+
+	var mtus map[string]int
+	for _, l := range n.Links {
+		mac, err := net.ParseMAC(l.MAC)
+		if err != nil || l.MTU <= 0 {
+			continue
+		}
+		if mtus == nil {
+			mtus = make(map[string]int)
+		}
+		mtus[mac.String()] = l.MTU
+	}
+	return mtus
+}
+
 func (cd *configDrive) FetchUserdata() ([]byte, error) {
 	return cd.tryReadFile(path.Join(cd.openstackVersionRoot(), "user_data"))
 }
@@ -42,14 +42,24 @@ func TestFetchMetadata(t *testing.T) {
 			files:    test.NewMockFilesystem(test.File{Path: "/openstack/latest/meta_data.json", Contents: `{"hostname": "host"}`}),
 			metadata: datasource.Metadata{Hostname: "host"},
 		},
+		{
+			root: "/",
+			files: test.NewMockFilesystem(test.File{Path: "/openstack/latest/meta_data.json", Contents: `{"hostname": "host"}`},
+				test.File{Path: "/openstack/latest/network_data.json", Contents: `{"links": [{"ethernet_mac_address": "fa:16:3e:9c:bf:3d", "mtu": "9000"}`},
+			),
+			metadata: datasource.Metadata{Hostname: "host"},
+		},
 		{
 			root: "/media/configdrive",
-			files: test.NewMockFilesystem(test.File{Path: "/media/configdrive/openstack/latest/meta_data.json", Contents: `{"hostname": "host", "network_config": {"content_path": "config_file.json"}, "public_keys":{"1": "key1", "2": "key2"}}`},
+			files: test.NewMockFilesystem(test.File{Path: "/media/configdrive/openstack/latest/meta_data.json", Contents: `{"hostname": "host", "uuid": "83679162-1378-4288-a2d4-70e13ec132aa", "network_config": {"content_path": "config_file.json"}, "public_keys":{"1": "key1", "2": "key2"}}`},
 				test.File{Path: "/media/configdrive/openstack/config_file.json", Contents: "make it work"},
+				test.File{Path: "/media/configdrive/openstack/latest/network_data.json", Contents: `{"links": [{"id": "tap1", "type": "ovs", "ethernet_mac_address": "FA:16:3E:9C:BF:3D", "mtu": 9000}, {"id": "tap2", "type": "ovs", "ethernet_mac_address": "fa:16:3e:00:00:01", "mtu": null}]}`},
 			),
 			metadata: datasource.Metadata{
+				InstanceID:    "83679162-1378-4288-a2d4-70e13ec132aa",
 				Hostname:      "host",
 				NetworkConfig: []byte("make it work"),
+				LinkMTUs:      map[string]int{"fa:16:3e:9c:bf:3d": 9000},
 				SSHPublicKeys: map[string]string{
 					"1": "key1",
 					"2": "key2",
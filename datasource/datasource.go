@@ -28,11 +28,15 @@ type Datasource interface {
 }
 
 type Metadata struct {
+	InstanceID    string
 	PublicIPv4    net.IP
 	PublicIPv6    net.IP
 	PrivateIPv4   net.IP
 	PrivateIPv6   net.IP
+	FloatingIPv4  net.IP
 	Hostname      string
 	SSHPublicKeys map[string]string
 	NetworkConfig []byte
+	// LinkMTUs holds the MTUs of the network links, keyed by MAC address.
+	LinkMTUs map[string]int
 }
@@ -101,6 +101,7 @@ func (scs *serverContextService) FetchMetadata() (metadata datasource.Metadata,
 		return
 	}
 
+	metadata.InstanceID = inputMetadata.UUID
 	if inputMetadata.Name != "" {
 		metadata.Hostname = inputMetadata.Name
 	} else {
@@ -38,10 +38,11 @@ type Address struct {
 }
 
 type Interface struct {
-	IPv4 *Address `json:"ipv4"`
-	IPv6 *Address `json:"ipv6"`
-	MAC  string   `json:"mac"`
-	Type string   `json:"type"`
+	IPv4       *Address `json:"ipv4"`
+	IPv6       *Address `json:"ipv6"`
+	AnchorIPv4 *Address `json:"anchor_ipv4"`
+	MAC        string   `json:"mac"`
+	Type       string   `json:"type"`
 }
 
 type Interfaces struct {
@@ -49,15 +50,26 @@ type Interfaces struct {
 	Private []Interface `json:"private"`
 }
 
+// FloatingIP describes the floating IP assigned to the droplet, whose traffic
+// is routed to the anchor IP of its public interface.
+type FloatingIP struct {
+	IPv4 struct {
+		Active    bool   `json:"active"`
+		IPAddress string `json:"ip_address"`
+	} `json:"ipv4"`
+}
+
 type DNS struct {
 	Nameservers []string `json:"nameservers"`
 }
 
 type Metadata struct {
+	DropletID  int        `json:"droplet_id"`
 	Hostname   string     `json:"hostname"`
 	Interfaces Interfaces `json:"interfaces"`
 	PublicKeys []string   `json:"public_keys"`
 	DNS        DNS        `json:"dns"`
+	FloatingIP FloatingIP `json:"floating_ip"`
 }
 
 type metadataService struct {
@@ -95,6 +107,12 @@ func (ms *metadataService) FetchMetadata() (metadata datasource.Metadata, err er
 			metadata.PrivateIPv6 = net.ParseIP(m.Interfaces.Private[0].IPv6.IPAddress)
 		}
 	}
+	if m.FloatingIP.IPv4.Active {
+		metadata.FloatingIPv4 = net.ParseIP(m.FloatingIP.IPv4.IPAddress)
+	}
+	if m.DropletID != 0 {
+		metadata.InstanceID = strconv.Itoa(m.DropletID)
+	}
 	metadata.Hostname = m.Hostname
 	metadata.SSHPublicKeys = map[string]string{}
 	for i, key := range m.PublicKeys {
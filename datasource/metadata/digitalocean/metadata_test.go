@@ -84,6 +84,7 @@ func TestFetchMetadata(t *testing.T) {
 }`,
 			},
 			expect: datasource.Metadata{
+				InstanceID: "1",
 				PublicIPv4: net.ParseIP("192.168.1.2"),
 				PublicIPv6: net.ParseIP("fe00::"),
 				SSHPublicKeys: map[string]string{
@@ -120,6 +121,31 @@ func TestFetchMetadata(t *testing.T) {
 }`),
 			},
 		},
+		{
+			root:         "/",
+			metadataPath: "v1.json",
+			resources: map[string]string{
+				"/v1.json": `{"droplet_id":2,"floating_ip":{"ipv4":{"active":true,"ip_address":"192.0.2.100"}}}`,
+			},
+			expect: datasource.Metadata{
+				InstanceID:    "2",
+				FloatingIPv4:  net.ParseIP("192.0.2.100"),
+				SSHPublicKeys: map[string]string{},
+				NetworkConfig: []byte(`{"droplet_id":2,"floating_ip":{"ipv4":{"active":true,"ip_address":"192.0.2.100"}}}`),
+			},
+		},
+		{
+			root:         "/",
+			metadataPath: "v1.json",
+			resources: map[string]string{
+				"/v1.json": `{"droplet_id":2,"floating_ip":{"ipv4":{"active":false}}}`,
+			},
+			expect: datasource.Metadata{
+				InstanceID:    "2",
+				SSHPublicKeys: map[string]string{},
+				NetworkConfig: []byte(`{"droplet_id":2,"floating_ip":{"ipv4":{"active":false}}}`),
+			},
+		},
 		{
 			clientErr: pkg.ErrTimeout{Err: fmt.Errorf("test error")},
 			expectErr: pkg.ErrTimeout{Err: fmt.Errorf("test error")},
@@ -137,7 +163,7 @@ func TestFetchMetadata(t *testing.T) {
 			t.Fatalf("bad error (%q): want %q, got %q", tt.resources, tt.expectErr, err)
 		}
 		if !reflect.DeepEqual(tt.expect, metadata) {
-			t.Fatalf("bad fetch (%q): want %#q, got %#q", tt.resources, tt.expect, metadata)
+			t.Fatalf("bad fetch (%q): want %#v, got %#v", tt.resources, tt.expect, metadata)
 		}
 	}
 }
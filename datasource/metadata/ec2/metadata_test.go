@@ -163,6 +163,7 @@ func TestFetchMetadata(t *testing.T) {
 			metadataPath: "2009-04-04/meta-data",
 			resources: map[string]string{
 				"/2009-04-04/meta-data/hostname":                  "host",
+				"/2009-04-04/meta-data/instance-id":               "i-0123abcd",
 				"/2009-04-04/meta-data/local-ipv4":                "1.2.3.4",
 				"/2009-04-04/meta-data/public-ipv4":               "5.6.7.8",
 				"/2009-04-04/meta-data/public-keys":               "0=test1\n",
@@ -170,6 +171,7 @@ func TestFetchMetadata(t *testing.T) {
 				"/2009-04-04/meta-data/public-keys/0/openssh-key": "key",
 			},
 			expect: datasource.Metadata{
+				InstanceID:    "i-0123abcd",
 				Hostname:      "host",
 				PrivateIPv4:   net.ParseIP("1.2.3.4"),
 				PublicIPv4:    net.ParseIP("5.6.7.8"),
@@ -0,0 +1,198 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package initialize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/coreos/coreos-cloudinit/config"
+	"github.com/coreos/coreos-cloudinit/system"
+)
+
+// executeCommand runs a single command in a transient unit. It is a variable
+// so that it can be replaced during testing.
+var executeCommand = system.RunTransientCommand
+
+// scriptFrequencies lists the script directories of the workspace in the
+// order in which they are run.
+var scriptFrequencies = []string{"per-once", "per-boot", "per-instance"}
+
+// runBootCommands runs the bootcmd entries of the given config. These are run
+// on every boot, before anything else is applied.
+func runBootCommands(cfg config.CloudConfig, env *Environment) error {
+	return runCommands("bootcmd", cfg.BootCmd, env)
+}
+
+// runRunCommands runs the runcmd entries of the given config. These are only
+// run once per instance; a marker containing the instance ID is kept in the
+// workspace after they have all succeeded.
+func runRunCommands(cfg config.CloudConfig, env *Environment) error {
+	if len(cfg.RunCmd) == 0 {
+		return nil
+	}
+
+	id, err := frequencyID("per-instance", env)
+	if err != nil {
+		return err
+	}
+	marker := path.Join(env.Workspace(), "commands", "runcmd.done")
+	if alreadyRun(marker, id) {
+		log.Printf("Commands in runcmd have already been run, skipping")
+		return nil
+	}
+
+	if err := runCommands("runcmd", cfg.RunCmd, env); err != nil {
+		return err
+	}
+
+	return markRun(marker, id)
+}
+
+// runCommands runs each of the given shell commands, in order. The output of
+// each command is written to <workspace>/commands/<kind>/<index>.log. The
+// first command to fail stops the run.
+func runCommands(kind string, cmds []string, env *Environment) error {
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	dir := path.Join(env.Workspace(), "commands", kind)
+	if err := system.EnsureDirectoryExists(dir); err != nil {
+		return err
+	}
+
+	for i, cmd := range cmds {
+		log.Printf("Running %s[%d] (%q)", kind, i, cmd)
+		output := path.Join(dir, fmt.Sprintf("%d.log", i))
+		if err := runCommand(kind, i, []string{"/bin/sh", "-c", cmd}, output, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runScriptDirectories runs the executables found in each of the
+// scripts/per-* directories of the workspace, in lexical order. Depending on
+// its directory, an executable is run once per boot, once per instance or
+// only once; a marker containing the boot or instance ID is kept in
+// <workspace>/commands/scripts-<frequency> for each one that succeeds. The
+// output of each executable is written next to its marker. A failing
+// executable doesn't prevent the others from being run.
+func runScriptDirectories(env *Environment) error {
+	var failed []string
+	for _, freq := range scriptFrequencies {
+		dir := path.Join(env.Workspace(), "scripts", freq)
+		infos, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		kind := "scripts-" + freq
+		state := path.Join(env.Workspace(), "commands", kind)
+		if err := system.EnsureDirectoryExists(state); err != nil {
+			return err
+		}
+
+		id, err := frequencyID(freq, env)
+		if err != nil {
+			log.Printf("Skipping scripts in %s: %v", freq, err)
+			continue
+		}
+		for i, info := range infos {
+			if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+				log.Printf("Skipping %s/%s since it isn't an executable file", freq, info.Name())
+				continue
+			}
+
+			marker := path.Join(state, info.Name()+".done")
+			if alreadyRun(marker, id) {
+				log.Printf("Script %s/%s has already been run, skipping", freq, info.Name())
+				continue
+			}
+
+			log.Printf("Running script %s/%s", freq, info.Name())
+			output := path.Join(state, info.Name()+".log")
+			if err := runCommand(kind, i, []string{path.Join(dir, info.Name())}, output, env); err != nil {
+				failed = append(failed, path.Join(freq, info.Name()))
+				continue
+			}
+			if err := markRun(marker, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed running scripts: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// runCommand runs the given command line to completion in a transient unit,
+// with the COREOS_* variables of the environment set, writing its output to
+// the given path.
+func runCommand(kind string, index int, command []string, output string, env *Environment) error {
+	res, err := executeCommand(system.TransientCommand{
+		Name:        fmt.Sprintf("coreos-cloudinit-%d-%s-%d.service", os.Getpid(), kind, index),
+		Description: fmt.Sprintf("Command %s[%d] executed by coreos-cloudinit on behalf of user", kind, index),
+		Command:     command,
+		Output:      output,
+		Environment: env.VariableList(),
+	})
+	if err != nil {
+		log.Printf("Failed running %s[%d]: %v", kind, index, err)
+		return err
+	}
+	log.Printf("Result of %s[%d]: %s", kind, index, res.Result)
+	return nil
+}
+
+// frequencyID returns the identifier recorded in the markers of commands
+// which are run with the given frequency: the boot ID for "per-boot", the
+// instance ID for "per-instance" and a constant for "per-once". An error is
+// returned when the boot ID is unavailable, since an empty identifier would
+// match every later boot.
+func frequencyID(freq string, env *Environment) (string, error) {
+	switch freq {
+	case "per-boot":
+		id, err := system.BootID()
+		if err != nil {
+			return "", fmt.Errorf("unable to determine the boot ID: %v", err)
+		}
+		return id, nil
+	case "per-instance":
+		return env.InstanceID(), nil
+	default:
+		return "once", nil
+	}
+}
+
+// alreadyRun returns whether or not the given marker exists and records id.
+func alreadyRun(marker, id string) bool {
+	done, err := ioutil.ReadFile(marker)
+	return err == nil && strings.TrimSpace(string(done)) == id
+}
+
+// markRun records id in the given marker.
+func markRun(marker, id string) error {
+	return ioutil.WriteFile(marker, []byte(id+"\n"), 0644)
+}
@@ -0,0 +1,173 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package initialize
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/coreos-cloudinit/config"
+	"github.com/coreos/coreos-cloudinit/datasource"
+	"github.com/coreos/coreos-cloudinit/system"
+)
+
+func stubExecuteCommand(ran *[]string, fail string) func(system.TransientCommand) (system.CommandResult, error) {
+	return func(c system.TransientCommand) (system.CommandResult, error) {
+		command := c.Command[len(c.Command)-1]
+		*ran = append(*ran, command)
+		if command == fail {
+			return system.CommandResult{Unit: c.Name, Result: "failed", ExitStatus: 1}, errors.New("command failed")
+		}
+		return system.CommandResult{Unit: c.Name, Result: "done"}, nil
+	}
+}
+
+func TestRunCommands(t *testing.T) {
+	defer func(e func(system.TransientCommand) (system.CommandResult, error)) { executeCommand = e }(executeCommand)
+
+	for i, tt := range []struct {
+		cmds []string
+		fail string
+
+		ran []string
+		err bool
+	}{
+		{},
+		{
+			cmds: []string{"echo a", "echo b", "echo c"},
+			ran:  []string{"echo a", "echo b", "echo c"},
+		},
+		{
+			cmds: []string{"echo a", "false", "echo c"},
+			fail: "false",
+			ran:  []string{"echo a", "false"},
+			err:  true,
+		},
+	} {
+		dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+		if err != nil {
+			t.Fatalf("Unable to create tempdir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		var ran []string
+		executeCommand = stubExecuteCommand(&ran, tt.fail)
+		env := NewEnvironment("/", "", dir, "", datasource.Metadata{})
+		err = runCommands("bootcmd", tt.cmds, env)
+		if (err != nil) != tt.err {
+			t.Errorf("bad error (%d): want %t, got %v", i, tt.err, err)
+		}
+		if !reflect.DeepEqual(tt.ran, ran) {
+			t.Errorf("bad commands (%d): want %q, got %q", i, tt.ran, ran)
+		}
+	}
+}
+
+func TestRunRunCommandsOnce(t *testing.T) {
+	defer func(e func(system.TransientCommand) (system.CommandResult, error)) { executeCommand = e }(executeCommand)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(path.Join(dir, "etc"), 0755); err != nil {
+		t.Fatalf("Unable to create etc: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "etc", "machine-id"), []byte("node1\n"), 0644); err != nil {
+		t.Fatalf("Unable to write machine-id: %v", err)
+	}
+
+	env := NewEnvironment(dir, "", "/var/lib/coreos-cloudinit", "", datasource.Metadata{})
+	cfg := config.CloudConfig{RunCmd: []string{"echo once"}}
+
+	var ran []string
+	executeCommand = stubExecuteCommand(&ran, "")
+	for i := 0; i < 2; i++ {
+		if err := runRunCommands(cfg, env); err != nil {
+			t.Fatalf("bad error (%d): want nil, got %v", i, err)
+		}
+	}
+	if !reflect.DeepEqual([]string{"echo once"}, ran) {
+		t.Fatalf("bad commands: want %q, got %q", []string{"echo once"}, ran)
+	}
+
+	env = NewEnvironment(dir, "", "/var/lib/coreos-cloudinit", "", datasource.Metadata{InstanceID: "i-2"})
+	if err := runRunCommands(cfg, env); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	if !reflect.DeepEqual([]string{"echo once", "echo once"}, ran) {
+		t.Fatalf("bad commands: want %q, got %q", []string{"echo once", "echo once"}, ran)
+	}
+}
+
+func TestRunScriptDirectories(t *testing.T) {
+	defer func(e func(system.TransientCommand) (system.CommandResult, error)) { executeCommand = e }(executeCommand)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := NewEnvironment(dir, "", "/var/lib/coreos-cloudinit", "", datasource.Metadata{})
+	if err := PrepWorkspace(env.Workspace()); err != nil {
+		t.Fatalf("Unable to prepare workspace: %v", err)
+	}
+	for _, f := range []struct {
+		path string
+		perm os.FileMode
+	}{
+		{"per-boot/10-first", 0755},
+		{"per-boot/20-second", 0755},
+		{"per-boot/README", 0644},
+		{"per-instance/fail", 0755},
+		{"per-once/once", 0700},
+	} {
+		if err := ioutil.WriteFile(path.Join(env.Workspace(), "scripts", f.path), []byte("#!/bin/sh\n"), f.perm); err != nil {
+			t.Fatalf("Unable to write script: %v", err)
+		}
+	}
+
+	var ran []string
+	executeCommand = func(c system.TransientCommand) (system.CommandResult, error) {
+		script := path.Base(c.Command[0])
+		ran = append(ran, script)
+		if script == "fail" {
+			return system.CommandResult{Unit: c.Name, Result: "failed", ExitStatus: 1}, errors.New("script failed")
+		}
+		return system.CommandResult{Unit: c.Name, Result: "done"}, nil
+	}
+
+	if err := runScriptDirectories(env); err == nil {
+		t.Errorf("bad error: want non-nil, got nil")
+	}
+	if expect := []string{"once", "10-first", "20-second", "fail"}; !reflect.DeepEqual(expect, ran) {
+		t.Errorf("bad scripts: want %q, got %q", expect, ran)
+	}
+
+	ran = nil
+	if err := runScriptDirectories(env); err == nil {
+		t.Errorf("bad error: want non-nil, got nil")
+	}
+	if expect := []string{"fail"}; !reflect.DeepEqual(expect, ran) {
+		t.Errorf("bad scripts: want %q, got %q", expect, ran)
+	}
+}
@@ -18,7 +18,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"os"
 	"path"
+	"strings"
 
 	"github.com/coreos/coreos-cloudinit/config"
 	"github.com/coreos/coreos-cloudinit/network"
@@ -41,96 +43,157 @@ type CloudConfigUnit interface {
 
 // Apply renders a CloudConfig to an Environment. This can involve things like
 // configuring the hostname, adding new users, writing various configuration
-// files to disk, and manipulating systemd services.
+// files to disk, manipulating systemd services, and running user commands.
+// If the environment is transactional, the files and units changed are
+// restored if any step fails, and a transaction left open by an interrupted
+// run is rolled back first.
 func Apply(cfg config.CloudConfig, ifaces []network.InterfaceGenerator, env *Environment) error {
-	if cfg.Hostname != "" {
-		if err := system.SetHostname(cfg.Hostname); err != nil {
-			return err
-		}
-		log.Printf("Set hostname to %s", cfg.Hostname)
+	if !env.Transactional() {
+		return apply(cfg, ifaces, env)
 	}
 
-	for _, user := range cfg.Users {
-		if user.Name == "" {
-			log.Printf("User object has no 'name' field, skipping")
-			continue
+	if recovered, err := RecoverTransaction(env.Workspace()); err != nil {
+		return fmt.Errorf("unable to roll back the interrupted transaction: %v", err)
+	} else if recovered {
+		if err := env.UnitManager().DaemonReload(); err != nil {
+			log.Printf("Failed systemd daemon-reload: %v", err)
 		}
+	}
 
-		if system.UserExists(&user) {
-			log.Printf("User '%s' exists, ignoring creation-time fields", user.Name)
-			if user.PasswordHash != "" {
-				log.Printf("Setting '%s' user's password", user.Name)
-				if err := system.SetUserPassword(user.Name, user.PasswordHash); err != nil {
-					log.Printf("Failed setting '%s' user's password: %v", user.Name, err)
-					return err
-				}
-			}
-		} else {
-			log.Printf("Creating user '%s'", user.Name)
-			if err := system.CreateUser(&user); err != nil {
-				log.Printf("Failed creating user '%s': %v", user.Name, err)
-				return err
-			}
-		}
+	tx, err := NewTransaction(env.Workspace())
+	if err != nil {
+		return err
+	}
+	env.tx = tx
+	err = apply(cfg, ifaces, env)
+	env.tx = nil
 
-		if len(user.SSHAuthorizedKeys) > 0 {
-			log.Printf("Authorizing %d SSH keys for user '%s'", len(user.SSHAuthorizedKeys), user.Name)
-			if err := system.AuthorizeSSHKeys(user.Name, env.SSHKeyName(), user.SSHAuthorizedKeys); err != nil {
-				return err
-			}
+	if err == nil {
+		return tx.Commit()
+	}
+
+	log.Printf("Rolling back changes: %v", err)
+	if rerr := tx.Rollback(err); rerr != nil {
+		log.Printf("Failed rolling back changes: %v", rerr)
+	}
+	if rerr := env.UnitManager().DaemonReload(); rerr != nil {
+		log.Printf("Failed systemd daemon-reload: %v", rerr)
+	}
+	return err
+}
+
+func apply(cfg config.CloudConfig, ifaces []network.InterfaceGenerator, env *Environment) error {
+	report := &failureReport{policy: cfg.ErrorPolicy}
+
+	if env.plan != nil {
+		env.plan.recordCommands("bootcmd", cfg.BootCmd)
+	}
+	if !env.Runtime() {
+		log.Printf("Applying cloud-config to %s, skipping runtime commands", env.Root())
+	} else if err := runBootCommands(cfg, env); err != nil {
+		if err := report.fail("bootcmd", "bootcmd", err); err != nil {
+			return err
 		}
-		if user.SSHImportGithubUser != "" {
-			log.Printf("Authorizing github user %s SSH keys for CoreOS user '%s'", user.SSHImportGithubUser, user.Name)
-			if err := SSHImportGithubUser(user.Name, user.SSHImportGithubUser); err != nil {
+	}
+
+	if cfg.Hostname != "" {
+		if err := env.SetHostname(cfg.Hostname); err != nil {
+			if err := report.fail("hostname", "hostname", err); err != nil {
 				return err
 			}
+		} else {
+			log.Printf("Set hostname to %s", cfg.Hostname)
 		}
-		for _, u := range user.SSHImportGithubUsers {
-			log.Printf("Authorizing github user %s SSH keys for CoreOS user '%s'", u, user.Name)
-			if err := SSHImportGithubUser(user.Name, u); err != nil {
-				return err
-			}
+	}
+
+	state, err := LoadState(env.Workspace())
+	if err != nil {
+		if err := report.fail("", "state", err); err != nil {
+			return err
 		}
-		if user.SSHImportURL != "" {
-			log.Printf("Authorizing SSH keys for CoreOS user '%s' from '%s'", user.Name, user.SSHImportURL)
-			if err := SSHImportKeysFromURL(user.Name, user.SSHImportURL); err != nil {
+	}
+
+	users := env.UserManager()
+
+	for i, user := range cfg.Users {
+		if err := applyUser(user, users, env); err != nil {
+			if err := report.fail("users", fmt.Sprintf("users[%d] (%q)", i, user.Name), err); err != nil {
 				return err
 			}
 		}
 	}
 
 	if len(cfg.SSHAuthorizedKeys) > 0 {
-		err := system.AuthorizeSSHKeys("core", env.SSHKeyName(), cfg.SSHAuthorizedKeys)
+		err := users.AuthorizeSSHKeys("core", env.SSHKeyName(), cfg.SSHAuthorizedKeys)
 		if err == nil {
 			log.Printf("Authorized SSH keys for core user")
-		} else {
+		} else if err := report.fail("ssh_authorized_keys", "ssh_authorized_keys", err); err != nil {
 			return err
 		}
 	}
 
 	var writeFiles []system.File
-	for _, file := range cfg.WriteFiles {
+	var locations []string
+	for i, file := range cfg.WriteFiles {
 		writeFiles = append(writeFiles, system.File{File: file})
+		locations = append(locations, fmt.Sprintf("write_files[%d] (%q)", i, file.Path))
 	}
 
-	for _, ccf := range []CloudConfigFile{
-		system.OEM{OEM: cfg.CoreOS.OEM},
-		system.Update{Update: cfg.CoreOS.Update, ReadConfig: system.DefaultReadConfig},
-		system.EtcHosts{EtcHosts: cfg.ManageEtcHosts},
-		system.Flannel{Flannel: cfg.CoreOS.Flannel},
+	for _, ccf := range []struct {
+		location string
+		CloudConfigFile
+	}{
+		{"coreos.oem", system.OEM{OEM: cfg.CoreOS.OEM}},
+		{"coreos.update", system.Update{Update: cfg.CoreOS.Update, ReadConfig: system.DefaultReadConfig}},
+		{"manage_etc_hosts", system.EtcHosts{EtcHosts: cfg.ManageEtcHosts}},
+		{"coreos.flannel", system.Flannel{Flannel: cfg.CoreOS.Flannel}},
 	} {
 		f, err := ccf.File()
 		if err != nil {
-			return err
+			if err := report.fail("write_files", ccf.location, err); err != nil {
+				return err
+			}
+			continue
 		}
 		if f != nil {
 			writeFiles = append(writeFiles, *f)
+			locations = append(locations, ccf.location)
+		}
+	}
+
+	// Stage the files so that invalid content is caught before anything is
+	// written.
+	valid := make([]bool, len(writeFiles))
+	for i, file := range writeFiles {
+		if _, err := config.DecodeContent(file.Content, file.Encoding); err != nil {
+			err = fmt.Errorf("Unable to decode %s (%v)", file.Path, err)
+			if err := report.fail("write_files", locations[i], err); err != nil {
+				return err
+			}
+		} else if _, err := file.Permissions(); err != nil {
+			if err := report.fail("write_files", locations[i], err); err != nil {
+				return err
+			}
+		} else if env.tx != nil {
+			if err := env.tx.Stage(&writeFiles[i], env.Root()); err != nil {
+				if err := report.fail("write_files", locations[i], err); err != nil {
+					return err
+				}
+			} else {
+				valid[i] = true
+			}
+		} else {
+			valid[i] = true
 		}
 	}
 
 	var units []system.Unit
 	for _, u := range cfg.CoreOS.Units {
-		units = append(units, system.Unit{Unit: u})
+		if u.OncePerInstance && !env.FirstBoot() {
+			log.Printf("Unit %q is only processed on the first boot of the instance, skipping", u.Name)
+			continue
+		}
+		units = append(units, system.Unit{Unit: u}.Expand()...)
 	}
 
 	for _, ccu := range []CloudConfigUnit{
@@ -144,37 +207,189 @@ func Apply(cfg config.CloudConfig, ifaces []network.InterfaceGenerator, env *Env
 	}
 
 	wroteEnvironment := false
-	for _, file := range writeFiles {
-		fullPath, err := system.WriteFile(&file, env.Root())
-		if err != nil {
-			return err
-		}
+	for i, file := range writeFiles {
 		if path.Clean(file.Path) == "/etc/environment" {
 			wroteEnvironment = true
 		}
-		log.Printf("Wrote file %s to filesystem", fullPath)
+		if !valid[i] {
+			continue
+		}
+		fullPath := path.Join(env.Root(), file.Path)
+		if system.FileUnchanged(&file, env.Root()) {
+			log.Printf("File %s is unchanged", fullPath)
+		} else if _, err := env.WriteFile(&file); err != nil {
+			if err := report.fail("write_files", locations[i], err); err != nil {
+				return err
+			}
+			continue
+		} else {
+			log.Printf("Wrote file %s to filesystem", fullPath)
+		}
+		if content, err := config.DecodeContent(file.Content, file.Encoding); err == nil {
+			state.Record(fullPath, content)
+		}
 	}
 
 	if !wroteEnvironment {
-		ef := env.DefaultEnvironmentFile()
-		if ef != nil {
-			err := system.WriteEnvFile(ef, env.Root())
-			if err != nil {
+		if err := writeDefaultEnvironmentFile(env); err != nil {
+			if err := report.fail("", "/etc/environment", err); err != nil {
 				return err
 			}
-			log.Printf("Updated /etc/environment")
 		}
 	}
 
+	if len(cfg.CoreOS.Network.Interfaces) > 0 {
+		if generators, err := network.ProcessCloudConfigNetwork(cfg.CoreOS.Network); err != nil {
+			if err := report.fail("", "coreos.network", err); err != nil {
+				return err
+			}
+		} else {
+			ifaces = append(ifaces, generators...)
+		}
+	}
+
+	var links []string
 	if len(ifaces) > 0 {
 		units = append(units, createNetworkingUnits(ifaces)...)
-		if err := system.RestartNetwork(ifaces); err != nil {
+		var err error
+		if links, err = env.PrepareNetwork(ifaces); err != nil {
+			if err := report.fail("", "network", err); err != nil {
+				return err
+			}
+		}
+	}
+
+	if env.Runtime() {
+		if err := runQueuedUnitCommands(env.UnitCommandQueue(), env.UnitManager(), report); err != nil {
 			return err
 		}
 	}
 
-	um := system.NewUnitManager(env.Root())
-	return processUnits(units, env.Root(), um)
+	parallel := env.UnitParallelism()
+	if !env.Runtime() {
+		parallel = 1
+	}
+	var waitForNetwork func() error
+	if len(ifaces) > 0 {
+		addressed := addressedInterfaces(ifaces)
+		waitForNetwork = func() error {
+			return reportInterfaces(addressed, env.WaitForNetwork(addressed), report)
+		}
+	}
+	if err := processUnits(units, env.Root(), env.UnitManager(), state, report, parallel, links, waitForNetwork); err != nil {
+		return err
+	}
+	if env.Runtime() && state != nil {
+		if err := state.Save(env.tx); err != nil {
+			if err := report.fail("", "state", err); err != nil {
+				return err
+			}
+		}
+	}
+
+	if env.plan != nil {
+		env.plan.recordCommands("runcmd", cfg.RunCmd)
+	}
+	if !env.Runtime() {
+		return report.err()
+	}
+
+	if err := runRunCommands(cfg, env); err != nil {
+		if err := report.fail("runcmd", "runcmd", err); err != nil {
+			return err
+		}
+	}
+
+	if err := PrepWorkspace(env.Workspace()); err != nil {
+		if err := report.fail("", "workspace", err); err != nil {
+			return err
+		}
+	} else if err := runScriptDirectories(env); err != nil {
+		if err := report.fail("", "scripts", err); err != nil {
+			return err
+		}
+	}
+
+	// The instance is only recorded once everything has been applied, so
+	// that a partial failure is retried as a first boot.
+	if err := report.err(); err != nil {
+		return err
+	}
+	return PersistInstanceInWorkspace(env)
+}
+
+// applyUser creates or updates the given user and authorizes its SSH keys.
+func applyUser(user config.User, users system.UserManager, env *Environment) error {
+	if user.Name == "" {
+		log.Printf("User object has no 'name' field, skipping")
+		return nil
+	}
+
+	if user.OncePerInstance && !env.FirstBoot() {
+		log.Printf("User '%s' is only configured on the first boot of the instance, skipping", user.Name)
+		return nil
+	}
+
+	if users.UserExists(&user) {
+		log.Printf("User '%s' exists, ignoring creation-time fields", user.Name)
+		if user.PasswordHash != "" {
+			log.Printf("Setting '%s' user's password", user.Name)
+			if err := users.SetUserPassword(user.Name, user.PasswordHash); err != nil {
+				log.Printf("Failed setting '%s' user's password: %v", user.Name, err)
+				return err
+			}
+		}
+	} else {
+		log.Printf("Creating user '%s'", user.Name)
+		if err := users.CreateUser(&user); err != nil {
+			log.Printf("Failed creating user '%s': %v", user.Name, err)
+			return err
+		}
+	}
+
+	if len(user.SSHAuthorizedKeys) > 0 {
+		log.Printf("Authorizing %d SSH keys for user '%s'", len(user.SSHAuthorizedKeys), user.Name)
+		if err := users.AuthorizeSSHKeys(user.Name, env.SSHKeyName(), user.SSHAuthorizedKeys); err != nil {
+			return err
+		}
+	}
+	if user.SSHImportGithubUser != "" {
+		log.Printf("Authorizing github user %s SSH keys for CoreOS user '%s'", user.SSHImportGithubUser, user.Name)
+		if err := SSHImportGithubUser(users, user.Name, user.SSHImportGithubUser); err != nil {
+			return err
+		}
+	}
+	for _, u := range user.SSHImportGithubUsers {
+		log.Printf("Authorizing github user %s SSH keys for CoreOS user '%s'", u, user.Name)
+		if err := SSHImportGithubUser(users, user.Name, u); err != nil {
+			return err
+		}
+	}
+	if user.SSHImportURL != "" {
+		log.Printf("Authorizing SSH keys for CoreOS user '%s' from '%s'", user.Name, user.SSHImportURL)
+		if err := SSHImportKeysFromURL(users, user.Name, user.SSHImportURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDefaultEnvironmentFile updates /etc/environment with the COREOS_*
+// variables of the environment.
+func writeDefaultEnvironmentFile(env *Environment) error {
+	ef := env.DefaultEnvironmentFile()
+	if ef == nil {
+		return nil
+	}
+	changed, err := system.MergeEnvFile(ef, env.Root())
+	if err != nil || !changed {
+		return err
+	}
+	if _, err := env.WriteFile(ef.File); err != nil {
+		return err
+	}
+	log.Printf("Updated /etc/environment")
+	return nil
 }
 
 func createNetworkingUnits(interfaces []network.InterfaceGenerator) (units []system.Unit) {
@@ -199,96 +414,275 @@ func createNetworkingUnits(interfaces []network.InterfaceGenerator) (units []sys
 // processUnits takes a set of Units and applies them to the given root using
 // the given UnitManager. This can involve things like writing unit files to
 // disk, masking/unmasking units, or invoking systemd
-// commands against units. It returns any error encountered.
-func processUnits(units []system.Unit, root string, um system.UnitManager) error {
-	type action struct {
-		unit    system.Unit
-		command string
-	}
-	actions := make([]action, 0, len(units))
+// commands against units. Failures are recorded in the given report, and any
+// error to return is returned. Unit files and drop-ins which are already in
+// place aren't rewritten, and systemd is only reloaded if one of them was. A
+// unit counts as changed if one of its files, or those of its template, was
+// rewritten or if they differ from those recorded in the given state, in
+// which case "restart-on-change" restarts it; otherwise the command is
+// skipped. If a network unit changed or links are given, systemd-networkd
+// reloads its configuration and reconfigures the given links, leaving the
+// others alone. The commands are run once that is done and, if waitForNetwork
+// is given, it has returned, in the order given by the dependencies between
+// the units, with at most parallel of them running at a time. The state is
+// updated for every unit which was processed successfully.
+func processUnits(units []system.Unit, root string, um system.UnitManager, state *State, report *failureReport, parallel int, links []string, waitForNetwork func() error) error {
+	actions := make([]unitAction, 0, len(units))
+	failed := map[string]bool{}
+	templates := map[string]bool{}
 	reload := false
-	restartNetworkd := false
+	reloadNetwork := len(links) > 0
 	for _, unit := range units {
 		if unit.Name == "" {
 			log.Printf("Skipping unit without name")
 			continue
 		}
 
-		if unit.Content != "" {
-			log.Printf("Writing unit %q to filesystem", unit.Name)
-			if err := um.PlaceUnit(unit); err != nil {
+		placed, changed, err := prepareUnit(unit, root, um, state)
+		reload = reload || placed
+		if unit.IsTemplate() {
+			templates[unit.Name] = changed
+		} else if unit.Template() != "" {
+			changed = changed || templates[unit.Template()]
+		}
+		if err != nil {
+			failed[unit.Name] = true
+			if err := report.fail("units", unitLocation(unit), err); err != nil {
 				return err
 			}
-			log.Printf("Wrote unit %q", unit.Name)
-			reload = true
+			continue
 		}
 
-		for _, dropin := range unit.DropIns {
-			if dropin.Name != "" && dropin.Content != "" {
-				log.Printf("Writing drop-in unit %q to filesystem", dropin.Name)
-				if err := um.PlaceUnitDropIn(unit, dropin); err != nil {
-					return err
-				}
-				log.Printf("Wrote drop-in unit %q", dropin.Name)
-				reload = true
+		if unit.Group() == "network" {
+			reloadNetwork = reloadNetwork || changed
+		} else if unit.Command == "restart-on-change" {
+			if changed {
+				actions = append(actions, unitAction{unit, "restart"})
+			} else {
+				log.Printf("Unit %q is unchanged, not restarting", unit.Name)
 			}
+		} else if unit.Command != "" {
+			actions = append(actions, unitAction{unit, unit.Command})
 		}
+	}
 
-		if unit.Mask {
-			log.Printf("Masking unit file %q", unit.Name)
-			if err := um.MaskUnit(unit); err != nil {
+	if reload {
+		if err := um.DaemonReload(); err != nil {
+			err = errors.New(fmt.Sprintf("failed systemd daemon-reload: %s", err))
+			if err := report.fail("units", "coreos.units", err); err != nil {
 				return err
 			}
-		} else if unit.Runtime {
-			log.Printf("Ensuring runtime unit file %q is unmasked", unit.Name)
-			if err := um.UnmaskUnit(unit); err != nil {
+		}
+	}
+
+	if reloadNetwork {
+		log.Printf("Reloading systemd-networkd")
+		if err := um.ReloadNetwork(links); err != nil {
+			if err := report.fail("", "network", err); err != nil {
 				return err
 			}
 		}
+	}
 
-		if unit.Enable {
-			if unit.Group() != "network" {
-				log.Printf("Enabling unit file %q", unit.Name)
-				if err := um.EnableUnitFile(unit); err != nil {
-					return err
-				}
-				log.Printf("Enabled unit %q", unit.Name)
-			} else {
-				log.Printf("Skipping enable for network-like unit %q", unit.Name)
-			}
+	if waitForNetwork != nil {
+		if err := waitForNetwork(); err != nil {
+			return err
 		}
+	}
 
-		if unit.Group() == "network" {
-			restartNetworkd = true
-		} else if unit.Command != "" {
-			actions = append(actions, action{unit, unit.Command})
+	errs := runUnitActions(actions, units, root, um, parallel, !report.continues("units"))
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		failed[actions[i].unit.Name] = true
+		if err == errNotRun {
+			continue
+		}
+		if err := report.fail("units", unitLocation(actions[i].unit), err); err != nil {
+			return err
 		}
 	}
 
-	if reload {
-		if err := um.DaemonReload(); err != nil {
-			return errors.New(fmt.Sprintf("failed systemd daemon-reload: %s", err))
+	for _, unit := range units {
+		if unit.Name != "" && !failed[unit.Name] {
+			state.Record(unit.Destination(root), unitContent(unit))
 		}
 	}
 
-	if restartNetworkd {
-		log.Printf("Restarting systemd-networkd")
-		networkd := system.Unit{Unit: config.Unit{Name: "systemd-networkd.service"}}
-		res, err := um.RunUnitCommand(networkd, "restart")
-		if err != nil {
+	return nil
+}
+
+// addressedInterfaces returns those of the given interfaces which have
+// addresses to wait for, leaving out e.g. bond slaves and bridge ports.
+func addressedInterfaces(interfaces []network.InterfaceGenerator) []network.InterfaceGenerator {
+	var addressed []network.InterfaceGenerator
+	for _, iface := range interfaces {
+		if strings.Contains(iface.Network(), "\nAddress=") || strings.Contains(iface.Network(), "\nDHCP=") {
+			addressed = append(addressed, iface)
+		}
+	}
+	return addressed
+}
+
+// reportInterfaces records a failure in the network section for each of the
+// given interfaces which wasn't configured, according to the given errors.
+// Those which were configured have already been logged while waiting.
+func reportInterfaces(interfaces []network.InterfaceGenerator, errs []error, report *failureReport) error {
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		name := interfaces[i].Name()
+		if name == "" {
+			name = interfaces[i].Hwaddr().String()
+		}
+		if err := report.fail("network", fmt.Sprintf("network interface %s", name), err); err != nil {
 			return err
 		}
-		log.Printf("Restarted systemd-networkd (%s)", res)
 	}
+	return nil
+}
 
-	for _, action := range actions {
-		log.Printf("Calling unit command %q on %q'", action.command, action.unit.Name)
-		res, err := um.RunUnitCommand(action.unit, action.command)
+// runQueuedUnitCommands runs the unit commands queued by earlier runs during
+// which systemd couldn't be reached. The commands which failed, or weren't
+// run because of an earlier failure, are left in the queue for the next run.
+func runQueuedUnitCommands(queue string, um system.UnitManager, report *failureReport) error {
+	commands, err := system.ReadQueuedCommands(queue)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return report.fail("units", "queued unit commands", err)
+	}
+
+	var remaining []system.QueuedCommand
+	for i, c := range commands {
+		unit := system.Unit{Unit: config.Unit{Name: c.Unit}}
+		log.Printf("Calling queued unit command %q on %q", c.Command, c.Unit)
+		res, err := um.RunUnitCommand(unit, c.Command)
 		if err != nil {
-			return err
+			remaining = append(remaining, c)
+			if err := report.fail("units", unitLocation(unit), err); err != nil {
+				remaining = append(remaining, commands[i+1:]...)
+				if werr := system.WriteQueuedCommands(queue, remaining); werr != nil {
+					log.Printf("Failed rewriting the queued unit commands: %v", werr)
+				}
+				return err
+			}
+			continue
 		}
-		log.Printf("Result of %q on %q: %s", action.command, action.unit.Name, res)
+		log.Printf("Result of queued %q on %q: %s", c.Command, c.Unit, res)
 	}
 
+	if err := system.WriteQueuedCommands(queue, remaining); err != nil {
+		return report.fail("units", "queued unit commands", err)
+	}
 	return nil
 }
+
+// prepareUnit places the files of the given unit, unless they are already in
+// place, or removes them, and disables, masks, unmasks, enables or presets
+// it. It returns whether or not any file was placed or removed and whether
+// or not the unit changed.
+func prepareUnit(unit system.Unit, root string, um system.UnitManager, state *State) (placed bool, changed bool, err error) {
+	if err = unit.Conflict(); err != nil {
+		return
+	}
+
+	if unit.Content != "" {
+		if unitFileUnchanged(unit.Destination(root), unit.Content) {
+			log.Printf("Unit %q is unchanged", unit.Name)
+		} else {
+			log.Printf("Writing unit %q to filesystem", unit.Name)
+			if err = um.PlaceUnit(unit); err != nil {
+				return
+			}
+			log.Printf("Wrote unit %q", unit.Name)
+			placed = true
+		}
+	}
+
+	for _, dropin := range unit.DropIns {
+		if dropin.Name != "" && dropin.Content != "" {
+			if unitFileUnchanged(unit.DropInDestination(root, dropin), dropin.Content) {
+				log.Printf("Drop-in unit %q is unchanged", dropin.Name)
+				continue
+			}
+			log.Printf("Writing drop-in unit %q to filesystem", dropin.Name)
+			if err = um.PlaceUnitDropIn(unit, dropin); err != nil {
+				return
+			}
+			log.Printf("Wrote drop-in unit %q", dropin.Name)
+			placed = true
+		}
+	}
+	if unit.Disable {
+		if unit.Group() != "network" {
+			log.Printf("Disabling unit file %q", unit.Name)
+			if err = um.DisableUnitFile(unit); err != nil {
+				return
+			}
+		} else {
+			log.Printf("Skipping disable for network-like unit %q", unit.Name)
+		}
+	}
+
+	if unit.Remove {
+		log.Printf("Removing unit %q and its drop-ins", unit.Name)
+		if err = um.RemoveUnit(unit); err != nil {
+			return
+		}
+		placed = true
+	}
+	changed = placed || state.Changed(unit.Destination(root), unitContent(unit))
+
+	if unit.Mask {
+		log.Printf("Masking unit file %q", unit.Name)
+		if err = um.MaskUnit(unit); err != nil {
+			return
+		}
+	} else if unit.Unmask || unit.Runtime {
+		log.Printf("Ensuring unit file %q is unmasked", unit.Name)
+		if err = um.UnmaskUnit(unit); err != nil {
+			return
+		}
+	}
+
+	if unit.Enable {
+		if unit.Group() != "network" {
+			log.Printf("Enabling unit file %q", unit.Name)
+			if err = um.EnableUnitFile(unit); err != nil {
+				return
+			}
+			log.Printf("Enabled unit %q", unit.Name)
+		} else {
+			log.Printf("Skipping enable for network-like unit %q", unit.Name)
+		}
+	} else if unit.Preset {
+		if unit.Group() != "network" {
+			log.Printf("Applying the preset of unit file %q", unit.Name)
+			if err = um.PresetUnitFile(unit); err != nil {
+				return
+			}
+		} else {
+			log.Printf("Skipping preset for network-like unit %q", unit.Name)
+		}
+	}
+	return
+}
+
+// unitLocation returns the location of the given unit in the cloud-config,
+// for the purpose of reporting failures.
+func unitLocation(unit system.Unit) string {
+	return fmt.Sprintf("coreos.units (%q)", unit.Name)
+}
+
+// unitFileUnchanged returns whether or not the unit file at the given path
+// already has the given content.
+func unitFileUnchanged(path, content string) bool {
+	return system.FileUnchanged(&system.File{File: config.File{
+		Path:               path,
+		Content:            content,
+		RawFilePermissions: "0644",
+	}}, "/")
+}
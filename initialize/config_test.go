@@ -15,10 +15,16 @@
 package initialize
 
 import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
 	"reflect"
 	"testing"
 
 	"github.com/coreos/coreos-cloudinit/config"
+	"github.com/coreos/coreos-cloudinit/datasource"
 	"github.com/coreos/coreos-cloudinit/network"
 	"github.com/coreos/coreos-cloudinit/system"
 )
@@ -26,10 +32,15 @@ import (
 type TestUnitManager struct {
 	placed   []string
 	enabled  []string
+	disabled []string
+	preset   []string
+	removed  []string
 	masked   []string
 	unmasked []string
 	commands []UnitAction
 	reload   bool
+	network  []string
+	networkd bool
 }
 
 type UnitAction struct {
@@ -49,14 +60,31 @@ func (tum *TestUnitManager) EnableUnitFile(u system.Unit) error {
 	tum.enabled = append(tum.enabled, u.Name)
 	return nil
 }
-func (tum *TestUnitManager) RunUnitCommand(u system.Unit, c string) (string, error) {
+func (tum *TestUnitManager) DisableUnitFile(u system.Unit) error {
+	tum.disabled = append(tum.disabled, u.Name)
+	return nil
+}
+func (tum *TestUnitManager) PresetUnitFile(u system.Unit) error {
+	tum.preset = append(tum.preset, u.Name)
+	return nil
+}
+func (tum *TestUnitManager) RemoveUnit(u system.Unit) error {
+	tum.removed = append(tum.removed, u.Name)
+	return nil
+}
+func (tum *TestUnitManager) RunUnitCommand(u system.Unit, c string) (system.UnitStatus, error) {
 	tum.commands = append(tum.commands, UnitAction{u.Name, c})
-	return "", nil
+	return system.UnitStatus{Result: "done", ActiveState: "active", SubState: "running"}, nil
 }
 func (tum *TestUnitManager) DaemonReload() error {
 	tum.reload = true
 	return nil
 }
+func (tum *TestUnitManager) ReloadNetwork(links []string) error {
+	tum.networkd = true
+	tum.network = append(tum.network, links...)
+	return nil
+}
 func (tum *TestUnitManager) MaskUnit(u system.Unit) error {
 	tum.masked = append(tum.masked, u.Name)
 	return nil
@@ -67,19 +95,22 @@ func (tum *TestUnitManager) UnmaskUnit(u system.Unit) error {
 }
 
 type mockInterface struct {
-	name           string
-	filename       string
-	netdev         string
-	link           string
-	network        string
-	kind           string
-	modprobeParams string
+	name     string
+	filename string
+	netdev   string
+	link     string
+	network  string
+	kind     string
 }
 
 func (i mockInterface) Name() string {
 	return i.name
 }
 
+func (i mockInterface) Hwaddr() net.HardwareAddr {
+	return nil
+}
+
 func (i mockInterface) Filename() string {
 	return i.filename
 }
@@ -100,10 +131,6 @@ func (i mockInterface) Type() string {
 	return i.kind
 }
 
-func (i mockInterface) ModprobeParams() string {
-	return i.modprobeParams
-}
-
 func TestCreateNetworkingUnits(t *testing.T) {
 	for _, tt := range []struct {
 		interfaces []network.InterfaceGenerator
@@ -163,6 +190,46 @@ func TestProcessUnits(t *testing.T) {
 				masked: []string{"foo"},
 			},
 		},
+		{
+			units: []system.Unit{
+				system.Unit{Unit: config.Unit{
+					Name:    "foo.service",
+					Disable: true,
+					Remove:  true,
+				}},
+				system.Unit{Unit: config.Unit{
+					Name:   "bar.service",
+					Unmask: true,
+					Preset: true,
+				}},
+			},
+			result: TestUnitManager{
+				disabled: []string{"foo.service"},
+				removed:  []string{"foo.service"},
+				unmasked: []string{"bar.service"},
+				preset:   []string{"bar.service"},
+				reload:   true,
+			},
+		},
+		{
+			units: system.Unit{Unit: config.Unit{
+				Name:      "foo@.service",
+				Content:   "[Service]\nExecStart=/bin/foo %i",
+				Enable:    true,
+				Command:   "start",
+				DropIns:   []config.UnitDropIn{{Name: "10-foo.conf", Content: "[Service]\nNice=1"}},
+				Instances: []string{"a", "b"},
+			}}.Expand(),
+			result: TestUnitManager{
+				placed:  []string{"foo@.service", "foo@a.service.d/10-foo.conf", "foo@b.service.d/10-foo.conf"},
+				enabled: []string{"foo@a.service", "foo@b.service"},
+				commands: []UnitAction{
+					UnitAction{"foo@a.service", "start"},
+					UnitAction{"foo@b.service", "start"},
+				},
+				reload: true,
+			},
+		},
 		{
 			units: []system.Unit{
 				system.Unit{Unit: config.Unit{
@@ -182,10 +249,10 @@ func TestProcessUnits(t *testing.T) {
 			result: TestUnitManager{
 				placed: []string{"baz.service", "foo.network", "bar.network"},
 				commands: []UnitAction{
-					UnitAction{"systemd-networkd.service", "restart"},
 					UnitAction{"baz.service", "start"},
 				},
-				reload: true,
+				reload:   true,
+				networkd: true,
 			},
 		},
 		{
@@ -289,11 +356,421 @@ func TestProcessUnits(t *testing.T) {
 
 	for _, tt := range tests {
 		tum := &TestUnitManager{}
-		if err := processUnits(tt.units, "", tum); err != nil {
+		if err := processUnits(tt.units, "", tum, nil, nil, 1, nil, nil); err != nil {
 			t.Errorf("bad error (%+v): want nil, got %s", tt.units, err)
 		}
 		if !reflect.DeepEqual(tt.result, *tum) {
 			t.Errorf("bad result (%+v): want %+v, got %+v", tt.units, tt.result, tum)
 		}
 	}
+
+	tum := &TestUnitManager{}
+	conflicting := []system.Unit{{Unit: config.Unit{Name: "foo.service", Enable: true, Mask: true}}}
+	if err := processUnits(conflicting, "", tum, nil, nil, 1, nil, nil); err == nil {
+		t.Errorf("bad error (%+v): want non-nil, got nil", conflicting)
+	}
+	if !reflect.DeepEqual(TestUnitManager{}, *tum) {
+		t.Errorf("bad result (%+v): want nothing done, got %+v", conflicting, tum)
+	}
+}
+
+func TestApplyOffline(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.CloudConfig{
+		Hostname: "baked",
+		BootCmd:  []string{"false"},
+		RunCmd:   []string{"false"},
+		CoreOS: config.CoreOS{Units: []config.Unit{{
+			Name:    "foo.service",
+			Enable:  true,
+			Command: "start",
+			Content: "[Service]\nExecStart=/bin/true\n\n[Install]\nWantedBy=multi-user.target\n",
+		}}},
+	}
+	env := NewEnvironment(dir, "", "/var/lib/coreos-cloudinit", "", datasource.Metadata{})
+	if err := Apply(cfg, nil, env); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+
+	if hostname, err := ioutil.ReadFile(path.Join(dir, "etc", "hostname")); err != nil || string(hostname) != "baked\n" {
+		t.Errorf("bad hostname: want %q, got %q (%v)", "baked\n", hostname, err)
+	}
+	if dest, err := os.Readlink(path.Join(dir, "etc/systemd/system/multi-user.target.wants/foo.service")); err != nil || dest != "/etc/systemd/system/foo.service" {
+		t.Errorf("bad enablement: want %q, got %q (%v)", "/etc/systemd/system/foo.service", dest, err)
+	}
+	if _, err := os.Stat(path.Join(env.Workspace(), "instance-id")); !os.IsNotExist(err) {
+		t.Errorf("bad instance ID: want none to be recorded, got %v", err)
+	}
+	want := []system.QueuedCommand{{Unit: "foo.service", Command: "start"}}
+	if queued, err := system.ReadQueuedCommands(env.UnitCommandQueue()); err != nil || !reflect.DeepEqual(want, queued) {
+		t.Errorf("bad queued commands: want %+v, got %+v (%v)", want, queued, err)
+	}
+}
+
+func TestRunQueuedUnitCommands(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	queued := []system.QueuedCommand{{Unit: "a.service", Command: "start"}, {Unit: "b.service", Command: "start"}, {Unit: "c.service", Command: "restart"}}
+	for i, tt := range []struct {
+		fail   map[string]bool
+		policy config.ErrorPolicy
+		err    bool
+		left   []system.QueuedCommand
+	}{
+		{
+			fail: nil,
+			err:  false,
+			left: nil,
+		},
+		{
+			fail:   map[string]bool{"b.service": true},
+			policy: config.ErrorPolicy{Default: config.Continue},
+			err:    false,
+			left:   []system.QueuedCommand{{Unit: "b.service", Command: "start"}},
+		},
+		{
+			fail: map[string]bool{"b.service": true},
+			err:  true,
+			left: []system.QueuedCommand{{Unit: "b.service", Command: "start"}, {Unit: "c.service", Command: "restart"}},
+		},
+	} {
+		queue := path.Join(dir, "queued-unit-commands")
+		if err := system.WriteQueuedCommands(queue, queued); err != nil {
+			t.Fatalf("Unable to write queue: %v", err)
+		}
+
+		um := &concurrentUnitManager{fail: tt.fail}
+		err := runQueuedUnitCommands(queue, um, &failureReport{policy: tt.policy})
+		if (err != nil) != tt.err {
+			t.Errorf("bad error (%d): want error %t, got %v", i, tt.err, err)
+		}
+
+		left, err := system.ReadQueuedCommands(queue)
+		if tt.left == nil {
+			if !os.IsNotExist(err) {
+				t.Errorf("bad queue (%d): want it removed, got %+v (%v)", i, left, err)
+			}
+		} else if err != nil || !reflect.DeepEqual(tt.left, left) {
+			t.Errorf("bad queue (%d): want %+v, got %+v (%v)", i, tt.left, left, err)
+		}
+	}
+}
+
+func TestApplyErrorPolicy(t *testing.T) {
+	for i, tt := range []struct {
+		policy   config.ErrorPolicy
+		failures []string
+		written  bool
+	}{
+		{
+			policy:   config.ErrorPolicy{},
+			failures: []string{`write_files[0] ("/bad")`},
+			written:  false,
+		},
+		{
+			policy:   config.ErrorPolicy{Default: config.Continue},
+			failures: []string{`write_files[0] ("/bad")`, `write_files[2] ("/worse")`},
+			written:  true,
+		},
+		{
+			policy:   config.ErrorPolicy{Default: config.Continue, WriteFiles: config.FailFast},
+			failures: []string{`write_files[0] ("/bad")`},
+			written:  false,
+		},
+		{
+			policy:   config.ErrorPolicy{WriteFiles: config.Continue},
+			failures: []string{`write_files[0] ("/bad")`, `write_files[2] ("/worse")`},
+			written:  true,
+		},
+	} {
+		dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+		if err != nil {
+			t.Fatalf("Unable to create tempdir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		cfg := config.CloudConfig{
+			ErrorPolicy: tt.policy,
+			WriteFiles: []config.File{
+				{Path: "/bad", RawFilePermissions: "0999"},
+				{Path: "/good", Content: "good"},
+				{Path: "/worse", Content: "!", Encoding: "base64"},
+			},
+		}
+		env := NewEnvironment(dir, "", "/var/lib/coreos-cloudinit", "", datasource.Metadata{})
+		err = Apply(cfg, nil, env)
+		aerr, ok := err.(*ApplyError)
+		if !ok {
+			t.Errorf("bad error (%d): want *ApplyError, got %#v", i, err)
+			continue
+		}
+		var failures []string
+		for _, f := range aerr.Failures {
+			failures = append(failures, f.Location)
+		}
+		if !reflect.DeepEqual(tt.failures, failures) {
+			t.Errorf("bad failures (%d): want %q, got %q", i, tt.failures, failures)
+		}
+		if _, err := os.Stat(path.Join(dir, "good")); (err == nil) != tt.written {
+			t.Errorf("bad written (%d): want %t, got %v", i, tt.written, err)
+		}
+	}
+}
+
+func TestProcessUnitsChanges(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	units := func(dropIn string) []system.Unit {
+		return []system.Unit{
+			{Unit: config.Unit{
+				Name:    "foo.service",
+				Command: "restart-on-change",
+				Content: "[Service]\nExecStart=/bin/true\n",
+				DropIns: []config.UnitDropIn{{Name: "10-foo.conf", Content: dropIn}},
+			}},
+			{Unit: config.Unit{Name: "bar.service", Command: "start"}},
+			{Unit: config.Unit{Name: "50-eth0.network", Content: "[Match]\nName=eth0\n"}},
+		}
+	}
+
+	for i, tt := range []struct {
+		dropIn string
+		result TestUnitManager
+	}{
+		{
+			dropIn: "[Service]\nNice=1\n",
+			result: TestUnitManager{
+				placed:   []string{"foo.service", "foo.service.d/10-foo.conf", "50-eth0.network"},
+				reload:   true,
+				networkd: true,
+				commands: []UnitAction{
+					{"foo.service", "restart"},
+					{"bar.service", "start"},
+				},
+			},
+		},
+		{
+			dropIn: "[Service]\nNice=1\n",
+			result: TestUnitManager{
+				commands: []UnitAction{{"bar.service", "start"}},
+			},
+		},
+		{
+			dropIn: "[Service]\nNice=2\n",
+			result: TestUnitManager{
+				placed: []string{"foo.service.d/10-foo.conf"},
+				reload: true,
+				commands: []UnitAction{
+					{"foo.service", "restart"},
+					{"bar.service", "start"},
+				},
+			},
+		},
+	} {
+		state, err := LoadState(dir)
+		if err != nil {
+			t.Fatalf("bad error loading state (%d): want nil, got %v", i, err)
+		}
+		tum := &TestUnitManager{}
+		if err := processUnits(units(tt.dropIn), dir, &placingUnitManager{tum, dir}, state, nil, 1, nil, nil); err != nil {
+			t.Fatalf("bad error (%d): want nil, got %v", i, err)
+		}
+		if !reflect.DeepEqual(tt.result, *tum) {
+			t.Errorf("bad result (%d): want %+v, got %+v", i, tt.result, *tum)
+		}
+		if err := state.Save(nil); err != nil {
+			t.Fatalf("bad error saving state (%d): want nil, got %v", i, err)
+		}
+	}
+}
+
+// placingUnitManager records actions like TestUnitManager, but also places
+// unit files under root.
+type placingUnitManager struct {
+	*TestUnitManager
+	root string
+}
+
+func (pum *placingUnitManager) PlaceUnit(u system.Unit) error {
+	pum.TestUnitManager.PlaceUnit(u)
+	_, err := system.WriteFile(&system.File{File: config.File{Path: u.Destination(pum.root), Content: u.Content, RawFilePermissions: "0644"}}, "/")
+	return err
+}
+
+func (pum *placingUnitManager) PlaceUnitDropIn(u system.Unit, d config.UnitDropIn) error {
+	pum.TestUnitManager.PlaceUnitDropIn(u, d)
+	_, err := system.WriteFile(&system.File{File: config.File{Path: u.DropInDestination(pum.root, d), Content: d.Content, RawFilePermissions: "0644"}}, "/")
+	return err
+}
+
+func TestProcessUnitsReloadNetwork(t *testing.T) {
+	for i, tt := range []struct {
+		links []string
+
+		result TestUnitManager
+	}{
+		{},
+		{
+			links:  []string{"eth0"},
+			result: TestUnitManager{network: []string{"eth0"}, networkd: true},
+		},
+	} {
+		tum := &TestUnitManager{}
+		if err := processUnits(nil, "", tum, nil, nil, 1, tt.links, nil); err != nil {
+			t.Fatalf("bad error (%d): want nil, got %v", i, err)
+		}
+		if !reflect.DeepEqual(tt.result, *tum) {
+			t.Errorf("bad result (%d): want %+v, got %+v", i, tt.result, *tum)
+		}
+	}
+}
+
+func TestAddressedInterfaces(t *testing.T) {
+	interfaces, err := network.ProcessDebianNetconf([]byte("iface eth0 inet dhcp\niface bond0 inet static\n    address 10.0.0.2\n    netmask 255.255.255.0\n    bond-slaves eth1 eth2\niface eth3 inet manual"))
+	if err != nil {
+		t.Fatalf("Unable to process network config: %v", err)
+	}
+
+	var names []string
+	for _, iface := range addressedInterfaces(interfaces) {
+		names = append(names, iface.Name())
+	}
+	if expect := []string{"bond0", "eth0"}; !reflect.DeepEqual(names, expect) {
+		t.Fatalf("bad addressed interfaces: want %v, got %v", expect, names)
+	}
+}
+
+func TestProcessUnitsNetworkTimeout(t *testing.T) {
+	interfaces, err := network.ProcessDebianNetconf([]byte("iface eth0 inet dhcp"))
+	if err != nil {
+		t.Fatalf("Unable to process network config: %v", err)
+	}
+	timeout := []error{errors.New(`timed out waiting for the network: interface "eth0" is configuring`)}
+
+	for i, tt := range []struct {
+		policy config.ErrorPolicy
+
+		commands []UnitAction
+		err      bool
+	}{
+		{
+			commands: []UnitAction{{"foo.service", "start"}},
+		},
+		{
+			policy:   config.ErrorPolicy{Network: config.Continue},
+			commands: []UnitAction{{"foo.service", "start"}},
+			err:      true,
+		},
+		{
+			policy: config.ErrorPolicy{Network: config.FailFast},
+			err:    true,
+		},
+	} {
+		report := &failureReport{policy: tt.policy}
+		tum := &TestUnitManager{}
+		units := []system.Unit{{Unit: config.Unit{Name: "foo.service", Command: "start"}}}
+		waitForNetwork := func() error {
+			return reportInterfaces(interfaces, timeout, report)
+		}
+		err := processUnits(units, "/", tum, nil, report, 1, nil, waitForNetwork)
+		if err == nil {
+			err = report.err()
+		}
+		if tt.err != (err != nil) {
+			t.Errorf("bad error (%d): want error %t, got %v", i, tt.err, err)
+		}
+		if !reflect.DeepEqual(tt.commands, tum.commands) {
+			t.Errorf("bad commands (%d): want %v, got %v", i, tt.commands, tum.commands)
+		}
+	}
+}
+
+func TestProcessUnitsRequireActive(t *testing.T) {
+	for i, tt := range []struct {
+		unit   config.Unit
+		status system.UnitStatus
+		err    bool
+	}{
+		{
+			unit:   config.Unit{Name: "foo.service", Command: "start", RequireActive: true},
+			status: system.UnitStatus{Result: "done", ActiveState: "active", SubState: "running"},
+			err:    false,
+		},
+		{
+			unit:   config.Unit{Name: "foo.service", Command: "start", RequireActive: true},
+			status: system.UnitStatus{Result: "done", ActiveState: "inactive", SubState: "dead"},
+			err:    true,
+		},
+		{
+			unit:   config.Unit{Name: "foo.service", Command: "start"},
+			status: system.UnitStatus{Result: "done", ActiveState: "inactive", SubState: "dead"},
+			err:    false,
+		},
+		{
+			unit:   config.Unit{Name: "foo.service", Command: "stop", RequireActive: true},
+			status: system.UnitStatus{Result: "done", ActiveState: "inactive", SubState: "dead"},
+			err:    false,
+		},
+		{
+			unit:   config.Unit{Name: "foo.service", Command: "start", RequireActive: true},
+			status: system.UnitStatus{Result: "skipped"},
+			err:    false,
+		},
+		{
+			unit:   config.Unit{Name: "foo.service", Command: "start"},
+			status: system.UnitStatus{Result: "failed", ActiveState: "failed", SubState: "failed"},
+			err:    false,
+		},
+		{
+			unit:   config.Unit{Name: "foo.service", Command: "start"},
+			status: system.UnitStatus{Result: "timeout", ActiveState: "activating", SubState: "start"},
+			err:    false,
+		},
+		{
+			unit:   config.Unit{Name: "foo.service", Command: "start", RequireActive: true},
+			status: system.UnitStatus{Result: "failed", ActiveState: "failed", SubState: "failed"},
+			err:    true,
+		},
+		{
+			unit:   config.Unit{Name: "foo.service", Command: "start", RequireActive: true},
+			status: system.UnitStatus{Result: "timeout", ActiveState: "activating", SubState: "start"},
+			err:    true,
+		},
+		{
+			unit:   config.Unit{Name: "foo.service", Command: "stop", RequireActive: true},
+			status: system.UnitStatus{Result: "dependency"},
+			err:    true,
+		},
+	} {
+		um := &statusUnitManager{&TestUnitManager{}, tt.status}
+		err := processUnits([]system.Unit{{Unit: tt.unit}}, "", um, nil, nil, 1, nil, nil)
+		if (err != nil) != tt.err {
+			t.Errorf("bad error (%d): want error %t, got %v", i, tt.err, err)
+		}
+	}
+}
+
+// statusUnitManager records actions like TestUnitManager, but leaves units in
+// the given status.
+type statusUnitManager struct {
+	*TestUnitManager
+	status system.UnitStatus
+}
+
+func (sum *statusUnitManager) RunUnitCommand(u system.Unit, c string) (system.UnitStatus, error) {
+	sum.TestUnitManager.RunUnitCommand(u, c)
+	return sum.status, nil
 }
@@ -15,14 +15,20 @@
 package initialize
 
 import (
+	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/coreos/coreos-cloudinit/config"
 	"github.com/coreos/coreos-cloudinit/datasource"
+	"github.com/coreos/coreos-cloudinit/network"
 	"github.com/coreos/coreos-cloudinit/system"
 )
 
@@ -34,8 +40,20 @@ type Environment struct {
 	workspace     string
 	sshKeyName    string
 	substitutions map[string]string
+	instanceID    string
+	firstBoot     bool
+	plan          *Plan
+	transactional bool
+	tx            *Transaction
+	parallelism   int
+	detached      bool
+	netTimeout    time.Duration
 }
 
+// DefaultNetworkTimeout is how long the network interfaces are waited for by
+// default, once their configuration has been applied.
+const DefaultNetworkTimeout = time.Minute
+
 // TODO(jonboulle): this is getting unwieldy, should be able to simplify the interface somehow
 func NewEnvironment(root, configRoot, workspace, sshKeyName string, metadata datasource.Metadata) *Environment {
 	firstNonNull := func(ip net.IP, env string) string {
@@ -45,12 +63,59 @@ func NewEnvironment(root, configRoot, workspace, sshKeyName string, metadata dat
 		return ip.String()
 	}
 	substitutions := map[string]string{
-		"$public_ipv4":  firstNonNull(metadata.PublicIPv4, os.Getenv("COREOS_PUBLIC_IPV4")),
-		"$private_ipv4": firstNonNull(metadata.PrivateIPv4, os.Getenv("COREOS_PRIVATE_IPV4")),
-		"$public_ipv6":  firstNonNull(metadata.PublicIPv6, os.Getenv("COREOS_PUBLIC_IPV6")),
-		"$private_ipv6": firstNonNull(metadata.PrivateIPv6, os.Getenv("COREOS_PRIVATE_IPV6")),
+		"$public_ipv4":   firstNonNull(metadata.PublicIPv4, os.Getenv("COREOS_PUBLIC_IPV4")),
+		"$private_ipv4":  firstNonNull(metadata.PrivateIPv4, os.Getenv("COREOS_PRIVATE_IPV4")),
+		"$public_ipv6":   firstNonNull(metadata.PublicIPv6, os.Getenv("COREOS_PUBLIC_IPV6")),
+		"$private_ipv6":  firstNonNull(metadata.PrivateIPv6, os.Getenv("COREOS_PRIVATE_IPV6")),
+		"$floating_ipv4": firstNonNull(metadata.FloatingIPv4, os.Getenv("COREOS_FLOATING_IPV4")),
+	}
+	env := &Environment{
+		root:          root,
+		configRoot:    configRoot,
+		workspace:     workspace,
+		sshKeyName:    sshKeyName,
+		substitutions: substitutions,
+		instanceID:    metadata.InstanceID,
+		parallelism:   DefaultUnitParallelism,
+		netTimeout:    DefaultNetworkTimeout,
+	}
+	if env.instanceID == "" {
+		env.instanceID = system.MachineID(root)
+	}
+	env.firstBoot = env.detectFirstBoot()
+	return env
+}
+
+// detectFirstBoot compares the instance ID with the one recorded in the
+// workspace by PersistInstanceInWorkspace. This is the first boot of the
+// instance if no ID has been recorded, if the recorded ID differs (e.g. the
+// disk was cloned onto a new instance) or if the instance was first seen
+// during the current boot. Without an instance ID (e.g. the machine ID of the
+// image is yet to be generated), clones can't be told apart, so every boot is
+// treated as the first one.
+func (e *Environment) detectFirstBoot() bool {
+	if e.instanceID == "" {
+		log.Printf("No instance ID available, treating this as a new instance")
+		return true
+	}
+	previous, err := ioutil.ReadFile(path.Join(e.Workspace(), "instance-id"))
+	if err != nil {
+		return true
+	}
+	if id := strings.TrimSpace(string(previous)); id != e.instanceID {
+		log.Printf("Instance ID changed from %q to %q, treating this as a new instance", id, e.instanceID)
+		return true
+	}
+	bootID, err := ioutil.ReadFile(path.Join(e.Workspace(), "instance-boot-id"))
+	if err != nil {
+		return false
 	}
-	return &Environment{root, configRoot, workspace, sshKeyName, substitutions}
+	current, err := system.BootID()
+	if err != nil {
+		log.Printf("Unable to determine the boot ID: %v", err)
+		return false
+	}
+	return strings.TrimSpace(string(bootID)) == current
 }
 
 func (e *Environment) Workspace() string {
@@ -73,6 +138,163 @@ func (e *Environment) SetSSHKeyName(name string) {
 	e.sshKeyName = name
 }
 
+// Offline returns whether or not the environment targets a root other than
+// that of the running system, or a running system whose systemd can't be
+// reached. Changes are then made to the files under the root alone and
+// nothing is run.
+func (e *Environment) Offline() bool {
+	return path.Clean(e.root) != "/" || e.detached
+}
+
+// SetDetached sets whether or not the systemd of the running system can't be
+// reached (e.g. in a container or a chroot), in which case the environment is
+// offline.
+func (e *Environment) SetDetached(detached bool) {
+	e.detached = detached
+}
+
+// UnitCommandQueue returns the path of the file in which the unit commands
+// which can't be run offline are queued, to be run by the next run during
+// which systemd can be reached.
+func (e *Environment) UnitCommandQueue() string {
+	return path.Join(e.Workspace(), "queued-unit-commands")
+}
+
+// SetPlan makes subsequent changes to the environment be recorded in the
+// given plan instead of being made.
+func (e *Environment) SetPlan(p *Plan) {
+	p.env = e
+	e.plan = p
+}
+
+// SetTransactional sets whether or not Apply restores the files and units it
+// changed if it fails.
+func (e *Environment) SetTransactional(transactional bool) {
+	e.transactional = transactional
+}
+
+// Transactional returns whether or not Apply restores the files and units it
+// changed if it fails. Planning is never transactional since nothing is
+// changed.
+func (e *Environment) Transactional() bool {
+	return e.transactional && e.plan == nil
+}
+
+// SetUnitParallelism sets the number of unit commands which are run at the
+// same time.
+func (e *Environment) SetUnitParallelism(n int) {
+	e.parallelism = n
+}
+
+func (e *Environment) UnitParallelism() int {
+	return e.parallelism
+}
+
+// Runtime returns whether or not commands are run in the environment, which
+// is neither the case offline nor while planning.
+func (e *Environment) Runtime() bool {
+	return !e.Offline() && e.plan == nil
+}
+
+// UserManager returns the UserManager of the system targeted by the
+// environment.
+func (e *Environment) UserManager() system.UserManager {
+	var um system.UserManager
+	if e.Offline() {
+		um = system.NewOfflineUserManager(e.root)
+	} else {
+		um = system.NewUserManager()
+	}
+	if e.plan != nil {
+		return planUsers{e.plan, um}
+	}
+	return um
+}
+
+// UnitManager returns the UnitManager of the system targeted by the
+// environment.
+func (e *Environment) UnitManager() system.UnitManager {
+	if e.plan != nil {
+		return planUnits{e.plan}
+	}
+	var um system.UnitManager
+	if e.Offline() {
+		um = system.NewOfflineUnitManager(e.root, e.UnitCommandQueue())
+	} else {
+		um = system.NewUnitManager(e.root)
+	}
+	if e.tx != nil {
+		return transactionalUnits{um, e.tx, e.root}
+	}
+	return um
+}
+
+// WriteFile writes the given file relative to the root of the environment.
+func (e *Environment) WriteFile(f *system.File) (string, error) {
+	if e.plan != nil {
+		return path.Join(e.root, f.Path), e.plan.recordFile(f)
+	}
+	if e.tx != nil {
+		return e.tx.Install(f, e.root)
+	}
+	return system.WriteFile(f, e.root)
+}
+
+// SetHostname sets the hostname of the system targeted by the environment.
+func (e *Environment) SetHostname(hostname string) error {
+	switch {
+	case e.plan != nil:
+		e.plan.Hostname = hostname
+		return nil
+	case e.Offline():
+		return system.WriteHostname(e.root, hostname)
+	default:
+		return system.SetHostname(hostname)
+	}
+}
+
+// PrepareNetwork prepares those of the given interfaces whose configuration
+// changed to be reconfigured by systemd-networkd, provided that they belong to
+// the running system. It returns the names of their links.
+func (e *Environment) PrepareNetwork(interfaces []network.InterfaceGenerator) ([]string, error) {
+	switch {
+	case e.plan != nil:
+		e.plan.recordNetworkReconfigure(system.ChangedNetworkInterfaces(e.root, interfaces))
+		return nil, nil
+	case e.Offline():
+		return nil, nil
+	default:
+		return system.PrepareNetwork(e.root, interfaces)
+	}
+}
+
+// SetNetworkTimeout sets how long the network interfaces are waited for once
+// their configuration has been applied. A timeout of 0 disables waiting.
+func (e *Environment) SetNetworkTimeout(timeout time.Duration) {
+	e.netTimeout = timeout
+}
+
+// WaitForNetwork waits until the given interfaces have been configured, or
+// until the network timeout expires, provided that they belong to the running
+// system. It returns the error of each interface, in the order given.
+func (e *Environment) WaitForNetwork(interfaces []network.InterfaceGenerator) []error {
+	if !e.Runtime() || e.netTimeout == 0 {
+		return nil
+	}
+	return system.WaitForNetwork(interfaces, e.netTimeout)
+}
+
+// InstanceID returns the identifier of the instance, as given by the metadata
+// or, if that is unavailable, the machine ID.
+func (e *Environment) InstanceID() string {
+	return e.instanceID
+}
+
+// FirstBoot returns whether or not this is the first boot of the instance.
+func (e *Environment) FirstBoot() bool {
+	return e.firstBoot
+}
+
 // Apply goes through the map of substitutions and replaces all instances of
 // the keys with their respective values. It supports escaping substitutions
 // with a leading '\'.
@@ -89,24 +311,42 @@ func (e *Environment) Apply(data string) string {
 	return data
 }
 
+// Variables returns the COREOS_* variables describing the addresses of the
+// machine, keyed by name. Addresses which are unknown are omitted.
+func (e *Environment) Variables() map[string]string {
+	vars := map[string]string{}
+	for name, key := range map[string]string{
+		"COREOS_PUBLIC_IPV4":   "$public_ipv4",
+		"COREOS_PRIVATE_IPV4":  "$private_ipv4",
+		"COREOS_PUBLIC_IPV6":   "$public_ipv6",
+		"COREOS_PRIVATE_IPV6":  "$private_ipv6",
+		"COREOS_FLOATING_IPV4": "$floating_ipv4",
+	} {
+		if ip, ok := e.substitutions[key]; ok && len(ip) > 0 {
+			vars[name] = ip
+		}
+	}
+	return vars
+}
+
+// VariableList returns the result of Variables as a sorted list of
+// "KEY=value" strings, suitable for the environment of a process.
+func (e *Environment) VariableList() []string {
+	vars := e.Variables()
+	list := make([]string, 0, len(vars))
+	for name, value := range vars {
+		list = append(list, fmt.Sprintf("%s=%s", name, value))
+	}
+	sort.Strings(list)
+	return list
+}
+
 func (e *Environment) DefaultEnvironmentFile() *system.EnvFile {
 	ef := system.EnvFile{
 		File: &system.File{File: config.File{
 			Path: "/etc/environment",
 		}},
-		Vars: map[string]string{},
-	}
-	if ip, ok := e.substitutions["$public_ipv4"]; ok && len(ip) > 0 {
-		ef.Vars["COREOS_PUBLIC_IPV4"] = ip
-	}
-	if ip, ok := e.substitutions["$private_ipv4"]; ok && len(ip) > 0 {
-		ef.Vars["COREOS_PRIVATE_IPV4"] = ip
-	}
-	if ip, ok := e.substitutions["$public_ipv6"]; ok && len(ip) > 0 {
-		ef.Vars["COREOS_PUBLIC_IPV6"] = ip
-	}
-	if ip, ok := e.substitutions["$private_ipv6"]; ok && len(ip) > 0 {
-		ef.Vars["COREOS_PRIVATE_IPV6"] = ip
+		Vars: e.Variables(),
 	}
 	if len(ef.Vars) == 0 {
 		return nil
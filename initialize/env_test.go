@@ -53,6 +53,14 @@ ExecStart=/usr/bin/echo "192.0.2.3 fe00:1234::"
 ExecStop=/usr/bin/echo 192.0.2.203 fe00:5678::
 ExecStop=/usr/bin/echo $unknown`,
 		},
+		{
+			// The floating IP is only known from the metadata
+			datasource.Metadata{
+				FloatingIPv4: net.ParseIP("192.0.2.100"),
+			},
+			"$floating_ipv4",
+			"192.0.2.100",
+		},
 		{
 			// Substituting one value directly while falling back with the other
 			datasource.Metadata{
@@ -146,3 +154,62 @@ func TestEnvironmentFileNil(t *testing.T) {
 		t.Fatalf("Environment file not nil: %v", ef)
 	}
 }
+
+func TestEnvironmentFirstBoot(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	newEnv := func(id string) *Environment {
+		return NewEnvironment(dir, "", "/var/lib/coreos-cloudinit", "", datasource.Metadata{InstanceID: id})
+	}
+
+	env := newEnv("i-1")
+	if env.InstanceID() != "i-1" {
+		t.Fatalf("bad instance ID: want %q, got %q", "i-1", env.InstanceID())
+	}
+	if !env.FirstBoot() {
+		t.Fatalf("bad first boot: want true, got false")
+	}
+	if err := PersistInstanceInWorkspace(env); err != nil {
+		t.Fatalf("Unable to persist instance: %v", err)
+	}
+
+	// Later runs during the same boot still see the first boot.
+	if env = newEnv("i-1"); !env.FirstBoot() {
+		t.Fatalf("bad first boot during the same boot: want true, got false")
+	}
+
+	// Simulate a reboot of the same instance.
+	if err := ioutil.WriteFile(path.Join(env.Workspace(), "instance-boot-id"), []byte("previous\n"), 0644); err != nil {
+		t.Fatalf("Unable to write boot ID: %v", err)
+	}
+	if env = newEnv("i-1"); env.FirstBoot() {
+		t.Fatalf("bad first boot after reboot: want false, got true")
+	}
+	if err := PersistInstanceInWorkspace(env); err != nil {
+		t.Fatalf("Unable to persist instance: %v", err)
+	}
+
+	// A clone has a different instance ID.
+	if env = newEnv("i-2"); !env.FirstBoot() {
+		t.Fatalf("bad first boot of clone: want true, got false")
+	}
+
+	// Without an instance ID, nor a machine ID to fall back to, every boot is
+	// the first one and nothing is recorded.
+	if env = newEnv(""); !env.FirstBoot() {
+		t.Fatalf("bad first boot without instance ID: want true, got false")
+	}
+	if err := PersistInstanceInWorkspace(env); err != nil {
+		t.Fatalf("Unable to persist instance: %v", err)
+	}
+	if id, err := ioutil.ReadFile(path.Join(env.Workspace(), "instance-id")); err != nil || string(id) != "i-1\n" {
+		t.Fatalf("bad recorded instance ID: want %q, got %q (%v)", "i-1\n", id, err)
+	}
+	if env = newEnv(""); !env.FirstBoot() {
+		t.Fatalf("bad first boot without instance ID: want true, got false")
+	}
+}
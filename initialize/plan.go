@@ -0,0 +1,316 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package initialize
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/coreos/coreos-cloudinit/config"
+	"github.com/coreos/coreos-cloudinit/network"
+	"github.com/coreos/coreos-cloudinit/system"
+)
+
+// Plan records the changes which Apply would make to an Environment, without
+// making them. See Environment.SetPlan.
+type Plan struct {
+	Hostname string       `json:"hostname,omitempty"`
+	Files    []FileChange `json:"files,omitempty"`
+	Users    []Change     `json:"users,omitempty"`
+	Units    []Change     `json:"units,omitempty"`
+	Network  []string     `json:"network_reconfigures,omitempty"`
+	Commands []string     `json:"commands,omitempty"`
+
+	env *Environment
+}
+
+// FileChange describes a file which would be written, along with a diff of
+// its content against that of the existing file.
+type FileChange struct {
+	Path        string `json:"path"`
+	Permissions string `json:"permissions"`
+	Created     bool   `json:"created"`
+	Diff        string `json:"diff,omitempty"`
+}
+
+// Change describes an action which would be taken on a user or a unit.
+type Change struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// JSON returns the plan in JSON form.
+func (p *Plan) JSON() ([]byte, error) {
+	return json.MarshalIndent(p, "", "  ")
+}
+
+// String returns the plan in human-readable form.
+func (p *Plan) String() string {
+	var buf bytes.Buffer
+	if p.Hostname != "" {
+		fmt.Fprintf(&buf, "Hostname:\n  set to %s\n", p.Hostname)
+	}
+	if len(p.Files) > 0 {
+		fmt.Fprintln(&buf, "Files:")
+		for _, f := range p.Files {
+			state := "modified"
+			if f.Created {
+				state = "created"
+			}
+			fmt.Fprintf(&buf, "  %s (%s, %s)\n", f.Path, state, f.Permissions)
+			for _, line := range strings.SplitAfter(f.Diff, "\n") {
+				if line != "" {
+					fmt.Fprintf(&buf, "    %s", line)
+				}
+			}
+		}
+	}
+	for _, section := range []struct {
+		title   string
+		changes []Change
+	}{
+		{"Users", p.Users},
+		{"Units", p.Units},
+	} {
+		if len(section.changes) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s:\n", section.title)
+		for _, c := range section.changes {
+			if c.Detail != "" {
+				fmt.Fprintf(&buf, "  %s %s (%s)\n", c.Action, c.Name, c.Detail)
+			} else {
+				fmt.Fprintf(&buf, "  %s %s\n", c.Action, c.Name)
+			}
+		}
+	}
+	if len(p.Network) > 0 {
+		fmt.Fprintf(&buf, "Network:\n  reconfigure %s\n", strings.Join(p.Network, ", "))
+	}
+	if len(p.Commands) > 0 {
+		fmt.Fprintln(&buf, "Commands:")
+		for _, c := range p.Commands {
+			fmt.Fprintf(&buf, "  %s\n", c)
+		}
+	}
+	if buf.Len() == 0 {
+		return "No changes\n"
+	}
+	return buf.String()
+}
+
+// recordFile records the writing of the given file, relative to the root of
+// the environment, unless its content is already in place.
+func (p *Plan) recordFile(f *system.File) error {
+	content, err := config.DecodeContent(f.Content, f.Encoding)
+	if err != nil {
+		return fmt.Errorf("Unable to decode %s (%v)", f.Path, err)
+	}
+	perm, err := f.Permissions()
+	if err != nil {
+		return err
+	}
+
+	fullPath := path.Join(p.env.Root(), f.Path)
+	old, err := ioutil.ReadFile(fullPath)
+	created := os.IsNotExist(err)
+	if err != nil && !created {
+		return err
+	}
+	if !created && bytes.Equal(old, content) {
+		if info, err := os.Stat(fullPath); err == nil && info.Mode().Perm() == perm {
+			return nil
+		}
+	}
+
+	diff := "binary content differs\n"
+	if bytes.IndexByte(old, 0) < 0 && bytes.IndexByte(content, 0) < 0 {
+		diff = diffLines(string(old), string(content))
+	}
+	p.Files = append(p.Files, FileChange{
+		Path:        path.Join("/", f.Path),
+		Permissions: fmt.Sprintf("%#o", perm),
+		Created:     created,
+		Diff:        diff,
+	})
+	return nil
+}
+
+func (p *Plan) recordCommands(kind string, cmds []string) {
+	for i, cmd := range cmds {
+		p.Commands = append(p.Commands, fmt.Sprintf("%s[%d]: %s", kind, i, cmd))
+	}
+}
+
+func (p *Plan) recordNetworkReconfigure(interfaces []network.InterfaceGenerator) {
+	for _, i := range interfaces {
+		p.Network = append(p.Network, i.Name())
+	}
+}
+
+// planUsers is a UserManager which records changes in a Plan. Users are
+// looked up using the UserManager of the environment.
+type planUsers struct {
+	plan   *Plan
+	lookup system.UserManager
+}
+
+func (u planUsers) UserExists(user *config.User) bool {
+	return u.lookup.UserExists(user)
+}
+
+func (u planUsers) CreateUser(user *config.User) error {
+	u.plan.Users = append(u.plan.Users, Change{Name: user.Name, Action: "create"})
+	return nil
+}
+
+func (u planUsers) SetUserPassword(user, hash string) error {
+	u.plan.Users = append(u.plan.Users, Change{Name: user, Action: "set-password"})
+	return nil
+}
+
+func (u planUsers) AuthorizeSSHKeys(user string, keysName string, keys []string) error {
+	u.plan.Users = append(u.plan.Users, Change{Name: user, Action: "authorize-ssh-keys", Detail: fmt.Sprintf("%d keys as %q", len(keys), keysName)})
+	return nil
+}
+
+// planUnits is a UnitManager which records changes in a Plan.
+type planUnits struct {
+	plan *Plan
+}
+
+func (u planUnits) record(name, action, detail string) {
+	u.plan.Units = append(u.plan.Units, Change{Name: name, Action: action, Detail: detail})
+}
+
+func (u planUnits) PlaceUnit(unit system.Unit) error {
+	u.record(unit.Name, "place", "")
+	return u.plan.recordFile(&system.File{File: config.File{
+		Path:               strings.TrimPrefix(unit.Destination("/"), "/"),
+		Content:            unit.Content,
+		RawFilePermissions: "0644",
+	}})
+}
+
+func (u planUnits) PlaceUnitDropIn(unit system.Unit, dropIn config.UnitDropIn) error {
+	u.record(unit.Name, "place-drop-in", dropIn.Name)
+	return u.plan.recordFile(&system.File{File: config.File{
+		Path:               strings.TrimPrefix(unit.DropInDestination("/", dropIn), "/"),
+		Content:            dropIn.Content,
+		RawFilePermissions: "0644",
+	}})
+}
+
+func (u planUnits) EnableUnitFile(unit system.Unit) error {
+	u.record(unit.Name, "enable", "")
+	return nil
+}
+
+func (u planUnits) DisableUnitFile(unit system.Unit) error {
+	u.record(unit.Name, "disable", "")
+	return nil
+}
+
+func (u planUnits) PresetUnitFile(unit system.Unit) error {
+	u.record(unit.Name, "preset", "")
+	return nil
+}
+
+func (u planUnits) RemoveUnit(unit system.Unit) error {
+	u.record(unit.Name, "remove", "")
+	return nil
+}
+
+func (u planUnits) RunUnitCommand(unit system.Unit, command string) (system.UnitStatus, error) {
+	u.record(unit.Name, command, "")
+	return system.UnitStatus{Result: "planned"}, nil
+}
+
+func (u planUnits) MaskUnit(unit system.Unit) error {
+	u.record(unit.Name, "mask", "")
+	return nil
+}
+
+func (u planUnits) UnmaskUnit(unit system.Unit) error {
+	u.record(unit.Name, "unmask", "")
+	return nil
+}
+
+func (u planUnits) DaemonReload() error {
+	u.record("systemd", "daemon-reload", "")
+	return nil
+}
+
+func (u planUnits) ReloadNetwork(links []string) error {
+	u.record("systemd-networkd", "reload", "")
+	return nil
+}
+
+// diffLines returns the lines removed from old and added in new, prefixed by
+// "-" and "+" respectively, interleaved with the lines they have in common,
+// prefixed by " ".
+func diffLines(old, new string) string {
+	a := splitLines(old)
+	b := splitLines(new)
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(&buf, " %s\n", a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&buf, "-%s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&buf, "+%s\n", b[j])
+			j++
+		}
+	}
+	return buf.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
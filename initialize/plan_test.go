@@ -0,0 +1,122 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package initialize
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/coreos-cloudinit/config"
+	"github.com/coreos/coreos-cloudinit/datasource"
+)
+
+func TestDiffLines(t *testing.T) {
+	for i, tt := range []struct {
+		old  string
+		new  string
+		diff string
+	}{
+		{"", "", ""},
+		{"", "a\nb\n", "+a\n+b\n"},
+		{"a\nb\n", "", "-a\n-b\n"},
+		{"a\nb\nc\n", "a\nc\nd\n", " a\n-b\n c\n+d\n"},
+		{"a\n", "b", "-a\n+b\n"},
+	} {
+		if diff := diffLines(tt.old, tt.new); diff != tt.diff {
+			t.Errorf("bad diff (%d): want %q, got %q", i, tt.diff, diff)
+		}
+	}
+}
+
+func TestApplyPlan(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"etc/modified":  "a\nb\n",
+		"etc/unchanged": "same\n",
+	} {
+		if err := os.MkdirAll(path.Dir(path.Join(dir, name)), 0755); err != nil {
+			t.Fatalf("Unable to create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write %q: %v", name, err)
+		}
+	}
+
+	cfg := config.CloudConfig{
+		Hostname: "planned",
+		BootCmd:  []string{"echo boot"},
+		RunCmd:   []string{"echo run"},
+		Users:    []config.User{{Name: "elroy", PasswordHash: "hash"}},
+		WriteFiles: []config.File{
+			{Path: "/etc/modified", Content: "a\nc\n"},
+			{Path: "/etc/unchanged", Content: "same\n"},
+			{Path: "/etc/created", Content: "new\n", RawFilePermissions: "0600"},
+		},
+		CoreOS: config.CoreOS{Units: []config.Unit{{
+			Name:    "foo.service",
+			Enable:  true,
+			Command: "start",
+			Content: "[Service]\nExecStart=/bin/true\n",
+		}}},
+	}
+	env := NewEnvironment(dir, "", "/var/lib/coreos-cloudinit", "", datasource.Metadata{})
+	plan := &Plan{}
+	env.SetPlan(plan)
+	if err := Apply(cfg, nil, env); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+
+	expect := &Plan{
+		Hostname: "planned",
+		Files: []FileChange{
+			{Path: "/etc/modified", Permissions: "0644", Diff: " a\n-b\n+c\n"},
+			{Path: "/etc/created", Permissions: "0600", Created: true, Diff: "+new\n"},
+			{Path: "/etc/systemd/system/foo.service", Permissions: "0644", Created: true, Diff: "+[Service]\n+ExecStart=/bin/true\n"},
+		},
+		Users: []Change{{Name: "elroy", Action: "create"}},
+		Units: []Change{
+			{Name: "foo.service", Action: "place"},
+			{Name: "foo.service", Action: "enable"},
+			{Name: "etcd.service", Action: "unmask"},
+			{Name: "etcd2.service", Action: "unmask"},
+			{Name: "fleet.service", Action: "unmask"},
+			{Name: "locksmithd.service", Action: "unmask"},
+			{Name: "systemd", Action: "daemon-reload"},
+			{Name: "foo.service", Action: "start"},
+		},
+		Commands: []string{"bootcmd[0]: echo boot", "runcmd[0]: echo run"},
+		env:      env,
+	}
+	if !reflect.DeepEqual(expect, plan) {
+		t.Fatalf("bad plan:\nwant %#v\ngot  %#v", *expect, *plan)
+	}
+
+	for _, name := range []string{"etc/created", "etc/hostname", "etc/passwd", "etc/systemd"} {
+		if _, err := os.Stat(path.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("bad file %q: want it not to exist, got %v", name, err)
+		}
+	}
+	if content, _ := ioutil.ReadFile(path.Join(dir, "etc/modified")); string(content) != "a\nb\n" {
+		t.Errorf("bad file %q: want it unchanged, got %q", "etc/modified", content)
+	}
+}
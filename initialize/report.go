@@ -0,0 +1,90 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package initialize
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/coreos/coreos-cloudinit/config"
+)
+
+// Failure describes an item of the cloud-config which failed to apply.
+type Failure struct {
+	Location string
+	Err      error
+}
+
+// ApplyError aggregates the failures encountered by Apply.
+type ApplyError struct {
+	Failures []Failure
+}
+
+func (e *ApplyError) Error() string {
+	if len(e.Failures) == 1 {
+		return fmt.Sprintf("%s: %v", e.Failures[0].Location, e.Failures[0].Err)
+	}
+	lines := []string{fmt.Sprintf("%d items failed to apply:", len(e.Failures))}
+	for _, f := range e.Failures {
+		lines = append(lines, fmt.Sprintf("  %s: %v", f.Location, f.Err))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// failureReport collects the failures encountered while applying a
+// cloud-config, according to its error policy. A nil report treats every
+// section as fail-fast.
+type failureReport struct {
+	policy   config.ErrorPolicy
+	failures []Failure
+}
+
+// fail records the failure of the item at the given location, which belongs
+// to the given section of the cloud-config. An empty section stands for steps
+// which don't belong to any, and follows the default policy. If the section
+// is fail-fast, the error to return is returned; otherwise nil is returned
+// and the caller should carry on with the next item. Failures of an ignored
+// section are only logged.
+func (r *failureReport) fail(section, location string, err error) error {
+	if r == nil {
+		return err
+	}
+	if r.policy.Policy(section) == config.Ignore {
+		log.Printf("Ignoring failure of %s: %v", location, err)
+		return nil
+	}
+	log.Printf("Failed applying %s: %v", location, err)
+	r.failures = append(r.failures, Failure{Location: location, Err: err})
+	if r.policy.Policy(section) == config.Continue {
+		return nil
+	}
+	return r.err()
+}
+
+// continues returns whether or not the given section of the cloud-config
+// carries on after a failure.
+func (r *failureReport) continues(section string) bool {
+	return r != nil && r.policy.Policy(section) == config.Continue
+}
+
+// err returns an ApplyError listing the failures so far, or nil if there were
+// none.
+func (r *failureReport) err() error {
+	if r == nil || len(r.failures) == 0 {
+		return nil
+	}
+	return &ApplyError{Failures: r.failures}
+}
@@ -0,0 +1,217 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package initialize
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/coreos/coreos-cloudinit/system"
+)
+
+// DefaultUnitParallelism is the number of unit commands which are run at the
+// same time by default.
+const DefaultUnitParallelism = 4
+
+// errNotRun is the error of a unit action which wasn't run because an earlier
+// action failed.
+var errNotRun = errors.New("not run after an earlier failure")
+
+// unitAction is a command to run on a unit.
+type unitAction struct {
+	unit    system.Unit
+	command string
+}
+
+// runUnitActions runs the given actions, at most parallel of them at a time,
+// and returns the error of each. An action waits for the actions of the units
+// its unit is ordered after (by its After= or their Before=) or requires
+// (Requires= or BindsTo=). Actions which are part of a dependency cycle, or
+// whose unit requires a unit which is neither one of the given units nor
+// found under root, fail without being run, as do those whose unit requires a
+// unit whose action failed. If stopOnFailure is set, no action is started
+// once one has failed; those which weren't started fail with errNotRun.
+func runUnitActions(actions []unitAction, units []system.Unit, root string, um system.UnitManager, parallel int, stopOnFailure bool) []error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	known := map[string]bool{}
+	for _, unit := range units {
+		known[unit.Name] = true
+	}
+	byName := map[string][]int{}
+	for i, action := range actions {
+		byName[action.unit.Name] = append(byName[action.unit.Name], i)
+	}
+
+	errs := make([]error, len(actions))
+	done := make([]bool, len(actions))
+	started := make([]bool, len(actions))
+	after := make([]map[int]bool, len(actions))
+	requires := make([]map[int]bool, len(actions))
+	for i := range actions {
+		after[i] = map[int]bool{}
+		requires[i] = map[int]bool{}
+	}
+	for i, action := range actions {
+		deps := action.unit.Dependencies(root)
+		for _, name := range deps.After {
+			if !known[name] && !system.UnitExists(root, name) {
+				log.Printf("Unit %q is ordered after unknown unit %q", action.unit.Name, name)
+			}
+			for _, j := range byName[name] {
+				after[i][j] = true
+			}
+		}
+		for _, name := range deps.Before {
+			for _, j := range byName[name] {
+				after[j][i] = true
+			}
+		}
+		for _, name := range deps.Requires {
+			// Units without files, such as slices and devices, are
+			// left to systemd.
+			if !known[name] && !system.UnitExists(root, name) {
+				log.Printf("Unit %q requires unknown unit %q", action.unit.Name, name)
+			}
+			for _, j := range byName[name] {
+				after[i][j] = true
+				requires[i][j] = true
+			}
+		}
+		delete(after[i], i)
+	}
+	for i, action := range actions {
+		if errs[i] == nil && inCycle(after, i) {
+			errs[i] = fmt.Errorf("unit %q is part of a dependency cycle", action.unit.Name)
+		}
+	}
+
+	finished := make(chan int)
+	running := 0
+	stopped := false
+	for i := range actions {
+		if errs[i] != nil {
+			done[i], started[i] = true, true
+			stopped = stopped || stopOnFailure
+		}
+	}
+	for {
+		for progress := true; progress && !stopped && running < parallel; {
+			progress = false
+			for i, action := range actions {
+				if started[i] || running >= parallel || !ready(after[i], done) {
+					continue
+				}
+				started[i], progress = true, true
+				if failed := failedRequirement(requires[i], errs, actions); failed != "" {
+					errs[i] = fmt.Errorf("unit %q requires unit %q, which failed", action.unit.Name, failed)
+					done[i] = true
+					continue
+				}
+				running++
+				go func(i int) {
+					errs[i] = runUnitAction(um, actions[i])
+					finished <- i
+				}(i)
+			}
+		}
+		if running == 0 {
+			break
+		}
+		i := <-finished
+		running--
+		done[i] = true
+		if errs[i] != nil && stopOnFailure {
+			stopped = true
+		}
+	}
+
+	for i := range actions {
+		if !started[i] {
+			errs[i] = errNotRun
+		}
+	}
+	return errs
+}
+
+// runUnitAction runs the given action. A job which failed or timed out is
+// only an error if the unit requires to be active; so is a unit which isn't
+// active afterwards.
+func runUnitAction(um system.UnitManager, action unitAction) error {
+	log.Printf("Calling unit command %q on %q'", action.command, action.unit.Name)
+	res, err := um.RunUnitCommand(action.unit, action.command)
+	if err != nil {
+		return err
+	}
+	log.Printf("Result of %q on %q: %s", action.command, action.unit.Name, res)
+	if !action.unit.RequireActive {
+		return nil
+	}
+
+	switch {
+	case res.Result == "timeout":
+		return fmt.Errorf("%s job for unit %q did not finish within %s (%s)", action.command, action.unit.Name, system.JobTimeout, res.State())
+	case !res.Succeeded():
+		return fmt.Errorf("%s job for unit %q finished with result %q (%s)", action.command, action.unit.Name, res.Result, res.State())
+	case action.command != "stop" && res.Result == "done" && res.ActiveState != "active":
+		return fmt.Errorf("unit %q is not active after %q (%s)", action.unit.Name, action.command, res.State())
+	}
+	return nil
+}
+
+// ready returns whether or not all of the given dependencies are done.
+func ready(deps map[int]bool, done []bool) bool {
+	for j := range deps {
+		if !done[j] {
+			return false
+		}
+	}
+	return true
+}
+
+// failedRequirement returns the name of the unit of the first required action
+// which failed, if any.
+func failedRequirement(requires map[int]bool, errs []error, actions []unitAction) string {
+	for j := range actions {
+		if requires[j] && errs[j] != nil {
+			return actions[j].unit.Name
+		}
+	}
+	return ""
+}
+
+// inCycle returns whether or not the given action can be reached from itself
+// by following its dependencies.
+func inCycle(deps []map[int]bool, i int) bool {
+	seen := map[int]bool{}
+	stack := []int{i}
+	for len(stack) > 0 {
+		j := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for k := range deps[j] {
+			if k == i {
+				return true
+			}
+			if !seen[k] {
+				seen[k] = true
+				stack = append(stack, k)
+			}
+		}
+	}
+	return false
+}
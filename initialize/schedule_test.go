@@ -0,0 +1,169 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package initialize
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/coreos-cloudinit/config"
+	"github.com/coreos/coreos-cloudinit/system"
+)
+
+// concurrentUnitManager records the order in which unit commands are run,
+// and how many of them ran at the same time. Commands on the units listed in
+// fail fail.
+type concurrentUnitManager struct {
+	TestUnitManager
+	fail map[string]bool
+
+	sync.Mutex
+	order   []string
+	running int
+	max     int
+}
+
+func (cum *concurrentUnitManager) RunUnitCommand(u system.Unit, c string) (system.UnitStatus, error) {
+	cum.Lock()
+	cum.order = append(cum.order, u.Name)
+	cum.running++
+	if cum.running > cum.max {
+		cum.max = cum.running
+	}
+	cum.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	cum.Lock()
+	cum.running--
+	cum.Unlock()
+	if cum.fail[u.Name] {
+		return system.UnitStatus{Result: "failed"}, errors.New("failed")
+	}
+	return system.UnitStatus{Result: "done"}, nil
+}
+
+func TestRunUnitActions(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	unit := func(name, content string) system.Unit {
+		return system.Unit{Unit: config.Unit{Name: name, Command: "start", Content: content}}
+	}
+
+	for i, tt := range []struct {
+		units    []system.Unit
+		fail     map[string]bool
+		parallel int
+		stop     bool
+
+		order  []string
+		failed []bool
+		max    int
+	}{
+		{
+			// a is ordered after b
+			units:    []system.Unit{unit("a.service", "[Unit]\nAfter=b.service\n"), unit("b.service", ""), unit("c.service", "")},
+			parallel: 1,
+			order:    []string{"b.service", "a.service", "c.service"},
+			failed:   []bool{false, false, false},
+			max:      1,
+		},
+		{
+			// b is ordered before a
+			units:    []system.Unit{unit("a.service", ""), unit("b.service", "[Unit]\nBefore=a.service\n")},
+			parallel: 1,
+			order:    []string{"b.service", "a.service"},
+			failed:   []bool{false, false},
+			max:      1,
+		},
+		{
+			// independent units run in parallel, in any order
+			units:    []system.Unit{unit("a.service", ""), unit("b.service", ""), unit("c.service", "")},
+			parallel: 2,
+			order:    []string{"a.service", "b.service", "c.service"},
+			failed:   []bool{false, false, false},
+			max:      2,
+		},
+		{
+			// a and b form a cycle
+			units:    []system.Unit{unit("a.service", "[Unit]\nAfter=b.service\n"), unit("b.service", "[Unit]\nAfter=a.service\n"), unit("c.service", "")},
+			parallel: 1,
+			order:    []string{"c.service"},
+			failed:   []bool{true, true, false},
+			max:      1,
+		},
+		{
+			// a requires units without files, which are left to systemd
+			units:    []system.Unit{unit("a.service", "[Unit]\nRequires=missing.service\nBindsTo=dev-sda.device\n"), unit("b.service", "")},
+			parallel: 1,
+			order:    []string{"a.service", "b.service"},
+			failed:   []bool{false, false},
+			max:      1,
+		},
+		{
+			// a requires b, which fails
+			units:    []system.Unit{unit("a.service", "[Unit]\nRequires=b.service\nAfter=b.service\n"), unit("b.service", ""), unit("c.service", "[Unit]\nAfter=b.service\n")},
+			fail:     map[string]bool{"b.service": true},
+			parallel: 1,
+			order:    []string{"b.service", "c.service"},
+			failed:   []bool{true, true, false},
+			max:      1,
+		},
+		{
+			// nothing is started after a failure
+			units:    []system.Unit{unit("a.service", ""), unit("b.service", "")},
+			fail:     map[string]bool{"a.service": true},
+			parallel: 1,
+			stop:     true,
+			order:    []string{"a.service"},
+			failed:   []bool{true, true},
+			max:      1,
+		},
+	} {
+		var actions []unitAction
+		for _, u := range tt.units {
+			actions = append(actions, unitAction{u, u.Command})
+		}
+		um := &concurrentUnitManager{fail: tt.fail}
+		errs := runUnitActions(actions, tt.units, dir, um, tt.parallel, tt.stop)
+
+		var failed []bool
+		for _, err := range errs {
+			failed = append(failed, err != nil)
+		}
+		if !reflect.DeepEqual(tt.failed, failed) {
+			t.Errorf("bad failures (%d): want %t, got %v", i, tt.failed, errs)
+		}
+		if tt.parallel > 1 {
+			sort.Strings(um.order)
+		}
+		if !reflect.DeepEqual(tt.order, um.order) {
+			t.Errorf("bad order (%d): want %q, got %q", i, tt.order, um.order)
+		}
+		if tt.max != um.max {
+			t.Errorf("bad parallelism (%d): want %d, got %d", i, tt.max, um.max)
+		}
+	}
+}
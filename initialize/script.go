@@ -0,0 +1,65 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package initialize
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/coreos/coreos-cloudinit/config"
+	"github.com/coreos/coreos-cloudinit/system"
+)
+
+// RunScript persists the given script in the workspace and executes it in a
+// transient unit with the COREOS_* variables of the environment set. Unless
+// wait is set, the script is started in the background and RunScript returns
+// immediately. Otherwise, it waits (up to timeout, if non-zero) for the script
+// to exit, records its output and exit status in the workspace and returns an
+// error if the script failed.
+func RunScript(script config.Script, env *Environment, wait bool, timeout time.Duration) error {
+	if err := PrepWorkspace(env.Workspace()); err != nil {
+		log.Printf("Failed preparing workspace: %v", err)
+		return err
+	}
+	scriptPath, err := PersistScriptInWorkspace(script, env.Workspace())
+	if err != nil {
+		return err
+	}
+
+	if !wait {
+		name, err := system.ExecuteScript(scriptPath, env.VariableList())
+		PersistUnitNameInWorkspace(name, env.Workspace())
+		return err
+	}
+
+	res, err := executeCommand(system.TransientCommand{
+		Name:        fmt.Sprintf("coreos-cloudinit-%s.service", path.Base(scriptPath)),
+		Description: "Unit generated and executed by coreos-cloudinit on behalf of user",
+		Command:     []string{scriptPath},
+		Output:      path.Join(env.Workspace(), "scripts", "output"),
+		Environment: env.VariableList(),
+		Timeout:     timeout,
+	})
+	PersistUnitNameInWorkspace(res.Unit, env.Workspace())
+	if perr := PersistExitStatusInWorkspace(res.ExitStatus, env.Workspace()); err == nil {
+		err = perr
+	}
+	if err == nil {
+		log.Printf("Script exited with status %d", res.ExitStatus)
+	}
+	return err
+}
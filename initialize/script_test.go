@@ -0,0 +1,78 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package initialize
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/coreos-cloudinit/config"
+	"github.com/coreos/coreos-cloudinit/datasource"
+	"github.com/coreos/coreos-cloudinit/system"
+)
+
+func TestRunScriptWait(t *testing.T) {
+	defer func(e func(system.TransientCommand) (system.CommandResult, error)) { executeCommand = e }(executeCommand)
+
+	for i, tt := range []struct {
+		status int
+		err    error
+	}{
+		{status: 0},
+		{status: 3, err: errors.New("script failed")},
+	} {
+		dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+		if err != nil {
+			t.Fatalf("Unable to create tempdir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		env := NewEnvironment("/", "", dir, "", datasource.Metadata{PublicIPv4: net.ParseIP("1.2.3.4")})
+
+		var cmd system.TransientCommand
+		executeCommand = func(c system.TransientCommand) (system.CommandResult, error) {
+			cmd = c
+			return system.CommandResult{Unit: c.Name, Result: "done", ExitStatus: tt.status}, tt.err
+		}
+
+		err = RunScript(config.Script("#!/bin/sh\nexit 0"), env, true, time.Minute)
+		if !reflect.DeepEqual(tt.err, err) {
+			t.Errorf("bad error (%d): want %v, got %v", i, tt.err, err)
+		}
+		if !reflect.DeepEqual([]string{"COREOS_PUBLIC_IPV4=1.2.3.4"}, cmd.Environment) {
+			t.Errorf("bad environment (%d): got %q", i, cmd.Environment)
+		}
+		if cmd.Timeout != time.Minute {
+			t.Errorf("bad timeout (%d): want %s, got %s", i, time.Minute, cmd.Timeout)
+		}
+		if cmd.Output != path.Join(dir, "scripts", "output") {
+			t.Errorf("bad output (%d): got %q", i, cmd.Output)
+		}
+
+		if name, err := ioutil.ReadFile(path.Join(dir, "scripts", "unit-name")); err != nil || string(name) != cmd.Name {
+			t.Errorf("bad unit name (%d): want %q, got %q (%v)", i, cmd.Name, name, err)
+		}
+		if status, err := ioutil.ReadFile(path.Join(dir, "scripts", "exit-status")); err != nil || string(status) != fmt.Sprintf("%d\n", tt.status) {
+			t.Errorf("bad exit status (%d): want %d, got %q (%v)", i, tt.status, status, err)
+		}
+	}
+}
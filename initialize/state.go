@@ -0,0 +1,106 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package initialize
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/coreos/coreos-cloudinit/config"
+	"github.com/coreos/coreos-cloudinit/system"
+)
+
+// State records the hashes of the files, units and drop-ins placed by the
+// last successful run, keyed by path. It is kept in <workspace>/state.json.
+type State struct {
+	Hashes map[string]string `json:"hashes"`
+
+	path string
+}
+
+// LoadState reads the state kept in the given workspace. If there is none, an
+// empty state is returned.
+func LoadState(workspace string) (*State, error) {
+	s := &State{Hashes: map[string]string{}, path: path.Join(workspace, "state.json")}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid state in %s: %v", s.path, err)
+	}
+	if s.Hashes == nil {
+		s.Hashes = map[string]string{}
+	}
+	return s, nil
+}
+
+// Changed returns whether or not the given content differs from the one
+// recorded under key. A nil state considers everything changed.
+func (s *State) Changed(key string, content []byte) bool {
+	if s == nil {
+		return true
+	}
+	return s.Hashes[key] != hash(content)
+}
+
+// Record records the hash of the given content under key.
+func (s *State) Record(key string, content []byte) {
+	if s != nil {
+		s.Hashes[key] = hash(content)
+	}
+}
+
+// Save writes the state back to the workspace. If a transaction is given, the
+// previous state is backed up in it, so that rolling back the transaction
+// restores the state along with the files and units it describes.
+func (s *State) Save(tx *Transaction) error {
+	if tx != nil {
+		if err := tx.Backup(s.path); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := system.File{File: config.File{
+		Path:               path.Base(s.path),
+		RawFilePermissions: "0644",
+		Content:            string(data),
+	}}
+	_, err = system.WriteFile(&file, path.Dir(s.path))
+	return err
+}
+
+func hash(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+// unitContent returns the contents of the unit and its drop-ins, as placed by
+// processUnits, for the purpose of detecting changes to them.
+func unitContent(u system.Unit) []byte {
+	content := []byte(u.Content)
+	for _, d := range u.DropIns {
+		content = append(content, fmt.Sprintf("\x00%s\x00%s", d.Name, d.Content)...)
+	}
+	return content
+}
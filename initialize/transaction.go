@@ -0,0 +1,539 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package initialize
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/coreos/coreos-cloudinit/config"
+	"github.com/coreos/coreos-cloudinit/system"
+)
+
+// Transaction keeps backups of the files overwritten or removed during a run
+// so that they can be restored if the run fails. Backups are kept in
+// <workspace>/transaction/backup, along with an index listing them, until the
+// transaction is committed or rolled back; the outcome is recorded in
+// <workspace>/transaction/result.json. New file content is staged in
+// <workspace>/transaction/staged before any file is changed.
+type Transaction struct {
+	dir     string
+	started time.Time
+	backups []backup
+	saved   map[string]bool
+	staged  map[string]string
+}
+
+// backup describes the state of a path before it was first changed. Dir is
+// set for directories created during the transaction.
+type backup struct {
+	Path    string      `json:"path"`
+	Existed bool        `json:"existed"`
+	Dir     bool        `json:"dir,omitempty"`
+	Copy    string      `json:"copy,omitempty"`
+	Link    string      `json:"link,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+}
+
+// transactionIndex is the list of backups of an open transaction, as
+// persisted in its backup directory.
+type transactionIndex struct {
+	Started time.Time `json:"started"`
+	Backups []backup  `json:"backups"`
+}
+
+// TransactionResult is the outcome of a transaction, as recorded in the
+// workspace.
+type TransactionResult struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+	Paths    []string  `json:"paths"`
+}
+
+// NewTransaction starts a transaction keeping its backups in the given
+// workspace. It refuses to start while the transaction of a previous run is
+// still open; see RecoverTransaction.
+func NewTransaction(workspace string) (*Transaction, error) {
+	t := &Transaction{
+		dir:     path.Join(workspace, "transaction"),
+		started: time.Now(),
+		saved:   map[string]bool{},
+		staged:  map[string]string{},
+	}
+	if _, err := os.Stat(t.indexPath()); err == nil {
+		return nil, fmt.Errorf("the transaction of a previous run is still open in %s", t.backupDir())
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, dir := range []string{t.backupDir(), t.stagingDir()} {
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.saveIndex(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// RecoverTransaction rolls back the transaction of a previous run which was
+// interrupted before it was committed or rolled back, if any, and returns
+// whether or not there was one.
+func RecoverTransaction(workspace string) (bool, error) {
+	t := &Transaction{
+		dir:    path.Join(workspace, "transaction"),
+		saved:  map[string]bool{},
+		staged: map[string]string{},
+	}
+	data, err := ioutil.ReadFile(t.indexPath())
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	var index transactionIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return false, fmt.Errorf("unable to parse %s: %v", t.indexPath(), err)
+	}
+
+	log.Printf("Rolling back the interrupted transaction started at %s", index.Started)
+	t.started = index.Started
+	t.backups = index.Backups
+	if err := t.Rollback(errors.New("transaction interrupted")); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+func (t *Transaction) backupDir() string {
+	return path.Join(t.dir, "backup")
+}
+
+func (t *Transaction) stagingDir() string {
+	return path.Join(t.dir, "staged")
+}
+
+func (t *Transaction) indexPath() string {
+	return path.Join(t.backupDir(), "index.json")
+}
+
+// saveIndex persists the list of backups so that the transaction can be
+// rolled back by a later run if this one is interrupted.
+func (t *Transaction) saveIndex() error {
+	data, err := json.Marshal(transactionIndex{Started: t.started, Backups: t.backups})
+	if err != nil {
+		return err
+	}
+	tmp := t.indexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.indexPath())
+}
+
+// Backup saves the file or symlink at the given path, unless it has already
+// been saved during this transaction, and records the missing directories
+// leading to it. It must be called before the path is changed.
+func (t *Transaction) Backup(p string) error {
+	p = path.Clean(p)
+	if t.saved[p] {
+		return nil
+	}
+
+	dirs, err := missingDirs(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		t.add(backup{Path: dir, Dir: true})
+	}
+
+	b := backup{Path: p}
+	info, err := os.Lstat(p)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case info.Mode()&os.ModeSymlink != 0:
+		if b.Link, err = os.Readlink(p); err != nil {
+			return err
+		}
+		b.Existed = true
+	case info.Mode().IsRegular():
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		b.Copy = path.Join(t.backupDir(), fmt.Sprintf("%d", len(t.backups)))
+		b.Mode = info.Mode().Perm()
+		if err := ioutil.WriteFile(b.Copy, content, 0600); err != nil {
+			return err
+		}
+		b.Existed = true
+	default:
+		return fmt.Errorf("unable to back up %s: not a regular file", p)
+	}
+
+	t.add(b)
+	return t.saveIndex()
+}
+
+// Created records a file, symlink or directory which was created during the
+// transaction without having been backed up beforehand, so that it is
+// removed on rollback.
+func (t *Transaction) Created(p string) error {
+	p = path.Clean(p)
+	if t.saved[p] {
+		return nil
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	t.add(backup{Path: p, Dir: info.IsDir()})
+	return t.saveIndex()
+}
+
+func (t *Transaction) add(b backup) {
+	t.saved[b.Path] = true
+	t.backups = append(t.backups, b)
+}
+
+// missingDirs returns the given directory and those of its parents which
+// don't exist, outermost first.
+func missingDirs(dir string) ([]string, error) {
+	var missing []string
+	for ; ; dir = path.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		missing = append([]string{dir}, missing...)
+		if dir == "/" || dir == "." {
+			break
+		}
+	}
+	return missing, nil
+}
+
+// Stage writes the content of the given file, relative to root, into the
+// staging directory of the transaction, so that content which can't be
+// written is caught before anything is changed. The staged file is moved into
+// place by Install.
+func (t *Transaction) Stage(f *system.File, root string) error {
+	staged := *f
+	staged.Path = fmt.Sprintf("%d", len(t.staged))
+	p, err := system.WriteFile(&staged, t.stagingDir())
+	if err != nil {
+		return err
+	}
+	t.staged[path.Clean(path.Join(root, f.Path))] = p
+	return nil
+}
+
+// Install backs up the destination of the given file, relative to root, and
+// writes the file, moving its staged content into place if it was staged.
+func (t *Transaction) Install(f *system.File, root string) (string, error) {
+	fullpath := path.Clean(path.Join(root, f.Path))
+	if err := t.Backup(fullpath); err != nil {
+		return "", err
+	}
+	if staged, ok := t.staged[fullpath]; ok {
+		delete(t.staged, fullpath)
+		if err := system.EnsureDirectoryExists(path.Dir(fullpath)); err != nil {
+			return "", err
+		}
+		// Staged files may live on another filesystem, in which case they
+		// are written again.
+		if err := os.Rename(staged, fullpath); err == nil {
+			log.Printf("Moved staged file to %q", fullpath)
+			return fullpath, nil
+		}
+	}
+	return system.WriteFile(f, root)
+}
+
+// Commit discards the backups and records the success of the transaction.
+func (t *Transaction) Commit() error {
+	if err := t.discard(); err != nil {
+		return err
+	}
+	return t.record("committed", nil)
+}
+
+// Rollback restores the backed up paths, in reverse order, removing the ones
+// which didn't exist, and records the failure of the transaction along with
+// the error which caused it. The backups are kept if any path can't be
+// restored.
+func (t *Transaction) Rollback(cause error) error {
+	var failed []string
+	for i := len(t.backups) - 1; i >= 0; i-- {
+		if err := t.backups[i].restore(); err != nil {
+			log.Printf("Failed restoring %s: %v", t.backups[i].Path, err)
+			failed = append(failed, t.backups[i].Path)
+		}
+	}
+
+	if len(failed) > 0 {
+		if err := t.record("rollback-failed", cause); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed restoring %q", failed)
+	}
+	if err := t.discard(); err != nil {
+		return err
+	}
+	return t.record("rolled-back", cause)
+}
+
+// discard removes the staged content and the backups, along with their
+// index, which closes the transaction.
+func (t *Transaction) discard() error {
+	if err := os.RemoveAll(t.stagingDir()); err != nil {
+		return err
+	}
+	return os.RemoveAll(t.backupDir())
+}
+
+func (b backup) restore() error {
+	if b.Dir {
+		// Directories are only removed once empty; anything else found in
+		// them wasn't created by the transaction.
+		if err := os.Remove(b.Path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Leaving directory %s in place: %v", b.Path, err)
+			return nil
+		}
+		log.Printf("Removed directory %s", b.Path)
+		return nil
+	}
+	if err := os.Remove(b.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	switch {
+	case !b.Existed:
+		log.Printf("Removed %s", b.Path)
+		return nil
+	case b.Link != "":
+		return os.Symlink(b.Link, b.Path)
+	}
+
+	content, err := ioutil.ReadFile(b.Copy)
+	if err != nil {
+		return err
+	}
+	file := system.File{File: config.File{
+		Path:               b.Path,
+		Content:            string(content),
+		RawFilePermissions: fmt.Sprintf("%#o", b.Mode),
+	}}
+	_, err = system.WriteFile(&file, "/")
+	return err
+}
+
+func (t *Transaction) record(outcome string, cause error) error {
+	result := TransactionResult{
+		Started:  t.started,
+		Finished: time.Now(),
+		Outcome:  outcome,
+		Paths:    []string{},
+	}
+	if cause != nil {
+		result.Error = cause.Error()
+	}
+	for _, b := range t.backups {
+		result.Paths = append(result.Paths, b.Path)
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(t.dir, "result.json"), data, 0644)
+}
+
+// transactionalUnits is a UnitManager which backs up unit files, drop-ins and
+// the symlinks enabling units in a Transaction before they are changed.
+type transactionalUnits struct {
+	system.UnitManager
+	tx   *Transaction
+	root string
+}
+
+func (u transactionalUnits) PlaceUnit(unit system.Unit) error {
+	if err := u.tx.Backup(unit.Destination(u.root)); err != nil {
+		return err
+	}
+	return u.UnitManager.PlaceUnit(unit)
+}
+
+func (u transactionalUnits) PlaceUnitDropIn(unit system.Unit, dropIn config.UnitDropIn) error {
+	if err := u.tx.Backup(unit.DropInDestination(u.root, dropIn)); err != nil {
+		return err
+	}
+	return u.UnitManager.PlaceUnitDropIn(unit, dropIn)
+}
+
+func (u transactionalUnits) MaskUnit(unit system.Unit) error {
+	if err := u.tx.Backup(unit.Destination(u.root)); err != nil {
+		return err
+	}
+	return u.UnitManager.MaskUnit(unit)
+}
+
+func (u transactionalUnits) UnmaskUnit(unit system.Unit) error {
+	if err := u.tx.Backup(unit.Destination(u.root)); err != nil {
+		return err
+	}
+	return u.UnitManager.UnmaskUnit(unit)
+}
+
+func (u transactionalUnits) RemoveUnit(unit system.Unit) error {
+	if err := u.tx.Backup(unit.Destination(u.root)); err != nil {
+		return err
+	}
+	dir := unit.DropInDestination(u.root, config.UnitDropIn{})
+	dropIns, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, dropIn := range dropIns {
+		if err := u.tx.Backup(path.Join(dir, dropIn.Name())); err != nil {
+			return err
+		}
+	}
+	return u.UnitManager.RemoveUnit(unit)
+}
+
+func (u transactionalUnits) EnableUnitFile(unit system.Unit) error {
+	return u.changeLinks(unit, u.UnitManager.EnableUnitFile)
+}
+
+func (u transactionalUnits) DisableUnitFile(unit system.Unit) error {
+	return u.changeLinks(unit, u.UnitManager.DisableUnitFile)
+}
+
+func (u transactionalUnits) PresetUnitFile(unit system.Unit) error {
+	return u.changeLinks(unit, u.UnitManager.PresetUnitFile)
+}
+
+// changeLinks runs the given change, which enables or disables the unit. The
+// symlinks referring to the unit in its unit directory are backed up
+// beforehand, and the symlinks and directories created by the change are
+// recorded afterwards.
+func (u transactionalUnits) changeLinks(unit system.Unit, change func(system.Unit) error) error {
+	dir := path.Dir(unit.Destination(u.root))
+	missing, err := missingDirs(dir)
+	if err != nil {
+		return err
+	}
+	dirs, links, err := unitLinks(dir, unit.Name)
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		if err := u.tx.Backup(link); err != nil {
+			return err
+		}
+	}
+
+	cerr := change(unit)
+
+	newDirs, newLinks, err := unitLinks(dir, unit.Name)
+	if err != nil {
+		return err
+	}
+	var created []string
+	for _, d := range missing {
+		if _, err := os.Lstat(d); err == nil {
+			created = append(created, d)
+		}
+	}
+	created = append(created, added(dirs, newDirs)...)
+	created = append(created, added(links, newLinks)...)
+	for _, p := range created {
+		if err := u.tx.Created(p); err != nil {
+			return err
+		}
+	}
+	return cerr
+}
+
+// unitLinks returns the subdirectories of the given unit directory (such as
+// foo.target.wants), and the symlinks in it and in its subdirectories which
+// are named after the named unit or point to it.
+func unitLinks(dir, name string) (dirs []string, links []string, err error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	for _, info := range infos {
+		p := path.Join(dir, info.Name())
+		if info.IsDir() {
+			dirs = append(dirs, p)
+			subinfos, err := ioutil.ReadDir(p)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, subinfo := range subinfos {
+				if isUnitLink(path.Join(p, subinfo.Name()), subinfo, name) {
+					links = append(links, path.Join(p, subinfo.Name()))
+				}
+			}
+		} else if isUnitLink(p, info, name) {
+			links = append(links, p)
+		}
+	}
+	return dirs, links, nil
+}
+
+func isUnitLink(p string, info os.FileInfo, name string) bool {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	if info.Name() == name {
+		return true
+	}
+	target, err := os.Readlink(p)
+	return err == nil && path.Base(target) == name
+}
+
+// added returns the paths of after which aren't in before.
+func added(before, after []string) []string {
+	existed := map[string]bool{}
+	for _, p := range before {
+		existed[p] = true
+	}
+	var paths []string
+	for _, p := range after {
+		if !existed[p] {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
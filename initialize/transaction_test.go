@@ -0,0 +1,308 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package initialize
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/coreos/coreos-cloudinit/config"
+	"github.com/coreos/coreos-cloudinit/datasource"
+	"github.com/coreos/coreos-cloudinit/system"
+)
+
+func readResult(t *testing.T, workspace string) TransactionResult {
+	data, err := ioutil.ReadFile(path.Join(workspace, "transaction", "result.json"))
+	if err != nil {
+		t.Fatalf("Unable to read result: %v", err)
+	}
+	var result TransactionResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatalf("Unable to parse result: %v", err)
+	}
+	return result
+}
+
+func TestTransactionRollback(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	modified := path.Join(dir, "modified")
+	created := path.Join(dir, "new", "created")
+	link := path.Join(dir, "link")
+	if err := ioutil.WriteFile(modified, []byte("old"), 0640); err != nil {
+		t.Fatalf("Unable to write file: %v", err)
+	}
+	if err := os.Symlink("/dev/null", link); err != nil {
+		t.Fatalf("Unable to create symlink: %v", err)
+	}
+
+	tx, err := NewTransaction(path.Join(dir, "workspace"))
+	if err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	for _, p := range []string{modified, created, link, modified} {
+		if err := tx.Backup(p); err != nil {
+			t.Fatalf("bad error backing up %q: want nil, got %v", p, err)
+		}
+	}
+	if err := os.Mkdir(path.Dir(created), 0755); err != nil {
+		t.Fatalf("Unable to create directory: %v", err)
+	}
+	for _, p := range []string{modified, created} {
+		if err := ioutil.WriteFile(p, []byte("new"), 0644); err != nil {
+			t.Fatalf("Unable to write file: %v", err)
+		}
+	}
+	if err := os.Remove(link); err != nil {
+		t.Fatalf("Unable to remove symlink: %v", err)
+	}
+
+	if err := tx.Rollback(errors.New("test error")); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+
+	if content, err := ioutil.ReadFile(modified); err != nil || string(content) != "old" {
+		t.Errorf("bad content: want %q, got %q (%v)", "old", content, err)
+	}
+	if info, err := os.Stat(modified); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("bad permissions: want %v, got %v (%v)", os.FileMode(0640), info.Mode().Perm(), err)
+	}
+	for _, p := range []string{created, path.Dir(created)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("bad created path %q: want it removed, got %v", p, err)
+		}
+	}
+	if target, err := os.Readlink(link); err != nil || target != "/dev/null" {
+		t.Errorf("bad symlink: want %q, got %q (%v)", "/dev/null", target, err)
+	}
+
+	result := readResult(t, path.Join(dir, "workspace"))
+	if result.Outcome != "rolled-back" || result.Error != "test error" || len(result.Paths) != 4 {
+		t.Errorf("bad result: want rolled-back with 4 paths, got %+v", result)
+	}
+}
+
+func TestRecoverTransaction(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	workspace := path.Join(dir, "workspace")
+	modified := path.Join(dir, "modified")
+	if err := ioutil.WriteFile(modified, []byte("old"), 0644); err != nil {
+		t.Fatalf("Unable to write file: %v", err)
+	}
+
+	if recovered, err := RecoverTransaction(workspace); recovered || err != nil {
+		t.Fatalf("bad recovery without a transaction: want false and nil, got %v and %v", recovered, err)
+	}
+
+	// Leave a transaction open, as an interrupted run would.
+	tx, err := NewTransaction(workspace)
+	if err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	if err := tx.Backup(modified); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	if err := ioutil.WriteFile(modified, []byte("new"), 0644); err != nil {
+		t.Fatalf("Unable to write file: %v", err)
+	}
+
+	if _, err := NewTransaction(workspace); err == nil {
+		t.Fatalf("bad error with an open transaction: want non-nil, got nil")
+	}
+	if recovered, err := RecoverTransaction(workspace); !recovered || err != nil {
+		t.Fatalf("bad recovery: want true and nil, got %v and %v", recovered, err)
+	}
+	if content, err := ioutil.ReadFile(modified); err != nil || string(content) != "old" {
+		t.Errorf("bad content: want %q, got %q (%v)", "old", content, err)
+	}
+	if result := readResult(t, workspace); result.Outcome != "rolled-back" || result.Error != "transaction interrupted" {
+		t.Errorf("bad result: want rolled-back after interruption, got %+v", result)
+	}
+	if _, err := NewTransaction(workspace); err != nil {
+		t.Fatalf("bad error after recovery: want nil, got %v", err)
+	}
+}
+
+// linkingUnitManager enables units by linking them into the wants directory
+// of multi-user.target, like systemd does.
+type linkingUnitManager struct {
+	TestUnitManager
+	root string
+}
+
+func (um *linkingUnitManager) EnableUnitFile(u system.Unit) error {
+	wants := path.Join(um.root, "etc", "systemd", "system", "multi-user.target.wants")
+	if err := os.MkdirAll(wants, 0755); err != nil {
+		return err
+	}
+	return os.Symlink(path.Join("..", u.Name), path.Join(wants, u.Name))
+}
+
+func (um *linkingUnitManager) DisableUnitFile(u system.Unit) error {
+	return os.Remove(path.Join(um.root, "etc", "systemd", "system", "multi-user.target.wants", u.Name))
+}
+
+func TestTransactionalUnitsLinks(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wants := path.Join(dir, "etc", "systemd", "system", "multi-user.target.wants")
+	if err := os.MkdirAll(path.Join(dir, "etc"), 0755); err != nil {
+		t.Fatalf("Unable to create directory: %v", err)
+	}
+
+	tx, err := NewTransaction(path.Join(dir, "workspace"))
+	if err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	um := transactionalUnits{&linkingUnitManager{root: dir}, tx, dir}
+	if err := um.EnableUnitFile(system.Unit{Unit: config.Unit{Name: "foo.service"}}); err != nil {
+		t.Fatalf("bad error enabling: want nil, got %v", err)
+	}
+	if err := tx.Rollback(errors.New("test error")); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	for _, p := range []string{path.Join(wants, "foo.service"), path.Join(dir, "etc", "systemd")} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("bad created path %q: want it removed, got %v", p, err)
+		}
+	}
+
+	if err := os.MkdirAll(wants, 0755); err != nil {
+		t.Fatalf("Unable to create directory: %v", err)
+	}
+	if err := os.Symlink("../bar.service", path.Join(wants, "bar.service")); err != nil {
+		t.Fatalf("Unable to create symlink: %v", err)
+	}
+	if tx, err = NewTransaction(path.Join(dir, "workspace")); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	um.tx = tx
+	if err := um.DisableUnitFile(system.Unit{Unit: config.Unit{Name: "bar.service"}}); err != nil {
+		t.Fatalf("bad error disabling: want nil, got %v", err)
+	}
+	if err := tx.Rollback(errors.New("test error")); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	if target, err := os.Readlink(path.Join(wants, "bar.service")); err != nil || target != "../bar.service" {
+		t.Errorf("bad symlink: want %q, got %q (%v)", "../bar.service", target, err)
+	}
+}
+
+func TestStateRollback(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	state, err := LoadState(dir)
+	if err != nil {
+		t.Fatalf("bad error loading state: want nil, got %v", err)
+	}
+	state.Record("/etc/foo", []byte("old\n"))
+	if err := state.Save(nil); err != nil {
+		t.Fatalf("bad error saving state: want nil, got %v", err)
+	}
+
+	tx, err := NewTransaction(dir)
+	if err != nil {
+		t.Fatalf("Unable to start transaction: %v", err)
+	}
+	state.Record("/etc/foo", []byte("new\n"))
+	if err := state.Save(tx); err != nil {
+		t.Fatalf("bad error saving state: want nil, got %v", err)
+	}
+	if err := tx.Rollback(errors.New("test")); err != nil {
+		t.Fatalf("bad error rolling back: want nil, got %v", err)
+	}
+
+	if state, err = LoadState(dir); err != nil {
+		t.Fatalf("bad error loading state: want nil, got %v", err)
+	}
+	if state.Changed("/etc/foo", []byte("old\n")) {
+		t.Errorf("bad state: want the hash of the old content, got %v", state.Hashes)
+	}
+}
+
+func TestApplyTransactional(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(path.Join(dir, "etc"), 0755); err != nil {
+		t.Fatalf("Unable to create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "etc", "foo"), []byte("old\n"), 0644); err != nil {
+		t.Fatalf("Unable to write file: %v", err)
+	}
+
+	cfg := config.CloudConfig{
+		WriteFiles: []config.File{
+			{Path: "/etc/foo", Content: "new\n"},
+			{Path: "/etc/bar", Content: "new\n"},
+		},
+		CoreOS: config.CoreOS{Units: []config.Unit{
+			{Name: "foo.service", Content: "[Service]\nExecStart=/bin/true\n"},
+			{Name: "missing.service", Enable: true},
+		}},
+	}
+	env := NewEnvironment(dir, "", "/var/lib/coreos-cloudinit", "", datasource.Metadata{})
+	env.SetTransactional(true)
+	if err := Apply(cfg, nil, env); err == nil {
+		t.Fatalf("bad error: want non-nil, got nil")
+	}
+
+	if content, err := ioutil.ReadFile(path.Join(dir, "etc", "foo")); err != nil || string(content) != "old\n" {
+		t.Errorf("bad content: want %q, got %q (%v)", "old\n", content, err)
+	}
+	for _, p := range []string{"etc/bar", "etc/systemd/system/foo.service"} {
+		if _, err := os.Stat(path.Join(dir, p)); !os.IsNotExist(err) {
+			t.Errorf("bad file %q: want it removed, got %v", p, err)
+		}
+	}
+	if result := readResult(t, env.Workspace()); result.Outcome != "rolled-back" {
+		t.Errorf("bad outcome: want %q, got %q", "rolled-back", result.Outcome)
+	}
+
+	cfg.CoreOS.Units = cfg.CoreOS.Units[:1]
+	if err := Apply(cfg, nil, env); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	if content, err := ioutil.ReadFile(path.Join(dir, "etc", "foo")); err != nil || string(content) != "new\n" {
+		t.Errorf("bad content: want %q, got %q (%v)", "new\n", content, err)
+	}
+	if result := readResult(t, env.Workspace()); result.Outcome != "committed" {
+		t.Errorf("bad outcome: want %q, got %q", "committed", result.Outcome)
+	}
+}
@@ -15,6 +15,7 @@
 package initialize
 
 import (
+	"fmt"
 	"io/ioutil"
 	"path"
 	"strings"
@@ -33,6 +34,12 @@ func PrepWorkspace(workspace string) error {
 		return err
 	}
 
+	for _, freq := range scriptFrequencies {
+		if err := system.EnsureDirectoryExists(path.Join(scripts, freq)); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -48,7 +55,7 @@ func PersistScriptInWorkspace(script config.Script, workspace string) (string, e
 
 	file := system.File{File: config.File{
 		Path:               relpath,
-		RawFilePermissions: "0744",
+		RawFilePermissions: "0700",
 		Content:            string(script),
 	}}
 
@@ -64,3 +71,47 @@ func PersistUnitNameInWorkspace(name string, workspace string) error {
 	_, err := system.WriteFile(&file, workspace)
 	return err
 }
+
+func PersistExitStatusInWorkspace(status int, workspace string) error {
+	file := system.File{File: config.File{
+		Path:               path.Join("scripts", "exit-status"),
+		RawFilePermissions: "0644",
+		Content:            fmt.Sprintf("%d\n", status),
+	}}
+	_, err := system.WriteFile(&file, workspace)
+	return err
+}
+
+// PersistInstanceInWorkspace records the instance ID of the environment in the
+// workspace. When the instance is new, the current boot ID is recorded as
+// well so that later runs during the same boot still see the first boot.
+// Nothing is recorded without an instance ID.
+func PersistInstanceInWorkspace(env *Environment) error {
+	if !env.FirstBoot() || env.InstanceID() == "" {
+		return nil
+	}
+	previous, err := ioutil.ReadFile(path.Join(env.Workspace(), "instance-id"))
+	if err == nil && strings.TrimSpace(string(previous)) == env.InstanceID() {
+		return nil
+	}
+	bootID, err := system.BootID()
+	if err != nil {
+		return err
+	}
+	// The boot ID is written first so that an interrupted write is retried
+	// during the next run.
+	for _, f := range []struct{ name, content string }{
+		{"instance-boot-id", bootID},
+		{"instance-id", env.InstanceID()},
+	} {
+		file := system.File{File: config.File{
+			Path:               f.name,
+			RawFilePermissions: "0644",
+			Content:            f.content + "\n",
+		}}
+		if _, err := system.WriteFile(&file, env.Workspace()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/coreos/coreos-cloudinit/config"
+)
+
+// ProcessCloudConfigNetwork compiles the network section of a cloud-config
+// into interfaces. Slaves of bonds, raw devices of VLANs and ports of bridges
+// which aren't described by the section are brought up without any
+// addressing.
+func ProcessCloudConfigNetwork(cfg config.Network) ([]InterfaceGenerator, error) {
+	log.Println("Processing cloud-config network config")
+
+	interfaceMap := make(map[string]networkInterface)
+	for _, iface := range cfg.Interfaces {
+		logical, err := parseConfigInterface(iface)
+		if err != nil {
+			return nil, err
+		}
+
+		key := logical.name
+		if key == "" {
+			key = logical.hwaddr.String()
+		}
+		if _, ok := interfaceMap[key]; ok {
+			return nil, fmt.Errorf("interface %q is described more than once", key)
+		}
+
+		switch iface.Type {
+		case "", "physical":
+			interfaceMap[key] = &physicalInterface{*logical}
+		case "bond":
+			options := make(map[string][]string)
+			for k, v := range map[string]string{
+				"bond-mode":             iface.Bond.Mode,
+				"bond-miimon":           iface.Bond.MIIMon,
+				"bond-lacp-rate":        iface.Bond.LACPRate,
+				"bond-xmit-hash-policy": iface.Bond.TransmitHashPolicy,
+				"bond-updelay":          iface.Bond.UpDelay,
+				"bond-downdelay":        iface.Bond.DownDelay,
+				"bond-min-links":        iface.Bond.MinLinks,
+			} {
+				if v != "" {
+					options[k] = []string{v}
+				}
+			}
+			bondOptions, err := parseBondOptions(options)
+			if err != nil {
+				return nil, fmt.Errorf("bond %q: %v", key, err)
+			}
+			interfaceMap[key] = &bondInterface{*logical, iface.Bond.Slaves, bondOptions, iface.Bond.Primary}
+		case "vlan":
+			interfaceMap[key] = &vlanInterface{*logical, iface.VLAN.ID, iface.VLAN.Link}
+		case "bridge":
+			options := make(map[string][]string)
+			if iface.Bridge.STP {
+				options["bridge_stp"] = []string{"on"}
+			}
+			if iface.Bridge.ForwardDelay != "" {
+				options["bridge_fd"] = []string{iface.Bridge.ForwardDelay}
+			}
+			bridgeOptions, err := parseBridgeOptions(options)
+			if err != nil {
+				return nil, fmt.Errorf("bridge %q: %v", key, err)
+			}
+			interfaceMap[key] = &bridgeInterface{*logical, iface.Bridge.Ports, bridgeOptions}
+		}
+	}
+
+	addLowerInterfaces(interfaceMap)
+	generators := orderInterfaces(interfaceMap)
+	log.Printf("Processed %d network interfaces\n", len(generators))
+	return generators, nil
+}
+
+// parseConfigInterface checks the given interface and returns its name, MAC
+// address and addressing.
+func parseConfigInterface(iface config.NetworkInterface) (*logicalInterface, error) {
+	name := iface.Name
+	if name == "" {
+		name = iface.MAC
+	}
+
+	switch iface.Type {
+	case "", "physical":
+		if iface.Name == "" && iface.MAC == "" {
+			return nil, fmt.Errorf("physical interface requires a name or a MAC address")
+		}
+	case "bond", "vlan", "bridge":
+		if iface.Name == "" {
+			return nil, fmt.Errorf("%s interface requires a name", iface.Type)
+		}
+		if iface.MAC != "" {
+			return nil, fmt.Errorf("interface %q: only physical interfaces can be matched by MAC address", name)
+		}
+	default:
+		return nil, fmt.Errorf("interface %q: invalid type %q", name, iface.Type)
+	}
+	switch {
+	case iface.Type == "bond" && len(iface.Bond.Slaves) == 0:
+		return nil, fmt.Errorf("bond %q requires slaves", name)
+	case iface.Type == "vlan" && iface.VLAN.Link == "":
+		return nil, fmt.Errorf("VLAN %q requires a link", name)
+	case iface.Type == "vlan" && (iface.VLAN.ID < 0 || iface.VLAN.ID > 4094):
+		return nil, fmt.Errorf("VLAN %q has invalid ID %d", name, iface.VLAN.ID)
+	}
+
+	if iface.MTU < 0 {
+		return nil, fmt.Errorf("interface %q has invalid MTU %d", name, iface.MTU)
+	}
+
+	var hwaddr net.HardwareAddr
+	if iface.MAC != "" {
+		var err error
+		if hwaddr, err = net.ParseMAC(iface.MAC); err != nil {
+			return nil, fmt.Errorf("interface %q: %v", name, err)
+		}
+	}
+
+	static := len(iface.Addresses) > 0
+	if iface.DHCP && (static || iface.Gateway != "" || len(iface.Routes) > 0 || len(iface.DNS) > 0) {
+		return nil, fmt.Errorf("interface %q: addresses, gateway, routes and DNS can't be combined with DHCP", name)
+	}
+
+	var conf configMethod = configMethodManual{}
+	switch {
+	case iface.DHCP:
+		conf = configMethodDHCP{}
+	case static || iface.Gateway != "" || len(iface.Routes) > 0 || len(iface.DNS) > 0:
+		static := configMethodStatic{
+			addresses:   make([]net.IPNet, 0),
+			nameservers: make([]net.IP, 0),
+			routes:      make([]route, 0),
+		}
+		for _, a := range iface.Addresses {
+			ip, ipnet, err := net.ParseCIDR(a)
+			if err != nil {
+				return nil, fmt.Errorf("interface %q: could not parse %q as an address with a prefix length", name, a)
+			}
+			static.addresses = append(static.addresses, net.IPNet{IP: ip, Mask: ipnet.Mask})
+		}
+		if iface.Gateway != "" {
+			gateway := net.ParseIP(iface.Gateway)
+			if gateway == nil {
+				return nil, fmt.Errorf("interface %q: could not parse %q as gateway", name, iface.Gateway)
+			}
+			destination := net.IPNet{IP: net.IPv4zero, Mask: net.IPMask(net.IPv4zero)}
+			if gateway.To4() == nil {
+				destination = net.IPNet{IP: net.IPv6zero, Mask: net.IPMask(net.IPv6zero)}
+			}
+			static.routes = append(static.routes, route{destination: destination, gateway: gateway})
+		}
+		for _, r := range iface.Routes {
+			_, destination, err := net.ParseCIDR(r.Destination)
+			if err != nil {
+				return nil, fmt.Errorf("interface %q: could not parse %q as route destination", name, r.Destination)
+			}
+			gateway := net.ParseIP(r.Gateway)
+			if gateway == nil {
+				return nil, fmt.Errorf("interface %q: could not parse %q as route gateway", name, r.Gateway)
+			}
+			static.routes = append(static.routes, route{destination: *destination, gateway: gateway})
+		}
+		for _, ns := range iface.DNS {
+			ip := net.ParseIP(ns)
+			if ip == nil {
+				return nil, fmt.Errorf("interface %q: could not parse %q as nameserver IP address", name, ns)
+			}
+			static.nameservers = append(static.nameservers, ip)
+		}
+		conf = static
+	}
+
+	return &logicalInterface{
+		name:     iface.Name,
+		hwaddr:   hwaddr,
+		mtu:      iface.MTU,
+		config:   conf,
+		children: []networkInterface{},
+	}, nil
+}
+
+// addLowerInterfaces adds a physical interface without any addressing for each
+// slave of a bond, raw device of a VLAN and port of a bridge which isn't in the
+// given interfaces.
+func addLowerInterfaces(interfaceMap map[string]networkInterface) {
+	for _, name := range sortedInterfaces(interfaceMap) {
+		var lower []string
+		switch i := interfaceMap[name].(type) {
+		case *bondInterface:
+			lower = i.slaves
+		case *vlanInterface:
+			lower = []string{i.rawDevice}
+		case *bridgeInterface:
+			lower = i.ports
+		}
+		for _, l := range lower {
+			if _, ok := interfaceMap[l]; !ok {
+				interfaceMap[l] = &physicalInterface{
+					logicalInterface{
+						name:     l,
+						config:   configMethodManual{},
+						children: []networkInterface{},
+					},
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/coreos-cloudinit/config"
+)
+
+func TestProcessCloudConfigNetwork(t *testing.T) {
+	type file struct {
+		name    string
+		netdev  string
+		network string
+	}
+
+	for i, tt := range []struct {
+		cfg config.Network
+
+		files []file
+		err   error
+	}{
+		{
+			cfg: config.Network{Interfaces: []config.NetworkInterface{
+				{MAC: "52:54:00:12:34:56", DHCP: true},
+			}},
+			files: []file{
+				{network: "[Match]\nMACAddress=52:54:00:12:34:56\n\n[Network]\nDHCP=true\n"},
+			},
+		},
+		{
+			cfg: config.Network{Interfaces: []config.NetworkInterface{
+				{
+					Name:      "eth0",
+					Addresses: []string{"10.0.0.2/24", "fd00::2/64"},
+					Gateway:   "10.0.0.1",
+					Routes:    []config.NetworkRoute{{Destination: "10.1.2.3/16", Gateway: "10.0.0.254"}},
+					DNS:       []string{"8.8.8.8"},
+				},
+			}},
+			files: []file{
+				{name: "eth0", network: "[Match]\nName=eth0\n\n[Network]\nDNS=8.8.8.8\n\n[Address]\nAddress=10.0.0.2/24\n\n[Address]\nAddress=fd00::2/64\n\n[Route]\nDestination=0.0.0.0/0\nGateway=10.0.0.1\n\n[Route]\nDestination=10.1.0.0/16\nGateway=10.0.0.254\n"},
+			},
+		},
+		{
+			cfg: config.Network{Interfaces: []config.NetworkInterface{
+				{Name: "br0", Type: "bridge", DHCP: true, Bridge: config.NetworkBridge{Ports: []string{"vlan10"}}},
+				{Name: "vlan10", Type: "vlan", VLAN: config.NetworkVLAN{ID: 10, Link: "bond0"}},
+				{Name: "bond0", Type: "bond", Bond: config.NetworkBond{Slaves: []string{"eth0", "eth1"}, Mode: "802.3ad"}},
+			}},
+			files: []file{
+				{name: "bond0", netdev: "[NetDev]\nKind=bond\nName=bond0\n\n[Bond]\nMode=802.3ad\n", network: "[Match]\nName=bond0\n\n[Network]\nVLAN=vlan10\n"},
+				{name: "br0", netdev: "[NetDev]\nKind=bridge\nName=br0\n", network: "[Match]\nName=br0\n\n[Network]\nDHCP=true\n"},
+				{name: "eth0", network: "[Match]\nName=eth0\n\n[Network]\nBond=bond0\n"},
+				{name: "eth1", network: "[Match]\nName=eth1\n\n[Network]\nBond=bond0\n"},
+				{name: "vlan10", netdev: "[NetDev]\nKind=vlan\nName=vlan10\n\n[VLAN]\nId=10\n", network: "[Match]\nName=vlan10\n\n[Network]\nBridge=br0\n"},
+			},
+		},
+		{
+			cfg: config.Network{Interfaces: []config.NetworkInterface{
+				{Name: "lan0", MAC: "52:54:00:12:34:56", MTU: 9000, DHCP: true},
+			}},
+			files: []file{
+				{name: "lan0", network: "[Match]\nName=lan0\nMACAddress=52:54:00:12:34:56\n\n[Link]\nMTUBytes=9000\n\n[Network]\nDHCP=true\n"},
+			},
+		},
+		{
+			cfg: config.Network{Interfaces: []config.NetworkInterface{
+				{Name: "eth0", DHCP: true, Addresses: []string{"10.0.0.2/24"}},
+			}},
+			err: errors.New(`interface "eth0": addresses, gateway, routes and DNS can't be combined with DHCP`),
+		},
+		{
+			cfg: config.Network{Interfaces: []config.NetworkInterface{
+				{Name: "eth0", Addresses: []string{"10.0.0.2"}},
+			}},
+			err: errors.New(`interface "eth0": could not parse "10.0.0.2" as an address with a prefix length`),
+		},
+		{
+			cfg: config.Network{Interfaces: []config.NetworkInterface{
+				{Name: "eth0"},
+				{Name: "eth0"},
+			}},
+			err: errors.New(`interface "eth0" is described more than once`),
+		},
+		{
+			cfg: config.Network{Interfaces: []config.NetworkInterface{
+				{Name: "vlan10", Type: "vlan", VLAN: config.NetworkVLAN{ID: 10}},
+			}},
+			err: errors.New(`VLAN "vlan10" requires a link`),
+		},
+	} {
+		interfaces, err := ProcessCloudConfigNetwork(tt.cfg)
+		if !reflect.DeepEqual(tt.err, err) {
+			t.Errorf("bad error (%d): want %v, got %v", i, tt.err, err)
+			continue
+		}
+
+		files := []file{}
+		for _, iface := range interfaces {
+			files = append(files, file{name: iface.Name(), netdev: iface.Netdev(), network: iface.Network()})
+		}
+		if tt.err == nil && !reflect.DeepEqual(tt.files, files) {
+			t.Errorf("bad files (%d): want %#v, got %#v", i, tt.files, files)
+		}
+	}
+}
@@ -27,10 +27,18 @@ func ProcessDebianNetconf(config []byte) ([]InterfaceGenerator, error) {
 		return nil, err
 	}
 
+	// Interfaces may be configured by several stanzas, typically one for
+	// each address family.
 	interfaces := make([]*stanzaInterface, 0, len(stanzas))
+	interfaceMap := make(map[string]*stanzaInterface)
 	for _, stanza := range stanzas {
 		switch s := stanza.(type) {
 		case *stanzaInterface:
+			if iface, ok := interfaceMap[s.name]; ok {
+				mergeInterfaceStanzas(iface, s)
+				continue
+			}
+			interfaceMap[s.name] = s
 			interfaces = append(interfaces, s)
 		}
 	}
@@ -54,3 +54,62 @@ func TestProcessDebianNetconf(t *testing.T) {
 		}
 	}
 }
+
+func TestProcessDebianNetconfDualStack(t *testing.T) {
+	config := `auto lo
+iface lo inet loopback
+
+auto bond0
+iface bond0 inet static
+    address 10.184.7.29
+    netmask 255.255.255.0
+    gateway 10.184.7.1
+    dns-nameservers 69.20.0.164 69.20.0.196
+    dns-search example.com
+    bond-slaves eth0 eth1
+    bond-mode 802.3ad
+
+iface bond0 inet6 static
+    address 2001:4802:7800:2:be76:4eff:fe20:2fe3
+    netmask 64
+    gateway fe80::def
+    dns-nameservers 2001:4860:4860::8888
+
+auto bond0.401
+iface bond0.401 inet static
+    address 10.208.227.239
+    netmask 255.255.224.0
+    vlan_raw_device bond0
+    up ip route add 10.176.0.0/12 via 10.208.224.1
+    post-up route add -net 10.208.0.0 netmask 255.240.0.0 gw 10.208.224.1 || true
+
+iface bond0.401 inet6 auto
+`
+	networks := map[string]string{
+		"bond0": "[Match]\nName=bond0\n\n[Network]\nVLAN=bond0.401\n" +
+			"DNS=69.20.0.164\nDNS=69.20.0.196\nDNS=2001:4860:4860::8888\nDomains=example.com\n" +
+			"\n[Address]\nAddress=10.184.7.29/24\n" +
+			"\n[Address]\nAddress=2001:4802:7800:2:be76:4eff:fe20:2fe3/64\n" +
+			"\n[Route]\nDestination=0.0.0.0/0\nGateway=10.184.7.1\n" +
+			"\n[Route]\nDestination=::/0\nGateway=fe80::def\n",
+		"bond0.401": "[Match]\nName=bond0.401\n\n[Network]\nIPv6AcceptRA=true\n" +
+			"\n[Address]\nAddress=10.208.227.239/19\n" +
+			"\n[Route]\nDestination=10.176.0.0/12\nGateway=10.208.224.1\n" +
+			"\n[Route]\nDestination=10.208.0.0/12\nGateway=10.208.224.1\n",
+		"eth0": "[Match]\nName=eth0\n\n[Network]\nBond=bond0\n",
+		"eth1": "[Match]\nName=eth1\n\n[Network]\nBond=bond0\n",
+	}
+
+	interfaces, err := ProcessDebianNetconf([]byte(config))
+	if err != nil {
+		t.Fatalf("bad error: want nil, got %s", err)
+	}
+	if len(interfaces) != len(networks) {
+		t.Fatalf("bad number of interfaces: want %d, got %d", len(networks), len(interfaces))
+	}
+	for _, iface := range interfaces {
+		if network := iface.Network(); network != networks[iface.Name()] {
+			t.Fatalf("bad network config for %q: want %q, got %q", iface.Name(), networks[iface.Name()], network)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package network
 
 import (
 	"fmt"
+	"log"
 	"net"
 	"sort"
 	"strconv"
@@ -24,12 +25,12 @@ import (
 
 type InterfaceGenerator interface {
 	Name() string
+	Hwaddr() net.HardwareAddr
 	Filename() string
 	Netdev() string
 	Link() string
 	Network() string
 	Type() string
-	ModprobeParams() string
 }
 
 type networkInterface interface {
@@ -41,6 +42,7 @@ type networkInterface interface {
 type logicalInterface struct {
 	name        string
 	hwaddr      net.HardwareAddr
+	mtu         int
 	config      configMethod
 	children    []networkInterface
 	configDepth int
@@ -50,7 +52,18 @@ func (i *logicalInterface) Name() string {
 	return i.name
 }
 
+// Hwaddr returns the MAC address the interface is matched by, if any.
+func (i *logicalInterface) Hwaddr() net.HardwareAddr {
+	return i.hwaddr
+}
+
 func (i *logicalInterface) Network() string {
+	return i.network("")
+}
+
+// network returns the network file of the interface, with the given options
+// in its [Link] section along with the interface's MTU.
+func (i *logicalInterface) network(link string) string {
 	config := fmt.Sprintln("[Match]")
 	if i.name != "" {
 		config += fmt.Sprintf("Name=%s\n", i.name)
@@ -58,6 +71,12 @@ func (i *logicalInterface) Network() string {
 	if i.hwaddr != nil {
 		config += fmt.Sprintf("MACAddress=%s\n", i.hwaddr)
 	}
+	if i.mtu > 0 {
+		link += fmt.Sprintf("MTUBytes=%d\n", i.mtu)
+	}
+	if link != "" {
+		config += "\n[Link]\n" + link
+	}
 	config += "\n[Network]\n"
 
 	for _, child := range i.children {
@@ -66,14 +85,28 @@ func (i *logicalInterface) Network() string {
 			config += fmt.Sprintf("VLAN=%s\n", iface.name)
 		case *bondInterface:
 			config += fmt.Sprintf("Bond=%s\n", iface.name)
+			if i.name != "" && iface.primary == i.name {
+				config += "PrimarySlave=true\n"
+			}
+		case *bridgeInterface:
+			config += fmt.Sprintf("Bridge=%s\n", iface.name)
 		}
 	}
 
 	switch conf := i.config.(type) {
 	case configMethodStatic:
+		if conf.dhcp != "" {
+			config += fmt.Sprintf("DHCP=%s\n", conf.dhcp)
+		}
+		if conf.acceptRA != "" {
+			config += fmt.Sprintf("IPv6AcceptRA=%s\n", conf.acceptRA)
+		}
 		for _, nameserver := range conf.nameservers {
 			config += fmt.Sprintf("DNS=%s\n", nameserver)
 		}
+		if len(conf.domains) > 0 {
+			config += fmt.Sprintf("Domains=%s\n", strings.Join(conf.domains, " "))
+		}
 		for _, addr := range conf.addresses {
 			config += fmt.Sprintf("\n[Address]\nAddress=%s\n", addr.String())
 		}
@@ -81,7 +114,17 @@ func (i *logicalInterface) Network() string {
 			config += fmt.Sprintf("\n[Route]\nDestination=%s\nGateway=%s\n", route.destination.String(), route.gateway)
 		}
 	case configMethodDHCP:
-		config += "DHCP=true\n"
+		family := conf.family
+		if family == "" {
+			family = "true"
+		}
+		config += fmt.Sprintf("DHCP=%s\n", family)
+		if conf.acceptRA != "" {
+			config += fmt.Sprintf("IPv6AcceptRA=%s\n", conf.acceptRA)
+		}
+		if len(conf.domains) > 0 {
+			config += fmt.Sprintf("Domains=%s\n", strings.Join(conf.domains, " "))
+		}
 	}
 
 	return config
@@ -95,6 +138,27 @@ func (i *logicalInterface) Netdev() string {
 	return ""
 }
 
+// configHwaddress returns the MAC address the interface is given by its
+// config, if any.
+func (i *logicalInterface) configHwaddress() net.HardwareAddr {
+	switch c := i.config.(type) {
+	case configMethodStatic:
+		return c.hwaddress
+	case configMethodDHCP:
+		return c.hwaddress
+	}
+	return nil
+}
+
+// netdev returns the [NetDev] section of the netdev file of the interface.
+func (i *logicalInterface) netdev(kind string) string {
+	config := fmt.Sprintf("[NetDev]\nKind=%s\nName=%s\n", kind, i.name)
+	if hwaddress := i.configHwaddress(); hwaddress != nil {
+		config += fmt.Sprintf("MACAddress=%s\n", hwaddress)
+	}
+	return config
+}
+
 func (i *logicalInterface) Filename() string {
 	name := i.name
 	if name == "" {
@@ -107,10 +171,6 @@ func (i *logicalInterface) Children() []networkInterface {
 	return i.children
 }
 
-func (i *logicalInterface) ModprobeParams() string {
-	return ""
-}
-
 func (i *logicalInterface) setConfigDepth(depth int) {
 	i.configDepth = depth
 }
@@ -123,29 +183,87 @@ func (p *physicalInterface) Type() string {
 	return "physical"
 }
 
+func (p *physicalInterface) Network() string {
+	var link string
+	if hwaddress := p.configHwaddress(); hwaddress != nil {
+		link = fmt.Sprintf("MACAddress=%s\n", hwaddress)
+	}
+	return p.network(link)
+}
+
+// Link returns a link file which names the interface after its MAC address,
+// so that the name persists across reboots. Interfaces which are only matched
+// by name or MAC address don't need one.
+func (p *physicalInterface) Link() string {
+	if p.name == "" || p.hwaddr == nil {
+		return ""
+	}
+	config := fmt.Sprintf("[Match]\nMACAddress=%s\n\n[Link]\nName=%s\n", p.hwaddr, p.name)
+	if p.mtu > 0 {
+		config += fmt.Sprintf("MTUBytes=%d\n", p.mtu)
+	}
+	return config
+}
+
+// interfaceHwaddr returns the MAC address of the named interface of the
+// running system.
+var interfaceHwaddr = func(name string) (net.HardwareAddr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return iface.HardwareAddr, nil
+}
+
+// SetLinkMTUs sets the MTU of the physical interfaces which don't have one to
+// that of their link in the given MTUs, keyed by MAC address, as provided by
+// the metadata of the platform. Interfaces which aren't matched by MAC address
+// are looked up by name on the running system.
+func SetLinkMTUs(interfaces []InterfaceGenerator, mtus map[string]int) {
+	if len(mtus) == 0 {
+		return
+	}
+	for _, iface := range interfaces {
+		p, ok := iface.(*physicalInterface)
+		if !ok || p.mtu > 0 {
+			continue
+		}
+		hwaddr := p.hwaddr
+		if hwaddr == nil {
+			var err error
+			if hwaddr, err = interfaceHwaddr(p.name); err != nil {
+				continue
+			}
+		}
+		if mtu, ok := mtus[hwaddr.String()]; ok {
+			log.Printf("Setting MTU of interface %q to %d from its link", p.Name(), mtu)
+			p.mtu = mtu
+		}
+	}
+}
+
 type bondInterface struct {
 	logicalInterface
 	slaves  []string
 	options map[string]string
+	primary string
 }
 
 func (b *bondInterface) Netdev() string {
-	return fmt.Sprintf("[NetDev]\nKind=bond\nName=%s\n", b.name)
+	config := b.netdev("bond")
+	if len(b.options) > 0 {
+		config += "\n[Bond]\n"
+		for _, name := range sortedKeys(b.options) {
+			config += fmt.Sprintf("%s=%s\n", name, b.options[name])
+		}
+	}
+	return config
 }
 
 func (b *bondInterface) Type() string {
 	return "bond"
 }
 
-func (b *bondInterface) ModprobeParams() string {
-	params := ""
-	for _, name := range sortedKeys(b.options) {
-		params += fmt.Sprintf("%s=%s ", name, b.options[name])
-	}
-	params = strings.TrimSuffix(params, " ")
-	return params
-}
-
 type vlanInterface struct {
 	logicalInterface
 	id        int
@@ -153,17 +271,7 @@ type vlanInterface struct {
 }
 
 func (v *vlanInterface) Netdev() string {
-	config := fmt.Sprintf("[NetDev]\nKind=vlan\nName=%s\n", v.name)
-	switch c := v.config.(type) {
-	case configMethodStatic:
-		if c.hwaddress != nil {
-			config += fmt.Sprintf("MACAddress=%s\n", c.hwaddress)
-		}
-	case configMethodDHCP:
-		if c.hwaddress != nil {
-			config += fmt.Sprintf("MACAddress=%s\n", c.hwaddress)
-		}
-	}
+	config := v.netdev("vlan")
 	config += fmt.Sprintf("\n[VLAN]\nId=%d\n", v.id)
 	return config
 }
@@ -172,8 +280,34 @@ func (v *vlanInterface) Type() string {
 	return "vlan"
 }
 
+type bridgeInterface struct {
+	logicalInterface
+	ports   []string
+	options map[string]string
+}
+
+func (b *bridgeInterface) Netdev() string {
+	config := b.netdev("bridge")
+	if len(b.options) > 0 {
+		config += "\n[Bridge]\n"
+		for _, name := range sortedKeys(b.options) {
+			config += fmt.Sprintf("%s=%s\n", name, b.options[name])
+		}
+	}
+	return config
+}
+
+func (b *bridgeInterface) Type() string {
+	return "bridge"
+}
+
 func buildInterfaces(stanzas []*stanzaInterface) []InterfaceGenerator {
-	interfaceMap := createInterfaces(stanzas)
+	return orderInterfaces(createInterfaces(stanzas))
+}
+
+// orderInterfaces links the given interfaces to those built on top of them
+// and returns them, sorted by name, with the depths of their configs set.
+func orderInterfaces(interfaceMap map[string]networkInterface) []InterfaceGenerator {
 	linkAncestors(interfaceMap)
 	markConfigDepths(interfaceMap)
 
@@ -188,22 +322,26 @@ func buildInterfaces(stanzas []*stanzaInterface) []InterfaceGenerator {
 func createInterfaces(stanzas []*stanzaInterface) map[string]networkInterface {
 	interfaceMap := make(map[string]networkInterface)
 	for _, iface := range stanzas {
+		// The MTU has already been checked by parseInterfaceStanza.
+		mtu, _ := parseMTU(iface.options, iface.name)
 		switch iface.kind {
 		case interfaceBond:
-			bondOptions := make(map[string]string)
-			for _, k := range []string{"mode", "miimon", "lacp-rate"} {
-				if v, ok := iface.options["bond-"+k]; ok && len(v) > 0 {
-					bondOptions[k] = v[0]
-				}
+			// The options have already been checked by parseBondStanza.
+			bondOptions, _ := parseBondOptions(iface.options)
+			var primary string
+			if v := iface.options["bond-primary"]; len(v) > 0 {
+				primary = v[0]
 			}
 			interfaceMap[iface.name] = &bondInterface{
 				logicalInterface{
 					name:     iface.name,
+					mtu:      mtu,
 					config:   iface.configMethod,
 					children: []networkInterface{},
 				},
 				iface.options["bond-slaves"],
 				bondOptions,
+				primary,
 			}
 			for _, slave := range iface.options["bond-slaves"] {
 				if _, ok := interfaceMap[slave]; !ok {
@@ -224,11 +362,37 @@ func createInterfaces(stanzas []*stanzaInterface) map[string]networkInterface {
 			interfaceMap[iface.name] = &physicalInterface{
 				logicalInterface{
 					name:     iface.name,
+					mtu:      mtu,
 					config:   iface.configMethod,
 					children: []networkInterface{},
 				},
 			}
 
+		case interfaceBridge:
+			// The options have already been checked by parseBridgeStanza.
+			bridgeOptions, _ := parseBridgeOptions(iface.options)
+			interfaceMap[iface.name] = &bridgeInterface{
+				logicalInterface{
+					name:     iface.name,
+					mtu:      mtu,
+					config:   iface.configMethod,
+					children: []networkInterface{},
+				},
+				iface.options["bridge_ports"],
+				bridgeOptions,
+			}
+			for _, port := range iface.options["bridge_ports"] {
+				if _, ok := interfaceMap[port]; !ok {
+					interfaceMap[port] = &physicalInterface{
+						logicalInterface{
+							name:     port,
+							config:   configMethodManual{},
+							children: []networkInterface{},
+						},
+					}
+				}
+			}
+
 		case interfaceVLAN:
 			var rawDevice string
 			id, _ := strconv.Atoi(iface.options["id"][0])
@@ -247,6 +411,7 @@ func createInterfaces(stanzas []*stanzaInterface) map[string]networkInterface {
 			interfaceMap[iface.name] = &vlanInterface{
 				logicalInterface{
 					name:     iface.name,
+					mtu:      mtu,
 					config:   iface.configMethod,
 					children: []networkInterface{},
 				},
@@ -282,6 +447,19 @@ func linkAncestors(interfaceMap map[string]networkInterface) {
 					}
 				}
 			}
+		case *bridgeInterface:
+			for _, port := range i.ports {
+				if parent, ok := interfaceMap[port]; ok {
+					switch p := parent.(type) {
+					case *physicalInterface:
+						p.children = append(p.children, iface)
+					case *bondInterface:
+						p.children = append(p.children, iface)
+					case *vlanInterface:
+						p.children = append(p.children, iface)
+					}
+				}
+			}
 		}
 	}
 }
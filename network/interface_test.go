@@ -15,6 +15,7 @@
 package network
 
 import (
+	"errors"
 	"net"
 	"reflect"
 	"testing"
@@ -37,6 +38,60 @@ func TestInterfaceGenerators(t *testing.T) {
 				hwaddr: net.HardwareAddr([]byte{0, 1, 2, 3, 4, 5}),
 			}},
 		},
+		{
+			name:    "testname",
+			link:    "[Match]\nMACAddress=00:01:02:03:04:05\n\n[Link]\nName=testname\nMTUBytes=9000\n",
+			network: "[Match]\nName=testname\nMACAddress=00:01:02:03:04:05\n\n[Link]\nMTUBytes=9000\n\n[Network]\n",
+			kind:    "physical",
+			iface: &physicalInterface{logicalInterface{
+				name:   "testname",
+				hwaddr: net.HardwareAddr([]byte{0, 1, 2, 3, 4, 5}),
+				mtu:    9000,
+			}},
+		},
+		{
+			name:    "testname",
+			network: "[Match]\nName=testname\n\n[Link]\nMACAddress=00:01:02:03:04:05\nMTUBytes=1400\n\n[Network]\nDHCP=true\n",
+			kind:    "physical",
+			iface: &physicalInterface{logicalInterface{
+				name:   "testname",
+				mtu:    1400,
+				config: configMethodDHCP{hwaddress: net.HardwareAddr([]byte{0, 1, 2, 3, 4, 5})},
+			}},
+		},
+		{
+			name:    "testname",
+			netdev:  "[NetDev]\nKind=bond\nName=testname\nMACAddress=00:01:02:03:04:05\n",
+			network: "[Match]\nName=testname\n\n[Link]\nMTUBytes=9000\n\n[Network]\nDHCP=true\n",
+			kind:    "bond",
+			iface: &bondInterface{logicalInterface: logicalInterface{
+				name:   "testname",
+				mtu:    9000,
+				config: configMethodDHCP{hwaddress: net.HardwareAddr([]byte{0, 1, 2, 3, 4, 5})},
+			}},
+		},
+		{
+			name:    "testname",
+			network: "[Match]\nName=testname\n\n[Network]\nDHCP=ipv6\nIPv6AcceptRA=true\nDomains=example.com example.org\n",
+			kind:    "physical",
+			iface: &physicalInterface{logicalInterface{
+				name:   "testname",
+				config: configMethodDHCP{family: "ipv6", acceptRA: "true", domains: []string{"example.com", "example.org"}},
+			}},
+		},
+		{
+			name:    "testname",
+			network: "[Match]\nName=testname\n\n[Network]\nDHCP=ipv4\nIPv6AcceptRA=false\n\n[Address]\nAddress=2001:db8::2/64\n",
+			kind:    "physical",
+			iface: &physicalInterface{logicalInterface{
+				name: "testname",
+				config: configMethodStatic{
+					addresses: []net.IPNet{{IP: net.ParseIP("2001:db8::2"), Mask: net.CIDRMask(64, 128)}},
+					dhcp:      "ipv4",
+					acceptRA:  "false",
+				},
+			}},
+		},
 		{
 			name:    "testname",
 			network: "[Match]\nName=testname\n\n[Network]\nBond=testbond1\nVLAN=testvlan1\nVLAN=testvlan2\n",
@@ -65,6 +120,16 @@ func TestInterfaceGenerators(t *testing.T) {
 				},
 			}},
 		},
+		{
+			name:    "testname",
+			netdev:  "[NetDev]\nKind=bond\nName=testname\n\n[Bond]\nLACPTransmitRate=fast\nMode=802.3ad\n",
+			network: "[Match]\nName=testname\n\n[Network]\n",
+			kind:    "bond",
+			iface: &bondInterface{
+				logicalInterface: logicalInterface{name: "testname"},
+				options:          map[string]string{"Mode": "802.3ad", "LACPTransmitRate": "fast"},
+			},
+		},
 		{
 			name:    "testname",
 			netdev:  "[NetDev]\nKind=vlan\nName=testname\n\n[VLAN]\nId=1\n",
@@ -100,6 +165,29 @@ func TestInterfaceGenerators(t *testing.T) {
 				},
 			}},
 		},
+		{
+			name:    "testname",
+			netdev:  "[NetDev]\nKind=bridge\nName=testname\n",
+			network: "[Match]\nName=testname\n\n[Network]\nDHCP=true\n",
+			kind:    "bridge",
+			iface:   &bridgeInterface{logicalInterface{name: "testname", config: configMethodDHCP{}}, []string{"eth0"}, nil},
+		},
+		{
+			name:    "testname",
+			netdev:  "[NetDev]\nKind=bridge\nName=testname\n\n[Bridge]\nForwardDelaySec=0\nSTP=yes\n",
+			network: "[Match]\nName=testname\n\n[Network]\n",
+			kind:    "bridge",
+			iface:   &bridgeInterface{logicalInterface{name: "testname"}, []string{"eth0"}, map[string]string{"STP": "yes", "ForwardDelaySec": "0"}},
+		},
+		{
+			name:    "testname",
+			network: "[Match]\nName=testname\n\n[Network]\nBridge=testbridge\n",
+			kind:    "physical",
+			iface: &physicalInterface{logicalInterface{
+				name:     "testname",
+				children: []networkInterface{&bridgeInterface{logicalInterface: logicalInterface{name: "testbridge"}}},
+			}},
+		},
 	} {
 		if name := tt.iface.Name(); name != tt.name {
 			t.Fatalf("bad name (%q): want %q, got %q", tt.iface, tt.name, name)
@@ -119,33 +207,23 @@ func TestInterfaceGenerators(t *testing.T) {
 	}
 }
 
-func TestModprobeParams(t *testing.T) {
+func TestBondPrimarySlave(t *testing.T) {
+	bond := &bondInterface{logicalInterface: logicalInterface{name: "bond0"}, primary: "eth1"}
 	for _, tt := range []struct {
-		i InterfaceGenerator
-		p string
+		i       InterfaceGenerator
+		network string
 	}{
 		{
-			i: &physicalInterface{},
-			p: "",
-		},
-		{
-			i: &vlanInterface{},
-			p: "",
+			i:       &physicalInterface{logicalInterface{name: "eth0", children: []networkInterface{bond}}},
+			network: "[Match]\nName=eth0\n\n[Network]\nBond=bond0\n",
 		},
 		{
-			i: &bondInterface{
-				logicalInterface{},
-				nil,
-				map[string]string{
-					"a": "1",
-					"b": "2",
-				},
-			},
-			p: "a=1 b=2",
+			i:       &physicalInterface{logicalInterface{name: "eth1", children: []networkInterface{bond}}},
+			network: "[Match]\nName=eth1\n\n[Network]\nBond=bond0\nPrimarySlave=true\n",
 		},
 	} {
-		if p := tt.i.ModprobeParams(); p != tt.p {
-			t.Fatalf("bad params (%q): got %s, want %s", tt.i, p, tt.p)
+		if network := tt.i.Network(); network != tt.network {
+			t.Fatalf("bad network (%q): want %q, got %q", tt.i, tt.network, network)
 		}
 	}
 }
@@ -188,6 +266,7 @@ func TestBuildInterfacesBlindBond(t *testing.T) {
 		},
 		[]string{"eth0"},
 		map[string]string{},
+		"",
 	}
 	eth0 := &physicalInterface{
 		logicalInterface{
@@ -241,6 +320,60 @@ func TestBuildInterfacesBlindVLAN(t *testing.T) {
 	}
 }
 
+func TestBuildInterfacesBridge(t *testing.T) {
+	stanzas := []*stanzaInterface{
+		{
+			name:         "br0",
+			kind:         interfaceBridge,
+			configMethod: configMethodDHCP{},
+			options: map[string][]string{
+				"bridge_ports": []string{"bond0", "vlan10"},
+				"bridge_stp":   []string{"on"},
+				"bridge_fd":    []string{"0"},
+			},
+		},
+		{
+			name:         "bond0",
+			kind:         interfaceBond,
+			configMethod: configMethodManual{},
+			options: map[string][]string{
+				"bond-slaves": []string{"eth0", "eth1"},
+			},
+		},
+		{
+			name:         "vlan10",
+			kind:         interfaceVLAN,
+			configMethod: configMethodManual{},
+			options: map[string][]string{
+				"id":         []string{"10"},
+				"raw_device": []string{"eth2"},
+			},
+		},
+	}
+
+	type file struct {
+		filename string
+		netdev   string
+		network  string
+	}
+	expect := []file{
+		{"01-bond0", "[NetDev]\nKind=bond\nName=bond0\n", "[Match]\nName=bond0\n\n[Network]\nBridge=br0\n"},
+		{"00-br0", "[NetDev]\nKind=bridge\nName=br0\n\n[Bridge]\nForwardDelaySec=0\nSTP=yes\n", "[Match]\nName=br0\n\n[Network]\nDHCP=true\n"},
+		{"02-eth0", "", "[Match]\nName=eth0\n\n[Network]\nBond=bond0\n"},
+		{"02-eth1", "", "[Match]\nName=eth1\n\n[Network]\nBond=bond0\n"},
+		{"02-eth2", "", "[Match]\nName=eth2\n\n[Network]\nVLAN=vlan10\n"},
+		{"01-vlan10", "[NetDev]\nKind=vlan\nName=vlan10\n\n[VLAN]\nId=10\n", "[Match]\nName=vlan10\n\n[Network]\nBridge=br0\n"},
+	}
+
+	var files []file
+	for _, iface := range buildInterfaces(stanzas) {
+		files = append(files, file{iface.Filename(), iface.Netdev(), iface.Network()})
+	}
+	if !reflect.DeepEqual(expect, files) {
+		t.Fatalf("bad files: want %#v, got %#v", expect, files)
+	}
+}
+
 func TestBuildInterfaces(t *testing.T) {
 	stanzas := []*stanzaInterface{
 		&stanzaInterface{
@@ -321,6 +454,7 @@ func TestBuildInterfaces(t *testing.T) {
 		},
 		[]string{"bond0"},
 		map[string]string{},
+		"",
 	}
 	bond0 := &bondInterface{
 		logicalInterface{
@@ -331,9 +465,10 @@ func TestBuildInterfaces(t *testing.T) {
 		},
 		[]string{"eth0"},
 		map[string]string{
-			"mode":   "4",
-			"miimon": "100",
+			"Mode":          "802.3ad",
+			"MIIMonitorSec": "100ms",
 		},
+		"",
 	}
 	eth0 := &physicalInterface{
 		logicalInterface{
@@ -366,3 +501,39 @@ func TestFilename(t *testing.T) {
 		}
 	}
 }
+
+func TestSetLinkMTUs(t *testing.T) {
+	defer func(f func(string) (net.HardwareAddr, error)) { interfaceHwaddr = f }(interfaceHwaddr)
+	interfaceHwaddr = func(name string) (net.HardwareAddr, error) {
+		if name == "eth0" {
+			return net.ParseMAC("52:54:00:00:00:01")
+		}
+		return nil, errors.New("no such interface")
+	}
+
+	eth0 := &physicalInterface{logicalInterface{name: "eth0"}}
+	eth1 := &physicalInterface{logicalInterface{name: "eth1"}}
+	lan := &physicalInterface{logicalInterface{name: "lan", hwaddr: net.HardwareAddr{0x52, 0x54, 0x00, 0x00, 0x00, 0x02}}}
+	wan := &physicalInterface{logicalInterface{name: "wan", hwaddr: net.HardwareAddr{0x52, 0x54, 0x00, 0x00, 0x00, 0x03}, mtu: 1400}}
+	bond0 := &bondInterface{logicalInterface: logicalInterface{name: "bond0"}}
+
+	SetLinkMTUs([]InterfaceGenerator{eth0, eth1, lan, wan, bond0}, map[string]int{
+		"52:54:00:00:00:01": 9000,
+		"52:54:00:00:00:02": 8950,
+		"52:54:00:00:00:03": 9000,
+	})
+	for _, tt := range []struct {
+		i   *logicalInterface
+		mtu int
+	}{
+		{&eth0.logicalInterface, 9000},
+		{&eth1.logicalInterface, 0},
+		{&lan.logicalInterface, 8950},
+		{&wan.logicalInterface, 1400},
+		{&bond0.logicalInterface, 0},
+	} {
+		if tt.i.mtu != tt.mtu {
+			t.Errorf("bad MTU of %q: want %d, got %d", tt.i.name, tt.mtu, tt.i.mtu)
+		}
+	}
+}
@@ -0,0 +1,745 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/coreos-cloudinit/Godeps/_workspace/src/github.com/coreos/yaml"
+)
+
+// netplanConfig is the network configuration of cloud-init, either at the top
+// level of the document or under a "network" key.
+type netplanConfig struct {
+	Network *netplanConfig `yaml:"network"`
+	Version int            `yaml:"version"`
+
+	// version 1
+	Config []netplanV1Entry `yaml:"config"`
+
+	// version 2
+	Ethernets map[string]netplanV2Ethernet `yaml:"ethernets"`
+	Bonds     map[string]netplanV2Bond     `yaml:"bonds"`
+	VLANs     map[string]netplanV2VLAN     `yaml:"vlans"`
+	Bridges   map[string]netplanV2Bridge   `yaml:"bridges"`
+}
+
+type netplanV1Entry struct {
+	Type             string                 `yaml:"type"`
+	Name             string                 `yaml:"name"`
+	MACAddress       string                 `yaml:"mac_address"`
+	MTU              int                    `yaml:"mtu"`
+	Subnets          []netplanV1Subnet      `yaml:"subnets"`
+	BondInterfaces   []string               `yaml:"bond_interfaces"`
+	BridgeInterfaces []string               `yaml:"bridge_interfaces"`
+	VLANLink         string                 `yaml:"vlan_link"`
+	VLANID           int                    `yaml:"vlan_id"`
+	Params           map[string]interface{} `yaml:"params"`
+
+	// nameserver
+	Address   interface{} `yaml:"address"`
+	Interface string      `yaml:"interface"`
+
+	// route
+	Route netplanV1Route `yaml:",inline"`
+}
+
+type netplanV1Subnet struct {
+	Type           string           `yaml:"type"`
+	Address        string           `yaml:"address"`
+	Netmask        string           `yaml:"netmask"`
+	Gateway        string           `yaml:"gateway"`
+	DNSNameservers []string         `yaml:"dns_nameservers"`
+	Routes         []netplanV1Route `yaml:"routes"`
+}
+
+type netplanV1Route struct {
+	Destination string `yaml:"destination"`
+	Network     string `yaml:"network"`
+	Netmask     string `yaml:"netmask"`
+	Gateway     string `yaml:"gateway"`
+}
+
+type netplanV2Addressing struct {
+	MACAddress  string   `yaml:"macaddress"`
+	MTU         int      `yaml:"mtu"`
+	DHCP4       bool     `yaml:"dhcp4"`
+	DHCP6       bool     `yaml:"dhcp6"`
+	Addresses   []string `yaml:"addresses"`
+	Gateway4    string   `yaml:"gateway4"`
+	Gateway6    string   `yaml:"gateway6"`
+	Nameservers struct {
+		Addresses []string `yaml:"addresses"`
+	} `yaml:"nameservers"`
+	Routes []struct {
+		To  string `yaml:"to"`
+		Via string `yaml:"via"`
+	} `yaml:"routes"`
+}
+
+type netplanV2Ethernet struct {
+	Addressing netplanV2Addressing `yaml:",inline"`
+	Match      *struct {
+		Name       string `yaml:"name"`
+		MACAddress string `yaml:"macaddress"`
+	} `yaml:"match"`
+	SetName string `yaml:"set-name"`
+}
+
+type netplanV2Bond struct {
+	Addressing netplanV2Addressing    `yaml:",inline"`
+	Interfaces []string               `yaml:"interfaces"`
+	Parameters map[string]interface{} `yaml:"parameters"`
+}
+
+type netplanV2VLAN struct {
+	Addressing netplanV2Addressing `yaml:",inline"`
+	ID         int                 `yaml:"id"`
+	Link       string              `yaml:"link"`
+}
+
+type netplanV2Bridge struct {
+	Addressing netplanV2Addressing    `yaml:",inline"`
+	Interfaces []string               `yaml:"interfaces"`
+	Parameters map[string]interface{} `yaml:"parameters"`
+}
+
+// ProcessNetplanNetconf translates the network configuration of cloud-init,
+// in either version 1 or version 2 (the format of netplan), into interfaces.
+func ProcessNetplanNetconf(config []byte) ([]InterfaceGenerator, error) {
+	log.Println("Processing netplan network config")
+	if len(config) == 0 {
+		return nil, nil
+	}
+
+	var cfg netplanConfig
+	if err := yaml.Unmarshal(config, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Network != nil {
+		cfg = *cfg.Network
+	}
+
+	var interfaceMap map[string]networkInterface
+	var err error
+	switch cfg.Version {
+	case 1:
+		interfaceMap, err = processNetplanV1(cfg.Config)
+	case 2:
+		interfaceMap, err = processNetplanV2(cfg)
+	default:
+		err = fmt.Errorf("unsupported network config version %d", cfg.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	addLowerInterfaces(interfaceMap)
+	generators := orderInterfaces(interfaceMap)
+	log.Printf("Processed %d network interfaces\n", len(generators))
+	return generators, nil
+}
+
+func processNetplanV1(entries []netplanV1Entry) (map[string]networkInterface, error) {
+	interfaceMap := make(map[string]networkInterface)
+	var nameservers []netplanV1Entry
+	var routes []netplanV1Entry
+	for _, e := range entries {
+		switch e.Type {
+		case "nameserver":
+			nameservers = append(nameservers, e)
+			continue
+		case "route":
+			routes = append(routes, e)
+			continue
+		case "physical", "bond", "vlan", "bridge":
+		default:
+			log.Printf("Ignoring network config entry of type %q\n", e.Type)
+			continue
+		}
+
+		if e.Name == "" {
+			return nil, fmt.Errorf("%s interface requires a name", e.Type)
+		}
+		if _, ok := interfaceMap[e.Name]; ok {
+			return nil, fmt.Errorf("interface %q is described more than once", e.Name)
+		}
+		logical, err := parseNetplanV1Interface(e)
+		if err != nil {
+			return nil, err
+		}
+
+		switch e.Type {
+		case "physical":
+			interfaceMap[e.Name] = &physicalInterface{*logical}
+		case "bond":
+			if len(e.BondInterfaces) == 0 {
+				return nil, fmt.Errorf("bond %q requires interfaces", e.Name)
+			}
+			options := make(map[string][]string)
+			for k, v := range e.Params {
+				options[k] = stringList(v)
+			}
+			bondOptions, err := parseBondOptions(options)
+			if err != nil {
+				return nil, fmt.Errorf("bond %q: %v", e.Name, err)
+			}
+			var primary string
+			if v := options["bond-primary"]; len(v) > 0 {
+				primary = v[0]
+			}
+			interfaceMap[e.Name] = &bondInterface{*logical, e.BondInterfaces, bondOptions, primary}
+		case "vlan":
+			if e.VLANLink == "" {
+				return nil, fmt.Errorf("VLAN %q requires a link", e.Name)
+			}
+			interfaceMap[e.Name] = &vlanInterface{*logical, e.VLANID, e.VLANLink}
+		case "bridge":
+			options := make(map[string][]string)
+			for k, v := range e.Params {
+				options[k] = stringList(v)
+			}
+			bridgeOptions, err := parseBridgeOptions(options)
+			if err != nil {
+				return nil, fmt.Errorf("bridge %q: %v", e.Name, err)
+			}
+			interfaceMap[e.Name] = &bridgeInterface{*logical, e.BridgeInterfaces, bridgeOptions}
+		}
+	}
+
+	for _, r := range routes {
+		destination, gateway, err := parseNetplanV1Route(r.Route)
+		if err != nil {
+			return nil, err
+		}
+		if !addNetplanV1Route(interfaceMap, route{destination: destination, gateway: gateway}) {
+			return nil, fmt.Errorf("no interface with a static address can reach gateway %s", gateway)
+		}
+	}
+
+	for _, ns := range nameservers {
+		for _, a := range stringList(ns.Address) {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("could not parse %q as nameserver IP address", a)
+			}
+			for _, name := range sortedInterfaces(interfaceMap) {
+				if ns.Interface != "" && ns.Interface != name {
+					continue
+				}
+				logical := logicalInterfaceOf(interfaceMap[name])
+				if static, ok := logical.config.(configMethodStatic); ok && !containsIP(static.nameservers, ip) {
+					static.nameservers = append(static.nameservers, ip)
+					logical.config = static
+				}
+			}
+		}
+	}
+
+	return interfaceMap, nil
+}
+
+// addNetplanV1Route adds the given route to the first interface with a static
+// address on the same network as the route's gateway, returning whether or not
+// there is one.
+func addNetplanV1Route(interfaceMap map[string]networkInterface, r route) bool {
+	for _, name := range sortedInterfaces(interfaceMap) {
+		logical := logicalInterfaceOf(interfaceMap[name])
+		static, ok := logical.config.(configMethodStatic)
+		if !ok {
+			continue
+		}
+		for _, addr := range static.addresses {
+			if addr.Contains(r.gateway) {
+				static.routes = append(static.routes, r)
+				logical.config = static
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseNetplanV1Interface returns the interface described by the given entry
+// along with the addressing of its subnets.
+func parseNetplanV1Interface(e netplanV1Entry) (*logicalInterface, error) {
+	var hwaddr net.HardwareAddr
+	if e.MACAddress != "" {
+		var err error
+		if hwaddr, err = net.ParseMAC(e.MACAddress); err != nil {
+			return nil, fmt.Errorf("interface %q: %v", e.Name, err)
+		}
+	}
+
+	a := netplanAddressing{}
+	for _, s := range e.Subnets {
+		switch s.Type {
+		case "dhcp", "dhcp4":
+			a.dhcp4 = true
+		case "dhcp6":
+			a.dhcp6 = true
+		case "static", "static6":
+			addr, err := parseNetplanV1Address(s.Address, s.Netmask)
+			if err != nil {
+				return nil, fmt.Errorf("interface %q: %v", e.Name, err)
+			}
+			a.addresses = append(a.addresses, addr)
+			if s.Gateway != "" {
+				a.gateways = append(a.gateways, s.Gateway)
+			}
+			a.nameservers = append(a.nameservers, s.DNSNameservers...)
+			for _, r := range s.Routes {
+				destination, gateway, err := parseNetplanV1Route(r)
+				if err != nil {
+					return nil, fmt.Errorf("interface %q: %v", e.Name, err)
+				}
+				a.routes = append(a.routes, route{destination: destination, gateway: gateway})
+			}
+		case "manual":
+		default:
+			log.Printf("Ignoring subnet of type %q of interface %q\n", s.Type, e.Name)
+		}
+	}
+
+	// The MAC address of a physical interface identifies it, while bonds,
+	// VLANs and bridges are given theirs.
+	var match net.HardwareAddr
+	if e.Type == "physical" {
+		match, hwaddr = hwaddr, nil
+	}
+	conf, err := a.configMethod(hwaddr)
+	if err != nil {
+		return nil, fmt.Errorf("interface %q: %v", e.Name, err)
+	}
+
+	return &logicalInterface{
+		name:     e.Name,
+		hwaddr:   match,
+		mtu:      e.MTU,
+		config:   conf,
+		children: []networkInterface{},
+	}, nil
+}
+
+// parseNetplanV1Address parses an address which either has a prefix length or
+// is accompanied by a netmask (as an address or a prefix length).
+func parseNetplanV1Address(address, netmask string) (net.IPNet, error) {
+	if strings.Contains(address, "/") {
+		ip, ipnet, err := net.ParseCIDR(address)
+		if err != nil {
+			return net.IPNet{}, fmt.Errorf("could not parse %q as address", address)
+		}
+		return net.IPNet{IP: ip, Mask: ipnet.Mask}, nil
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return net.IPNet{}, fmt.Errorf("could not parse %q as address", address)
+	}
+	bits := net.IPv6len * 8
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = net.IPv4len * 8
+	}
+	switch {
+	case netmask == "":
+		return net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	case net.ParseIP(netmask) != nil:
+		mask := net.ParseIP(netmask)
+		if m := mask.To4(); m != nil {
+			mask = m
+		}
+		return net.IPNet{IP: ip, Mask: net.IPMask(mask)}, nil
+	default:
+		ones, err := strconv.Atoi(netmask)
+		if err != nil || ones < 0 || ones > bits {
+			return net.IPNet{}, fmt.Errorf("could not parse %q as netmask", netmask)
+		}
+		return net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}, nil
+	}
+}
+
+func parseNetplanV1Route(r netplanV1Route) (net.IPNet, net.IP, error) {
+	destination := r.Destination
+	if destination == "" {
+		destination = r.Network
+	}
+	addr, err := parseNetplanV1Address(destination, r.Netmask)
+	if err != nil {
+		return net.IPNet{}, nil, fmt.Errorf("could not parse %q as route destination", destination)
+	}
+	gateway := net.ParseIP(r.Gateway)
+	if gateway == nil {
+		return net.IPNet{}, nil, fmt.Errorf("could not parse %q as route gateway", r.Gateway)
+	}
+	return net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}, gateway, nil
+}
+
+// netplanV2BondParameters maps the parameters of a bond onto the Debian bond
+// options.
+var netplanV2BondParameters = map[string]string{
+	"mode":                    "bond-mode",
+	"lacp-rate":               "bond-lacp-rate",
+	"mii-monitor-interval":    "bond-miimon",
+	"min-links":               "bond-min-links",
+	"transmit-hash-policy":    "bond-xmit-hash-policy",
+	"ad-select":               "bond-ad-select",
+	"all-slaves-active":       "bond-all-slaves-active",
+	"arp-interval":            "bond-arp-interval",
+	"arp-ip-targets":          "bond-arp-ip-target",
+	"arp-validate":            "bond-arp-validate",
+	"arp-all-targets":         "bond-arp-all-targets",
+	"up-delay":                "bond-updelay",
+	"down-delay":              "bond-downdelay",
+	"fail-over-mac-policy":    "bond-fail-over-mac",
+	"gratuitous-arp":          "bond-num-grat-arp",
+	"gratuitious-arp":         "bond-num-grat-arp",
+	"packets-per-slave":       "bond-packets-per-slave",
+	"primary-reselect-policy": "bond-primary-reselect",
+	"resend-igmp":             "bond-resend-igmp",
+	"learn-packet-interval":   "bond-lp-interval",
+	"primary":                 "bond-primary",
+}
+
+func processNetplanV2(cfg netplanConfig) (map[string]networkInterface, error) {
+	interfaceMap := make(map[string]networkInterface)
+	add := func(name string, iface networkInterface) error {
+		if _, ok := interfaceMap[name]; ok {
+			return fmt.Errorf("interface %q is described more than once", name)
+		}
+		interfaceMap[name] = iface
+		return nil
+	}
+
+	var sortedEthernets, sortedBonds, sortedVLANs, sortedBridges []string
+	for id := range cfg.Ethernets {
+		sortedEthernets = append(sortedEthernets, id)
+	}
+	for id := range cfg.Bonds {
+		sortedBonds = append(sortedBonds, id)
+	}
+	for id := range cfg.VLANs {
+		sortedVLANs = append(sortedVLANs, id)
+	}
+	for id := range cfg.Bridges {
+		sortedBridges = append(sortedBridges, id)
+	}
+	for _, ids := range [][]string{sortedEthernets, sortedBonds, sortedVLANs, sortedBridges} {
+		sort.Strings(ids)
+	}
+
+	// Ethernets which are matched by name or MAC address are referred to
+	// by their ID within the config.
+	names := make(map[string]string)
+	for _, id := range sortedEthernets {
+		e := cfg.Ethernets[id]
+		name := id
+		var hwaddr net.HardwareAddr
+		if e.Match != nil {
+			name = e.Match.Name
+			if e.Match.MACAddress != "" {
+				var err error
+				if hwaddr, err = net.ParseMAC(e.Match.MACAddress); err != nil {
+					return nil, fmt.Errorf("interface %q: %v", id, err)
+				}
+			}
+		}
+		if e.SetName != "" && hwaddr != nil {
+			name = e.SetName
+		} else if e.SetName != "" && e.SetName != name {
+			log.Printf("Not renaming interface %q to %q: it isn't matched by MAC address\n", id, e.SetName)
+		}
+		if name == "" && hwaddr == nil {
+			return nil, fmt.Errorf("interface %q: match requires a name or a MAC address", id)
+		}
+
+		conf, err := e.Addressing.configMethod()
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %v", id, err)
+		}
+		key := name
+		if key == "" {
+			key = hwaddr.String()
+		}
+		names[id] = key
+		if err := add(key, &physicalInterface{logicalInterface{
+			name:     name,
+			hwaddr:   hwaddr,
+			mtu:      e.Addressing.MTU,
+			config:   conf,
+			children: []networkInterface{},
+		}}); err != nil {
+			return nil, err
+		}
+	}
+	lower := func(ids []string) []string {
+		interfaces := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if name, ok := names[id]; ok {
+				id = name
+			}
+			interfaces = append(interfaces, id)
+		}
+		return interfaces
+	}
+
+	for _, name := range sortedBonds {
+		b := cfg.Bonds[name]
+		if len(b.Interfaces) == 0 {
+			return nil, fmt.Errorf("bond %q requires interfaces", name)
+		}
+		conf, err := b.Addressing.configMethod()
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %v", name, err)
+		}
+		options := make(map[string][]string)
+		for p, v := range b.Parameters {
+			k, ok := netplanV2BondParameters[p]
+			if !ok {
+				log.Printf("Ignoring parameter %q of bond %q\n", p, name)
+				continue
+			}
+			switch v := v.(type) {
+			case bool:
+				options[k] = []string{map[bool]string{false: "0", true: "1"}[v]}
+			default:
+				options[k] = stringList(v)
+			}
+		}
+		bondOptions, err := parseBondOptions(options)
+		if err != nil {
+			return nil, fmt.Errorf("bond %q: %v", name, err)
+		}
+		var primary string
+		if v := options["bond-primary"]; len(v) > 0 {
+			primary = lower(v)[0]
+		}
+		if err := add(name, &bondInterface{
+			logicalInterface{name: name, mtu: b.Addressing.MTU, config: conf, children: []networkInterface{}},
+			lower(b.Interfaces),
+			bondOptions,
+			primary,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range sortedVLANs {
+		v := cfg.VLANs[name]
+		if v.Link == "" {
+			return nil, fmt.Errorf("VLAN %q requires a link", name)
+		}
+		conf, err := v.Addressing.configMethod()
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %v", name, err)
+		}
+		if err := add(name, &vlanInterface{
+			logicalInterface{name: name, mtu: v.Addressing.MTU, config: conf, children: []networkInterface{}},
+			v.ID,
+			lower([]string{v.Link})[0],
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range sortedBridges {
+		b := cfg.Bridges[name]
+		conf, err := b.Addressing.configMethod()
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %v", name, err)
+		}
+		options := make(map[string][]string)
+		for k, p := range map[string]string{
+			"bridge_stp":        "stp",
+			"bridge_fd":         "forward-delay",
+			"bridge_hello":      "hello-time",
+			"bridge_maxage":     "max-age",
+			"bridge_ageing":     "ageing-time",
+			"bridge_bridgeprio": "priority",
+		} {
+			if v, ok := b.Parameters[p]; ok {
+				options[k] = []string{fmt.Sprint(v)}
+			}
+		}
+		bridgeOptions, err := parseBridgeOptions(options)
+		if err != nil {
+			return nil, fmt.Errorf("bridge %q: %v", name, err)
+		}
+		if err := add(name, &bridgeInterface{
+			logicalInterface{name: name, mtu: b.Addressing.MTU, config: conf, children: []networkInterface{}},
+			lower(b.Interfaces),
+			bridgeOptions,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return interfaceMap, nil
+}
+
+// configMethod returns the addressing of an interface of a version 2 config.
+func (a netplanV2Addressing) configMethod() (configMethod, error) {
+	var hwaddr net.HardwareAddr
+	if a.MACAddress != "" {
+		var err error
+		if hwaddr, err = net.ParseMAC(a.MACAddress); err != nil {
+			return nil, err
+		}
+	}
+	addressing := netplanAddressing{
+		dhcp4:       a.DHCP4,
+		dhcp6:       a.DHCP6,
+		nameservers: a.Nameservers.Addresses,
+	}
+	for _, address := range a.Addresses {
+		ip, ipnet, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %q as an address with a prefix length", address)
+		}
+		addressing.addresses = append(addressing.addresses, net.IPNet{IP: ip, Mask: ipnet.Mask})
+	}
+	for _, gateway := range []string{a.Gateway4, a.Gateway6} {
+		if gateway != "" {
+			addressing.gateways = append(addressing.gateways, gateway)
+		}
+	}
+	for _, r := range a.Routes {
+		to := r.To
+		if to == "default" {
+			to = "0.0.0.0/0"
+			if strings.Contains(r.Via, ":") {
+				to = "::/0"
+			}
+		}
+		_, destination, err := net.ParseCIDR(to)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %q as route destination", r.To)
+		}
+		gateway := net.ParseIP(r.Via)
+		if gateway == nil {
+			return nil, fmt.Errorf("could not parse %q as route gateway", r.Via)
+		}
+		addressing.routes = append(addressing.routes, route{destination: *destination, gateway: gateway})
+	}
+	return addressing.configMethod(hwaddr)
+}
+
+// netplanAddressing collects the addressing of an interface.
+type netplanAddressing struct {
+	dhcp4       bool
+	dhcp6       bool
+	addresses   []net.IPNet
+	gateways    []string
+	routes      []route
+	nameservers []string
+}
+
+// configMethod returns DHCP, static or manual addressing. Nameservers are
+// ignored under DHCP alone, as networkd uses those it is given by the DHCP
+// server. Static addresses may be combined with DHCP, of either family.
+func (a netplanAddressing) configMethod(hwaddr net.HardwareAddr) (configMethod, error) {
+	var family string
+	switch {
+	case a.dhcp4 && a.dhcp6:
+		family = "true"
+	case a.dhcp4:
+		family = "ipv4"
+	case a.dhcp6:
+		family = "ipv6"
+	}
+	static := len(a.addresses) > 0 || len(a.routes) > 0 || len(a.gateways) > 0 || len(a.nameservers) > 0
+	switch {
+	case family != "" && !static:
+		return configMethodDHCP{hwaddress: hwaddr, family: family}, nil
+	case !static:
+		return configMethodManual{}, nil
+	}
+
+	conf := configMethodStatic{
+		addresses:   a.addresses,
+		nameservers: make([]net.IP, 0, len(a.nameservers)),
+		routes:      make([]route, 0, len(a.gateways)+len(a.routes)),
+		hwaddress:   hwaddr,
+		dhcp:        family,
+	}
+	if conf.addresses == nil {
+		conf.addresses = make([]net.IPNet, 0)
+	}
+	for _, g := range a.gateways {
+		gateway := net.ParseIP(g)
+		if gateway == nil {
+			return nil, fmt.Errorf("could not parse %q as gateway", g)
+		}
+		destination := net.IPNet{IP: net.IPv4zero, Mask: net.IPMask(net.IPv4zero)}
+		if gateway.To4() == nil {
+			destination = net.IPNet{IP: net.IPv6zero, Mask: net.IPMask(net.IPv6zero)}
+		}
+		conf.routes = append(conf.routes, route{destination: destination, gateway: gateway})
+	}
+	conf.routes = append(conf.routes, a.routes...)
+	for _, ns := range a.nameservers {
+		ip := net.ParseIP(ns)
+		if ip == nil {
+			return nil, fmt.Errorf("could not parse %q as nameserver IP address", ns)
+		}
+		conf.nameservers = append(conf.nameservers, ip)
+	}
+	return conf, nil
+}
+
+// logicalInterfaceOf returns the logical interface underlying the given one.
+func logicalInterfaceOf(iface networkInterface) *logicalInterface {
+	switch i := iface.(type) {
+	case *physicalInterface:
+		return &i.logicalInterface
+	case *bondInterface:
+		return &i.logicalInterface
+	case *vlanInterface:
+		return &i.logicalInterface
+	case *bridgeInterface:
+		return &i.logicalInterface
+	}
+	return &logicalInterface{}
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// stringList returns the given YAML value, either a scalar or a list, as a
+// list of strings.
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, s := range v {
+			list = append(list, fmt.Sprint(s))
+		}
+		return list
+	}
+	return []string{fmt.Sprint(value)}
+}
@@ -0,0 +1,295 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/coreos-cloudinit/config"
+)
+
+func TestProcessNetplanNetconf(t *testing.T) {
+	type file struct {
+		name    string
+		netdev  string
+		network string
+	}
+
+	for i, tt := range []struct {
+		in string
+
+		files []file
+		err   error
+	}{
+		{},
+		{
+			in:  "version: 3",
+			err: errors.New("unsupported network config version 3"),
+		},
+		{
+			in: `network:
+  version: 1
+  config:
+    - type: physical
+      name: eth0
+      mac_address: "52:54:00:12:34:56"
+      subnets:
+        - type: static
+          address: 10.0.0.2
+          netmask: 255.255.255.0
+          gateway: 10.0.0.1
+          dns_nameservers: [10.0.0.1]
+        - type: static6
+          address: fd00::2/64
+    - type: physical
+      name: eth1
+      subnets:
+        - type: dhcp
+    - type: nameserver
+      address: [10.0.0.1, 8.8.8.8]
+    - type: route
+      destination: 10.1.0.0/16
+      gateway: 10.0.0.254
+`,
+			files: []file{
+				{name: "eth0", network: "[Match]\nName=eth0\nMACAddress=52:54:00:12:34:56\n\n[Network]\nDNS=10.0.0.1\nDNS=8.8.8.8\n\n[Address]\nAddress=10.0.0.2/24\n\n[Address]\nAddress=fd00::2/64\n\n[Route]\nDestination=0.0.0.0/0\nGateway=10.0.0.1\n\n[Route]\nDestination=10.1.0.0/16\nGateway=10.0.0.254\n"},
+				{name: "eth1", network: "[Match]\nName=eth1\n\n[Network]\nDHCP=ipv4\n"},
+			},
+		},
+		{
+			in: `version: 1
+config:
+  - type: bond
+    name: bond0
+    bond_interfaces: [eth0, eth1]
+    params:
+      bond-mode: 802.3ad
+      bond-miimon: 100
+    subnets:
+      - type: dhcp4
+  - type: vlan
+    name: vlan10
+    vlan_link: bond0
+    vlan_id: 10
+`,
+			files: []file{
+				{name: "bond0", netdev: "[NetDev]\nKind=bond\nName=bond0\n\n[Bond]\nMIIMonitorSec=100ms\nMode=802.3ad\n", network: "[Match]\nName=bond0\n\n[Network]\nVLAN=vlan10\nDHCP=ipv4\n"},
+				{name: "eth0", network: "[Match]\nName=eth0\n\n[Network]\nBond=bond0\n"},
+				{name: "eth1", network: "[Match]\nName=eth1\n\n[Network]\nBond=bond0\n"},
+				{name: "vlan10", netdev: "[NetDev]\nKind=vlan\nName=vlan10\n\n[VLAN]\nId=10\n", network: "[Match]\nName=vlan10\n\n[Network]\n"},
+			},
+		},
+		{
+			in: `version: 1
+config:
+  - type: physical
+    name: eth0
+    subnets:
+      - type: static
+        address: 10.0.0.2/24
+      - type: dhcp6
+`,
+			files: []file{
+				{name: "eth0", network: "[Match]\nName=eth0\n\n[Network]\nDHCP=ipv6\n\n[Address]\nAddress=10.0.0.2/24\n"},
+			},
+		},
+		{
+			in: `version: 2
+ethernets:
+  eth0:
+    addresses: [10.0.0.2/24]
+    dhcp6: true
+  eth1:
+    dhcp6: true
+  eth2:
+    dhcp4: true
+    dhcp6: true
+`,
+			files: []file{
+				{name: "eth0", network: "[Match]\nName=eth0\n\n[Network]\nDHCP=ipv6\n\n[Address]\nAddress=10.0.0.2/24\n"},
+				{name: "eth1", network: "[Match]\nName=eth1\n\n[Network]\nDHCP=ipv6\n"},
+				{name: "eth2", network: "[Match]\nName=eth2\n\n[Network]\nDHCP=true\n"},
+			},
+		},
+		{
+			in: `version: 1
+config:
+  - type: physical
+    name: eth0
+  - type: route
+    destination: 10.1.0.0/16
+    gateway: 10.0.0.254
+`,
+			err: errors.New("no interface with a static address can reach gateway 10.0.0.254"),
+		},
+		{
+			in: `network:
+  version: 2
+  ethernets:
+    lan:
+      match:
+        macaddress: "52:54:00:12:34:56"
+      dhcp4: true
+    eno1:
+      addresses: [10.0.0.2/24]
+      gateway4: 10.0.0.1
+      nameservers:
+        addresses: [8.8.8.8]
+      routes:
+        - to: 10.1.0.0/16
+          via: 10.0.0.254
+`,
+			files: []file{
+				{network: "[Match]\nMACAddress=52:54:00:12:34:56\n\n[Network]\nDHCP=ipv4\n"},
+				{name: "eno1", network: "[Match]\nName=eno1\n\n[Network]\nDNS=8.8.8.8\n\n[Address]\nAddress=10.0.0.2/24\n\n[Route]\nDestination=0.0.0.0/0\nGateway=10.0.0.1\n\n[Route]\nDestination=10.1.0.0/16\nGateway=10.0.0.254\n"},
+			},
+		},
+		{
+			in: `network:
+  version: 2
+  ethernets:
+    port0:
+      match:
+        name: enp1s0
+    port1:
+      match:
+        name: enp2s0
+  bonds:
+    bond0:
+      interfaces: [port0, port1]
+      parameters:
+        mode: active-backup
+        mii-monitor-interval: 100
+  bridges:
+    br0:
+      interfaces: [bond0]
+      dhcp4: true
+`,
+			files: []file{
+				{name: "bond0", netdev: "[NetDev]\nKind=bond\nName=bond0\n\n[Bond]\nMIIMonitorSec=100ms\nMode=active-backup\n", network: "[Match]\nName=bond0\n\n[Network]\nBridge=br0\n"},
+				{name: "br0", netdev: "[NetDev]\nKind=bridge\nName=br0\n", network: "[Match]\nName=br0\n\n[Network]\nDHCP=ipv4\n"},
+				{name: "enp1s0", network: "[Match]\nName=enp1s0\n\n[Network]\nBond=bond0\n"},
+				{name: "enp2s0", network: "[Match]\nName=enp2s0\n\n[Network]\nBond=bond0\n"},
+			},
+		},
+		{
+			in: `version: 2
+vlans:
+  vlan10:
+    id: 10
+`,
+			err: errors.New(`VLAN "vlan10" requires a link`),
+		},
+	} {
+		interfaces, err := ProcessNetplanNetconf([]byte(tt.in))
+		if !reflect.DeepEqual(tt.err, err) {
+			t.Errorf("bad error (%d): want %v, got %v", i, tt.err, err)
+			continue
+		}
+
+		var files []file
+		for _, iface := range interfaces {
+			files = append(files, file{name: iface.Name(), netdev: iface.Netdev(), network: iface.Network()})
+		}
+		if !reflect.DeepEqual(tt.files, files) {
+			t.Errorf("bad files (%d): want %#v, got %#v", i, tt.files, files)
+		}
+	}
+}
+
+func TestNetplanLinks(t *testing.T) {
+	for i, tt := range []struct {
+		in string
+
+		link    string
+		network string
+	}{
+		{
+			in:      "version: 1\nconfig:\n  - type: physical\n    name: lan0\n    mac_address: \"52:54:00:12:34:56\"\n    mtu: 9000\n",
+			link:    "[Match]\nMACAddress=52:54:00:12:34:56\n\n[Link]\nName=lan0\nMTUBytes=9000\n",
+			network: "[Match]\nName=lan0\nMACAddress=52:54:00:12:34:56\n\n[Link]\nMTUBytes=9000\n\n[Network]\n",
+		},
+		{
+			in:      "version: 2\nethernets:\n  lan:\n    match:\n      macaddress: \"52:54:00:12:34:56\"\n    set-name: lan0\n    mtu: 1400\n    dhcp4: true\n",
+			link:    "[Match]\nMACAddress=52:54:00:12:34:56\n\n[Link]\nName=lan0\nMTUBytes=1400\n",
+			network: "[Match]\nName=lan0\nMACAddress=52:54:00:12:34:56\n\n[Link]\nMTUBytes=1400\n\n[Network]\nDHCP=ipv4\n",
+		},
+		{
+			in:      "version: 2\nethernets:\n  eth0:\n    macaddress: \"52:54:00:12:34:56\"\n    dhcp4: true\n",
+			network: "[Match]\nName=eth0\n\n[Link]\nMACAddress=52:54:00:12:34:56\n\n[Network]\nDHCP=ipv4\n",
+		},
+	} {
+		interfaces, err := ProcessNetplanNetconf([]byte(tt.in))
+		if err != nil {
+			t.Errorf("bad error (%d): want nil, got %v", i, err)
+			continue
+		}
+		if link := interfaces[0].Link(); link != tt.link {
+			t.Errorf("bad link (%d): want %q, got %q", i, tt.link, link)
+		}
+		if network := interfaces[0].Network(); network != tt.network {
+			t.Errorf("bad network (%d): want %q, got %q", i, tt.network, network)
+		}
+	}
+}
+
+func TestNetplanAfterCloudConfig(t *testing.T) {
+	// Parsing a cloud-config must not change how the keys of the network
+	// config are read.
+	if _, err := config.NewCloudConfig("#cloud-config\nmanage-etc-hosts: localhost\n"); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	interfaces, err := ProcessNetplanNetconf([]byte("version: 2\nethernets:\n  lan-0:\n    match:\n      macaddress: \"52:54:00:12:34:56\"\n    set-name: lan-0\n    dhcp4: true\n"))
+	if err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	if name := interfaces[0].Name(); name != "lan-0" {
+		t.Errorf("bad name: want %q, got %q", "lan-0", name)
+	}
+}
+
+func TestNetplanBondOptions(t *testing.T) {
+	for i, tt := range []struct {
+		in string
+
+		netdev  string
+		network string
+	}{
+		{
+			in:      "version: 1\nconfig:\n  - type: bond\n    name: bond0\n    bond_interfaces: [eth0]\n    params:\n      bond-mode: 802.3ad\n      bond-miimon: 100\n      bond-lacp-rate: fast\n      bond-primary: eth0\n",
+			netdev:  "[NetDev]\nKind=bond\nName=bond0\n\n[Bond]\nLACPTransmitRate=fast\nMIIMonitorSec=100ms\nMode=802.3ad\n",
+			network: "[Match]\nName=eth0\n\n[Network]\nBond=bond0\nPrimarySlave=true\n",
+		},
+		{
+			in:      "version: 2\nethernets:\n  port0:\n    match:\n      name: eth0\nbonds:\n  bond0:\n    interfaces: [port0]\n    parameters:\n      mode: active-backup\n      mii-monitor-interval: 100\n      all-slaves-active: true\n      arp-ip-targets: [10.0.0.1, 10.0.0.2]\n      primary: port0\n",
+			netdev:  "[NetDev]\nKind=bond\nName=bond0\n\n[Bond]\nARPIPTargets=10.0.0.1 10.0.0.2\nAllSlavesActive=yes\nMIIMonitorSec=100ms\nMode=active-backup\n",
+			network: "[Match]\nName=eth0\n\n[Network]\nBond=bond0\nPrimarySlave=true\n",
+		},
+	} {
+		interfaces, err := ProcessNetplanNetconf([]byte(tt.in))
+		if err != nil {
+			t.Errorf("bad error (%d): want nil, got %v", i, err)
+			continue
+		}
+		if netdev := interfaces[0].Netdev(); netdev != tt.netdev {
+			t.Errorf("bad netdev (%d): want %q, got %q", i, tt.netdev, netdev)
+		}
+		if network := interfaces[1].Network(); network != tt.network {
+			t.Errorf("bad network (%d): want %q, got %q", i, tt.network, network)
+		}
+	}
+}
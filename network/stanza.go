@@ -17,6 +17,7 @@ package network
 import (
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -41,6 +42,7 @@ const (
 	interfaceBond = interfaceKind(iota)
 	interfacePhysical
 	interfaceVLAN
+	interfaceBridge
 )
 
 type route struct {
@@ -53,8 +55,14 @@ type configMethod interface{}
 type configMethodStatic struct {
 	addresses   []net.IPNet
 	nameservers []net.IP
+	domains     []string
 	routes      []route
 	hwaddress   net.HardwareAddr
+	// dhcp is the address family ("ipv4", "ipv6" or "true" for both)
+	// which is configured by DHCP alongside the static addresses, if any.
+	dhcp string
+	// acceptRA is whether IPv6 router advertisements are accepted, if set.
+	acceptRA string
 }
 
 type configMethodLoopback struct{}
@@ -63,6 +71,11 @@ type configMethodManual struct{}
 
 type configMethodDHCP struct {
 	hwaddress net.HardwareAddr
+	domains   []string
+	// family is "ipv4" or "ipv6" when DHCP is limited to a single address
+	// family. It is empty for inet stanzas, which have always enabled both.
+	family   string
+	acceptRA string
 }
 
 func parseStanzas(lines []string) (stanzas []stanza, err error) {
@@ -173,39 +186,40 @@ func parseInterfaceStanza(attributes []string, options []string) (*stanzaInterfa
 	}
 
 	iface := attributes[0]
+	family := attributes[1]
 	confMethod := attributes[2]
 
+	if family != "inet" && family != "inet6" {
+		return nil, fmt.Errorf("invalid address family %q", family)
+	}
+
 	optionMap := make(map[string][]string, 0)
 	for _, option := range options {
-		if strings.HasPrefix(option, "post-up") {
-			tokens := strings.SplitAfterN(option, " ", 2)
-			if len(tokens) != 2 {
-				continue
+		tokens := strings.Fields(option)
+		switch tokens[0] {
+		case "up", "post-up", "down", "pre-down":
+			// up and down are aliases of post-up and pre-down.
+			name := "post-up"
+			if tokens[0] == "down" || tokens[0] == "pre-down" {
+				name = "pre-down"
 			}
-			if v, ok := optionMap["post-up"]; ok {
-				optionMap["post-up"] = append(v, tokens[1])
-			} else {
-				optionMap["post-up"] = []string{tokens[1]}
-			}
-		} else if strings.HasPrefix(option, "pre-down") {
 			tokens := strings.SplitAfterN(option, " ", 2)
 			if len(tokens) != 2 {
 				continue
 			}
-			if v, ok := optionMap["pre-down"]; ok {
-				optionMap["pre-down"] = append(v, tokens[1])
+			if v, ok := optionMap[name]; ok {
+				optionMap[name] = append(v, tokens[1])
 			} else {
-				optionMap["pre-down"] = []string{tokens[1]}
+				optionMap[name] = []string{tokens[1]}
 			}
-		} else {
-			tokens := strings.Fields(option)
+		default:
 			optionMap[tokens[0]] = tokens[1:]
 		}
 	}
 
 	var conf configMethod
-	switch confMethod {
-	case "static":
+	switch {
+	case confMethod == "static":
 		config := configMethodStatic{
 			addresses:   make([]net.IPNet, 1),
 			routes:      make([]route, 0),
@@ -213,12 +227,16 @@ func parseInterfaceStanza(attributes []string, options []string) (*stanzaInterfa
 		}
 		if addresses, ok := optionMap["address"]; ok {
 			if len(addresses) == 1 {
-				config.addresses[0].IP = net.ParseIP(addresses[0])
+				if ip, ipnet, err := net.ParseCIDR(addresses[0]); err == nil {
+					config.addresses[0] = net.IPNet{IP: ip, Mask: ipnet.Mask}
+				} else {
+					config.addresses[0].IP = net.ParseIP(addresses[0])
+				}
 			}
 		}
 		if netmasks, ok := optionMap["netmask"]; ok {
 			if len(netmasks) == 1 {
-				config.addresses[0].Mask = net.IPMask(net.ParseIP(netmasks[0]).To4())
+				config.addresses[0].Mask = parseNetmask(netmasks[0], family)
 			}
 		}
 		if config.addresses[0].IP == nil || config.addresses[0].Mask == nil {
@@ -226,12 +244,13 @@ func parseInterfaceStanza(attributes []string, options []string) (*stanzaInterfa
 		}
 		if gateways, ok := optionMap["gateway"]; ok {
 			if len(gateways) == 1 {
+				gateway := net.ParseIP(gateways[0])
+				if gateway == nil {
+					return nil, fmt.Errorf("malformed gateway option for %q", iface)
+				}
 				config.routes = append(config.routes, route{
-					destination: net.IPNet{
-						IP:   net.IPv4(0, 0, 0, 0),
-						Mask: net.IPv4Mask(0, 0, 0, 0),
-					},
-					gateway: net.ParseIP(gateways[0]),
+					destination: defaultDestination(gateway.To4() == nil),
+					gateway:     gateway,
 				})
 			}
 		}
@@ -243,46 +262,66 @@ func parseInterfaceStanza(attributes []string, options []string) (*stanzaInterfa
 		for _, nameserver := range optionMap["dns-nameservers"] {
 			config.nameservers = append(config.nameservers, net.ParseIP(nameserver))
 		}
+		config.domains = optionMap["dns-search"]
 		for _, postup := range optionMap["post-up"] {
-			if strings.HasPrefix(postup, "route add") {
-				route := route{}
-				fields := strings.Fields(postup)
-				for i, field := range fields[:len(fields)-1] {
-					switch field {
-					case "-net":
-						if _, dst, err := net.ParseCIDR(fields[i+1]); err == nil {
-							route.destination = *dst
-						} else {
-							route.destination.IP = net.ParseIP(fields[i+1])
-						}
-					case "netmask":
-						route.destination.Mask = net.IPMask(net.ParseIP(fields[i+1]).To4())
-					case "gw":
-						route.gateway = net.ParseIP(fields[i+1])
-					}
-				}
-				if route.destination.IP != nil && route.destination.Mask != nil && route.gateway != nil {
-					config.routes = append(config.routes, route)
-				}
+			if route, ok := parseRouteCommand(postup); ok {
+				config.routes = append(config.routes, route)
 			}
 		}
+		if family == "inet6" {
+			if acceptRA, err := parseAcceptRA(optionMap, iface); err == nil {
+				config.acceptRA = acceptRA
+			} else {
+				return nil, err
+			}
+		}
+		conf = config
+	case confMethod == "auto" && family == "inet6":
+		// SLAAC, optionally along with stateless DHCPv6.
+		config := configMethodStatic{
+			addresses:   make([]net.IPNet, 0),
+			routes:      make([]route, 0),
+			nameservers: make([]net.IP, 0),
+			domains:     optionMap["dns-search"],
+			acceptRA:    "true",
+		}
+		if dhcp := optionMap["dhcp"]; len(dhcp) == 1 && dhcp[0] == "1" {
+			config.dhcp = "ipv6"
+		}
+		if hwaddress, err := parseHwaddress(optionMap, iface); err == nil {
+			config.hwaddress = hwaddress
+		} else {
+			return nil, err
+		}
 		conf = config
-	case "loopback":
+	case confMethod == "loopback":
 		conf = configMethodLoopback{}
-	case "manual":
+	case confMethod == "manual":
 		conf = configMethodManual{}
-	case "dhcp":
-		config := configMethodDHCP{}
+	case confMethod == "dhcp":
+		config := configMethodDHCP{domains: optionMap["dns-search"]}
 		if hwaddress, err := parseHwaddress(optionMap, iface); err == nil {
 			config.hwaddress = hwaddress
 		} else {
 			return nil, err
 		}
+		if family == "inet6" {
+			config.family = "ipv6"
+			if acceptRA, err := parseAcceptRA(optionMap, iface); err == nil {
+				config.acceptRA = acceptRA
+			} else {
+				return nil, err
+			}
+		}
 		conf = config
 	default:
 		return nil, fmt.Errorf("invalid config method %q", confMethod)
 	}
 
+	if _, err := parseMTU(optionMap, iface); err != nil {
+		return nil, err
+	}
+
 	if _, ok := optionMap["vlan_raw_device"]; ok {
 		return parseVLANStanza(iface, conf, attributes, optionMap)
 	}
@@ -291,6 +330,10 @@ func parseInterfaceStanza(attributes []string, options []string) (*stanzaInterfa
 		return parseVLANStanza(iface, conf, attributes, optionMap)
 	}
 
+	if _, ok := optionMap["bridge_ports"]; ok {
+		return parseBridgeStanza(iface, conf, attributes, optionMap)
+	}
+
 	if _, ok := optionMap["bond-slaves"]; ok {
 		return parseBondStanza(iface, conf, attributes, optionMap)
 	}
@@ -298,6 +341,254 @@ func parseInterfaceStanza(attributes []string, options []string) (*stanzaInterfa
 	return parsePhysicalStanza(iface, conf, attributes, optionMap)
 }
 
+// mergeInterfaceStanzas merges stanza b, which configures the same interface
+// as stanza a (typically for the other address family), into a.
+func mergeInterfaceStanzas(a, b *stanzaInterface) {
+	a.auto = a.auto || b.auto
+	if a.kind == interfacePhysical {
+		a.kind = b.kind
+	}
+	a.configMethod = mergeConfigMethods(a.configMethod, b.configMethod)
+	for name, values := range b.options {
+		switch _, ok := a.options[name]; {
+		case name == "post-up" || name == "pre-down":
+			a.options[name] = append(a.options[name], values...)
+		case !ok:
+			a.options[name] = values
+		}
+	}
+}
+
+func mergeConfigMethods(a, b configMethod) configMethod {
+	switch a.(type) {
+	case configMethodManual, configMethodLoopback:
+		return b
+	}
+	switch b.(type) {
+	case configMethodManual, configMethodLoopback:
+		return a
+	}
+
+	if a, ok := a.(configMethodDHCP); ok {
+		if b, ok := b.(configMethodDHCP); ok {
+			if a.family != b.family {
+				a.family = ""
+			}
+			if a.hwaddress == nil {
+				a.hwaddress = b.hwaddress
+			}
+			if b.acceptRA != "" {
+				a.acceptRA = b.acceptRA
+			}
+			a.domains = append(a.domains, b.domains...)
+			return a
+		}
+	}
+
+	static := asStatic(a)
+	other := asStatic(b)
+	switch {
+	case static.dhcp == "":
+		static.dhcp = other.dhcp
+	case other.dhcp != "" && other.dhcp != static.dhcp:
+		static.dhcp = "true"
+	}
+	if static.hwaddress == nil {
+		static.hwaddress = other.hwaddress
+	}
+	if other.acceptRA != "" {
+		static.acceptRA = other.acceptRA
+	}
+	static.addresses = append(static.addresses, other.addresses...)
+	static.nameservers = append(static.nameservers, other.nameservers...)
+	static.domains = append(static.domains, other.domains...)
+	static.routes = append(static.routes, other.routes...)
+	return static
+}
+
+// asStatic returns the given DHCP or static config method as a static one.
+func asStatic(c configMethod) configMethodStatic {
+	switch c := c.(type) {
+	case configMethodStatic:
+		return c
+	case configMethodDHCP:
+		dhcp := c.family
+		if dhcp == "" {
+			dhcp = "true"
+		}
+		return configMethodStatic{
+			addresses:   make([]net.IPNet, 0),
+			nameservers: make([]net.IP, 0),
+			domains:     c.domains,
+			routes:      make([]route, 0),
+			hwaddress:   c.hwaddress,
+			dhcp:        dhcp,
+			acceptRA:    c.acceptRA,
+		}
+	}
+	return configMethodStatic{}
+}
+
+// parseNetmask parses a netmask given either as a prefix length or, for the
+// inet family, in dotted-quad notation.
+func parseNetmask(netmask string, family string) net.IPMask {
+	bits := 32
+	if family == "inet6" {
+		bits = 128
+	}
+	if n, err := strconv.Atoi(netmask); err == nil {
+		return net.CIDRMask(n, bits)
+	}
+	if family == "inet" {
+		if ip := net.ParseIP(netmask).To4(); ip != nil {
+			return net.IPMask(ip)
+		}
+	}
+	return nil
+}
+
+// defaultDestination returns the destination of a default route.
+func defaultDestination(ipv6 bool) net.IPNet {
+	if ipv6 {
+		return net.IPNet{IP: net.IPv6zero, Mask: net.IPMask(net.IPv6zero)}
+	}
+	return net.IPNet{IP: net.IPv4(0, 0, 0, 0), Mask: net.IPv4Mask(0, 0, 0, 0)}
+}
+
+// parseRouteCommand parses a static route out of a "route add" or "ip route
+// add" command. Anything following a shell operator (e.g. "|| true") is
+// ignored.
+func parseRouteCommand(command string) (route, bool) {
+	fields := strings.Fields(command)
+	for i, field := range fields {
+		if field == "||" || field == "&&" || field == ";" {
+			fields = fields[:i]
+			break
+		}
+	}
+	if len(fields) < 2 {
+		return route{}, false
+	}
+
+	var destination, netmask, gateway string
+	var ipv6, host bool
+	value := func(i int) string {
+		if i+1 < len(fields) {
+			return fields[i+1]
+		}
+		return ""
+	}
+	switch fields[0] {
+	case "route":
+		add := false
+		for i := 1; i < len(fields); i++ {
+			switch field := fields[i]; {
+			case field == "-6":
+				ipv6 = true
+			case field == "-A":
+				ipv6 = value(i) == "inet6"
+				i++
+			case field == "add":
+				add = true
+			case field == "-net" || field == "-host":
+				host = field == "-host"
+				destination = value(i)
+				i++
+			case field == "netmask":
+				netmask = value(i)
+				i++
+			case field == "gw":
+				gateway = value(i)
+				i++
+			case field == "dev" || field == "metric" || field == "mss" || field == "window" || field == "irtt":
+				i++
+			case add && destination == "" && !strings.HasPrefix(field, "-"):
+				destination = field
+			}
+		}
+		if !add {
+			return route{}, false
+		}
+	case "ip":
+		add := false
+		for i := 1; i < len(fields); i++ {
+			switch field := fields[i]; {
+			case field == "-6":
+				ipv6 = true
+			case field == "-f" || field == "-family":
+				ipv6 = value(i) == "inet6"
+				i++
+			case field == "route" || field == "r" || field == "-4":
+			case field == "add" || field == "replace":
+				add = true
+			case field == "via":
+				gateway = value(i)
+				i++
+			case field == "dev" || field == "metric" || field == "proto" || field == "src" ||
+				field == "table" || field == "mtu" || field == "scope":
+				i++
+			case add && destination == "":
+				destination = field
+				host = !strings.Contains(field, "/")
+			}
+		}
+		if !add {
+			return route{}, false
+		}
+	default:
+		return route{}, false
+	}
+
+	r := route{gateway: net.ParseIP(gateway)}
+	if r.gateway == nil {
+		return route{}, false
+	}
+	ipv6 = ipv6 || r.gateway.To4() == nil
+	family, bits := "inet", 32
+	if ipv6 {
+		family, bits = "inet6", 128
+	}
+	switch {
+	case destination == "default":
+		r.destination = defaultDestination(ipv6)
+	case strings.Contains(destination, "/"):
+		_, dst, err := net.ParseCIDR(destination)
+		if err != nil {
+			return route{}, false
+		}
+		r.destination = *dst
+	default:
+		r.destination.IP = net.ParseIP(destination)
+		if host {
+			r.destination.Mask = net.CIDRMask(bits, bits)
+		} else if netmask != "" {
+			r.destination.Mask = parseNetmask(netmask, family)
+		}
+	}
+	if r.destination.IP == nil || r.destination.Mask == nil {
+		return route{}, false
+	}
+	return r, true
+}
+
+// parseAcceptRA maps the accept_ra option of inet6 stanzas onto the
+// IPv6AcceptRA option of a network file.
+func parseAcceptRA(options map[string][]string, iface string) (string, error) {
+	acceptRA, ok := options["accept_ra"]
+	if !ok {
+		return "", nil
+	}
+	if len(acceptRA) == 1 {
+		switch acceptRA[0] {
+		case "0":
+			return "false", nil
+		case "1", "2":
+			return "true", nil
+		}
+	}
+	return "", fmt.Errorf("malformed accept_ra option for %q", iface)
+}
+
 func parseHwaddress(options map[string][]string, iface string) (net.HardwareAddr, error) {
 	if hwaddress, ok := options["hwaddress"]; ok && len(hwaddress) == 2 {
 		switch hwaddress[0] {
@@ -311,10 +602,177 @@ func parseHwaddress(options map[string][]string, iface string) (net.HardwareAddr
 	return nil, nil
 }
 
+func parseMTU(options map[string][]string, iface string) (int, error) {
+	mtu, ok := options["mtu"]
+	if !ok {
+		return 0, nil
+	}
+	if len(mtu) == 1 {
+		if n, err := strconv.Atoi(mtu[0]); err == nil && n > 0 {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("malformed mtu option for %q", iface)
+}
+
 func parseBondStanza(iface string, conf configMethod, attributes []string, options map[string][]string) (*stanzaInterface, error) {
+	if _, err := parseBondOptions(options); err != nil {
+		return nil, fmt.Errorf("malformed bond options for %q: %v", iface, err)
+	}
 	return &stanzaInterface{name: iface, kind: interfaceBond, configMethod: conf, options: options}, nil
 }
 
+func parseBridgeStanza(iface string, conf configMethod, attributes []string, options map[string][]string) (*stanzaInterface, error) {
+	switch ports := options["bridge_ports"]; {
+	case len(ports) == 1 && ports[0] == "none":
+		options["bridge_ports"] = []string{}
+	case len(ports) == 1 && ports[0] == "all":
+		return nil, fmt.Errorf("unsupported bridge_ports %q for %q", ports[0], iface)
+	}
+	if _, err := parseBridgeOptions(options); err != nil {
+		return nil, fmt.Errorf("malformed bridge options for %q: %v", iface, err)
+	}
+	return &stanzaInterface{name: iface, kind: interfaceBridge, configMethod: conf, options: options}, nil
+}
+
+// bondOption describes how a Debian bond option maps onto an option of the
+// [Bond] section of a netdev file.
+type bondOption struct {
+	key string
+	// values lists the valid values of the option, in the order of their
+	// numeric forms. Options without values take a number.
+	values []string
+	// unit is appended to the number (e.g. to turn milliseconds into a
+	// time span).
+	unit string
+}
+
+var bondOptions = map[string]bondOption{
+	"bond-mode":              {key: "Mode", values: []string{"balance-rr", "active-backup", "balance-xor", "broadcast", "802.3ad", "balance-tlb", "balance-alb"}},
+	"bond-xmit-hash-policy":  {key: "TransmitHashPolicy", values: []string{"layer2", "layer3+4", "layer2+3", "encap2+3", "encap3+4"}},
+	"bond-lacp-rate":         {key: "LACPTransmitRate", values: []string{"slow", "fast"}},
+	"bond-ad-select":         {key: "AdSelect", values: []string{"stable", "bandwidth", "count"}},
+	"bond-fail-over-mac":     {key: "FailOverMACPolicy", values: []string{"none", "active", "follow"}},
+	"bond-arp-validate":      {key: "ARPValidate", values: []string{"none", "active", "backup", "all"}},
+	"bond-arp-all-targets":   {key: "ARPAllTargets", values: []string{"any", "all"}},
+	"bond-primary-reselect":  {key: "PrimaryReselectPolicy", values: []string{"always", "better", "failure"}},
+	"bond-all-slaves-active": {key: "AllSlavesActive", values: []string{"no", "yes"}},
+	"bond-miimon":            {key: "MIIMonitorSec", unit: "ms"},
+	"bond-updelay":           {key: "UpDelaySec", unit: "ms"},
+	"bond-downdelay":         {key: "DownDelaySec", unit: "ms"},
+	"bond-arp-interval":      {key: "ARPIntervalSec", unit: "ms"},
+	"bond-lp-interval":       {key: "LearnPacketIntervalSec"},
+	"bond-num-grat-arp":      {key: "GratuitousARP"},
+	"bond-resend-igmp":       {key: "ResendIGMP"},
+	"bond-min-links":         {key: "MinLinks"},
+	"bond-packets-per-slave": {key: "PacketsPerSlave"},
+}
+
+// parseBondOptions maps the Debian bond options onto the options of the [Bond]
+// section of a netdev file. The primary slave (bond-primary) is set in the
+// slave's network file instead.
+func parseBondOptions(options map[string][]string) (map[string]string, error) {
+	bond := make(map[string]string)
+	for _, name := range sortedOptions(options) {
+		values := options[name]
+		if name == "bond-arp-ip-target" {
+			targets := make([]string, 0, len(values))
+			for _, v := range values {
+				for _, target := range strings.Split(v, ",") {
+					if net.ParseIP(target) == nil {
+						return nil, fmt.Errorf("invalid value %q for %s", target, name)
+					}
+					targets = append(targets, target)
+				}
+			}
+			bond["ARPIPTargets"] = strings.Join(targets, " ")
+			continue
+		}
+
+		option, ok := bondOptions[name]
+		if !ok {
+			continue
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("%s requires a single value", name)
+		}
+		value := values[0]
+		if option.values == nil {
+			if n, err := strconv.Atoi(value); err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid value %q for %s", value, name)
+			}
+			bond[option.key] = value + option.unit
+			continue
+		}
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 && n < len(option.values) {
+			value = option.values[n]
+		}
+		valid := false
+		for _, v := range option.values {
+			valid = valid || v == value
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid value %q for %s", value, name)
+		}
+		bond[option.key] = value
+	}
+	return bond, nil
+}
+
+func sortedOptions(options map[string][]string) (keys []string) {
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// bridgeOptions maps the Debian bridge options onto the options of the
+// [Bridge] section of a netdev file.
+var bridgeOptions = map[string]string{
+	"bridge_fd":         "ForwardDelaySec",
+	"bridge_hello":      "HelloTimeSec",
+	"bridge_maxage":     "MaxAgeSec",
+	"bridge_ageing":     "AgeingTimeSec",
+	"bridge_bridgeprio": "Priority",
+	"bridge_stp":        "STP",
+}
+
+func parseBridgeOptions(options map[string][]string) (map[string]string, error) {
+	bridge := make(map[string]string)
+	for _, name := range []string{"bridge_fd", "bridge_hello", "bridge_maxage", "bridge_ageing", "bridge_bridgeprio", "bridge_stp"} {
+		values, ok := options[name]
+		if !ok {
+			continue
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("%s requires a single value", name)
+		}
+		value := values[0]
+		switch name {
+		case "bridge_stp":
+			switch value {
+			case "on", "yes", "true":
+				value = "yes"
+			case "off", "no", "false":
+				value = "no"
+			default:
+				return nil, fmt.Errorf("invalid value %q for %s", value, name)
+			}
+		case "bridge_bridgeprio":
+			if p, err := strconv.Atoi(value); err != nil || p < 0 || p > 65535 {
+				return nil, fmt.Errorf("invalid value %q for %s", value, name)
+			}
+		default:
+			if s, err := strconv.ParseFloat(value, 64); err != nil || s < 0 {
+				return nil, fmt.Errorf("invalid value %q for %s", value, name)
+			}
+		}
+		bridge[bridgeOptions[name]] = value
+	}
+	return bridge, nil
+}
+
 func parsePhysicalStanza(iface string, conf configMethod, attributes []string, options map[string][]string) (*stanzaInterface, error) {
 	return &stanzaInterface{name: iface, kind: interfacePhysical, configMethod: conf, options: options}, nil
 }
@@ -58,6 +58,12 @@ func TestBadParseInterfaceStanza(t *testing.T) {
 		{[]string{"eth", "inet", "static"}, []string{"address 192.168.1.100", "netmask invalid"}, "malformed static network config"},
 		{[]string{"eth", "inet", "static"}, []string{"address 192.168.1.100", "netmask 255.255.255.0", "hwaddress ether NotAnAddress"}, "malformed hwaddress option"},
 		{[]string{"eth", "inet", "dhcp"}, []string{"hwaddress ether NotAnAddress"}, "malformed hwaddress option"},
+		{[]string{"eth", "ipx", "static"}, nil, "invalid address family"},
+		{[]string{"eth", "inet", "auto"}, nil, "invalid config method"},
+		{[]string{"eth", "inet", "static"}, []string{"address 192.168.1.100", "netmask 255.255.255.0", "gateway invalid"}, "malformed gateway option"},
+		{[]string{"eth", "inet6", "static"}, []string{"address 2001:db8::2", "netmask 255.255.255.0"}, "malformed static network config"},
+		{[]string{"eth", "inet6", "static"}, []string{"address 2001:db8::2/64", "accept_ra 3"}, "malformed accept_ra option"},
+		{[]string{"eth", "inet6", "dhcp"}, []string{"accept_ra"}, "malformed accept_ra option"},
 	} {
 		_, err := parseInterfaceStanza(tt.in, tt.opts)
 		if err == nil || !strings.HasPrefix(err.Error(), tt.e) {
@@ -168,6 +174,164 @@ func TestParseBondStanza(t *testing.T) {
 	}
 }
 
+func TestParseBridgeStanza(t *testing.T) {
+	for _, tt := range []struct {
+		options map[string][]string
+
+		ports []string
+		err   bool
+	}{
+		{
+			options: map[string][]string{"bridge_ports": []string{"eth0", "bond0"}},
+			ports:   []string{"eth0", "bond0"},
+		},
+		{
+			options: map[string][]string{"bridge_ports": []string{"none"}},
+			ports:   []string{},
+		},
+		{
+			options: map[string][]string{"bridge_ports": []string{"all"}},
+			err:     true,
+		},
+		{
+			options: map[string][]string{"bridge_ports": []string{"eth0"}, "bridge_stp": []string{"on"}, "bridge_fd": []string{"0"}},
+			ports:   []string{"eth0"},
+		},
+		{
+			options: map[string][]string{"bridge_ports": []string{"eth0"}, "bridge_stp": []string{"maybe"}},
+			err:     true,
+		},
+		{
+			options: map[string][]string{"bridge_ports": []string{"eth0"}, "bridge_fd": []string{"-1"}},
+			err:     true,
+		},
+	} {
+		bridge, err := parseBridgeStanza("br0", configMethodManual{}, nil, tt.options)
+		if tt.err != (err != nil) {
+			t.Fatalf("bad error (%v): want %t, got %v", tt.options, tt.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if bridge.kind != interfaceBridge {
+			t.Fatalf("bad kind (%v): want %v, got %v", tt.options, interfaceBridge, bridge.kind)
+		}
+		if !reflect.DeepEqual(bridge.options["bridge_ports"], tt.ports) {
+			t.Fatalf("bad ports (%v): want %v, got %v", tt.options, tt.ports, bridge.options["bridge_ports"])
+		}
+	}
+}
+
+func TestParseInterfaceStanzaMTU(t *testing.T) {
+	for _, tt := range []struct {
+		option string
+
+		mtu int
+		err bool
+	}{
+		{option: "mtu 9000", mtu: 9000},
+		{option: "mtu 0", err: true},
+		{option: "mtu jumbo", err: true},
+	} {
+		iface, err := parseInterfaceStanza([]string{"eth0", "inet", "manual"}, []string{tt.option})
+		if tt.err != (err != nil) {
+			t.Fatalf("bad error (%q): want %t, got %v", tt.option, tt.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if mtu, _ := parseMTU(iface.options, iface.name); mtu != tt.mtu {
+			t.Fatalf("bad MTU (%q): want %d, got %d", tt.option, tt.mtu, mtu)
+		}
+	}
+}
+
+func TestParseBondOptions(t *testing.T) {
+	for _, tt := range []struct {
+		options map[string][]string
+
+		bond map[string]string
+		err  bool
+	}{
+		{
+			options: map[string][]string{"bond-slaves": []string{"eth0"}, "bond-primary": []string{"eth0"}},
+			bond:    map[string]string{},
+		},
+		{
+			options: map[string][]string{
+				"bond-mode":              []string{"4"},
+				"bond-miimon":            []string{"100"},
+				"bond-lacp-rate":         []string{"1"},
+				"bond-xmit-hash-policy":  []string{"layer3+4"},
+				"bond-updelay":           []string{"200"},
+				"bond-downdelay":         []string{"200"},
+				"bond-ad-select":         []string{"bandwidth"},
+				"bond-min-links":         []string{"1"},
+				"bond-all-slaves-active": []string{"0"},
+				"bond-arp-ip-target":     []string{"10.0.0.1,10.0.0.2", "10.0.0.3"},
+			},
+			bond: map[string]string{
+				"Mode":               "802.3ad",
+				"MIIMonitorSec":      "100ms",
+				"LACPTransmitRate":   "fast",
+				"TransmitHashPolicy": "layer3+4",
+				"UpDelaySec":         "200ms",
+				"DownDelaySec":       "200ms",
+				"AdSelect":           "bandwidth",
+				"MinLinks":           "1",
+				"AllSlavesActive":    "no",
+				"ARPIPTargets":       "10.0.0.1 10.0.0.2 10.0.0.3",
+			},
+		},
+		{
+			options: map[string][]string{"bond-mode": []string{"7"}},
+			err:     true,
+		},
+		{
+			options: map[string][]string{"bond-miimon": []string{"fast"}},
+			err:     true,
+		},
+		{
+			options: map[string][]string{"bond-arp-ip-target": []string{"10.0.0"}},
+			err:     true,
+		},
+	} {
+		bond, err := parseBondOptions(tt.options)
+		if tt.err != (err != nil) {
+			t.Fatalf("bad error (%v): want %t, got %v", tt.options, tt.err, err)
+		}
+		if err == nil && !reflect.DeepEqual(tt.bond, bond) {
+			t.Fatalf("bad options (%v): want %v, got %v", tt.options, tt.bond, bond)
+		}
+	}
+}
+
+func TestParseBridgeOptions(t *testing.T) {
+	options, err := parseBridgeOptions(map[string][]string{
+		"bridge_ports":      []string{"eth0"},
+		"bridge_stp":        []string{"off"},
+		"bridge_fd":         []string{"2.5"},
+		"bridge_hello":      []string{"2"},
+		"bridge_maxage":     []string{"20"},
+		"bridge_ageing":     []string{"300"},
+		"bridge_bridgeprio": []string{"32768"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expect := map[string]string{
+		"STP":             "no",
+		"ForwardDelaySec": "2.5",
+		"HelloTimeSec":    "2",
+		"MaxAgeSec":       "20",
+		"AgeingTimeSec":   "300",
+		"Priority":        "32768",
+	}
+	if !reflect.DeepEqual(options, expect) {
+		t.Fatalf("bad options: want %v, got %v", expect, options)
+	}
+}
+
 func TestParsePhysicalStanza(t *testing.T) {
 	conf := configMethodManual{}
 	options := map[string][]string{
@@ -353,6 +517,178 @@ func TestParseInterfaceStanzaStaticPostUp(t *testing.T) {
 	}
 }
 
+func TestParseInterfaceStanzaIPv6(t *testing.T) {
+	for i, tt := range []struct {
+		method  string
+		options []string
+		expect  configMethod
+	}{
+		{
+			method:  "static",
+			options: []string{"address 2001:db8::2", "netmask 64", "gateway fe80::1", "dns-nameservers 2001:db8::53", "dns-search example.com"},
+			expect: configMethodStatic{
+				addresses:   []net.IPNet{{IP: net.ParseIP("2001:db8::2"), Mask: net.CIDRMask(64, 128)}},
+				nameservers: []net.IP{net.ParseIP("2001:db8::53")},
+				domains:     []string{"example.com"},
+				routes: []route{
+					{destination: net.IPNet{IP: net.IPv6zero, Mask: net.IPMask(net.IPv6zero)}, gateway: net.ParseIP("fe80::1")},
+				},
+			},
+		},
+		{
+			method:  "static",
+			options: []string{"address 2001:db8::2/64", "accept_ra 0", "up ip -6 route add 2001:db8:1::/48 via 2001:db8::1"},
+			expect: configMethodStatic{
+				addresses:   []net.IPNet{{IP: net.ParseIP("2001:db8::2"), Mask: net.CIDRMask(64, 128)}},
+				nameservers: []net.IP{},
+				routes: []route{
+					{destination: net.IPNet{IP: net.ParseIP("2001:db8:1::"), Mask: net.CIDRMask(48, 128)}, gateway: net.ParseIP("2001:db8::1")},
+				},
+				acceptRA: "false",
+			},
+		},
+		{
+			method:  "auto",
+			options: []string{"dhcp 1"},
+			expect: configMethodStatic{
+				addresses:   []net.IPNet{},
+				nameservers: []net.IP{},
+				routes:      []route{},
+				dhcp:        "ipv6",
+				acceptRA:    "true",
+			},
+		},
+		{
+			method:  "dhcp",
+			options: []string{"accept_ra 2", "dns-search example.com example.org"},
+			expect: configMethodDHCP{
+				domains:  []string{"example.com", "example.org"},
+				family:   "ipv6",
+				acceptRA: "true",
+			},
+		},
+	} {
+		iface, err := parseInterfaceStanza([]string{"eth", "inet6", tt.method}, tt.options)
+		if err != nil {
+			t.Fatalf("bad error (%d): want nil, got %s", i, err)
+		}
+		if !reflect.DeepEqual(iface.configMethod, tt.expect) {
+			t.Fatalf("bad config method (%d): want %#v, got %#v", i, tt.expect, iface.configMethod)
+		}
+	}
+}
+
+func TestParseRouteCommand(t *testing.T) {
+	for _, tt := range []struct {
+		command string
+		expect  route
+		ok      bool
+	}{
+		{
+			command: "route add -net 10.176.0.0 netmask 255.240.0.0 gw 10.184.0.1 || true",
+			expect: route{
+				destination: net.IPNet{IP: net.IPv4(10, 176, 0, 0), Mask: net.IPv4Mask(255, 240, 0, 0)},
+				gateway:     net.IPv4(10, 184, 0, 1),
+			},
+			ok: true,
+		},
+		{
+			command: "route add -host 10.0.0.5 gw 10.0.0.1",
+			expect: route{
+				destination: net.IPNet{IP: net.IPv4(10, 0, 0, 5), Mask: net.CIDRMask(32, 32)},
+				gateway:     net.IPv4(10, 0, 0, 1),
+			},
+			ok: true,
+		},
+		{
+			command: "route -A inet6 add 2001:db8::/32 gw fe80::1 dev eth0",
+			expect: route{
+				destination: net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(32, 128)},
+				gateway:     net.ParseIP("fe80::1"),
+			},
+			ok: true,
+		},
+		{
+			command: "ip route add 10.208.0.0/12 via 10.184.0.1 dev bond0.401",
+			expect: route{
+				destination: net.IPNet{IP: net.IPv4(10, 208, 0, 0).To4(), Mask: net.CIDRMask(12, 32)},
+				gateway:     net.IPv4(10, 184, 0, 1),
+			},
+			ok: true,
+		},
+		{
+			command: "ip route add default via fe80::1",
+			expect: route{
+				destination: net.IPNet{IP: net.IPv6zero, Mask: net.IPMask(net.IPv6zero)},
+				gateway:     net.ParseIP("fe80::1"),
+			},
+			ok: true,
+		},
+		{command: "ip route del 10.208.0.0/12 via 10.184.0.1"},
+		{command: "ip route add 10.208.0.0/12"},
+		{command: "route add -net 10.176.0.0 gw 10.184.0.1"},
+		{command: "echo route add"},
+	} {
+		r, ok := parseRouteCommand(tt.command)
+		if ok != tt.ok {
+			t.Fatalf("bad ok (%q): want %t, got %t", tt.command, tt.ok, ok)
+		}
+		if !reflect.DeepEqual(r, tt.expect) {
+			t.Fatalf("bad route (%q): want %#v, got %#v", tt.command, tt.expect, r)
+		}
+	}
+}
+
+func TestMergeConfigMethods(t *testing.T) {
+	address4 := net.IPNet{IP: net.IPv4(192, 168, 1, 100), Mask: net.IPv4Mask(255, 255, 255, 0)}
+	address6 := net.IPNet{IP: net.ParseIP("2001:db8::2"), Mask: net.CIDRMask(64, 128)}
+	for i, tt := range []struct {
+		a      configMethod
+		b      configMethod
+		expect configMethod
+	}{
+		{
+			a:      configMethodManual{},
+			b:      configMethodDHCP{family: "ipv6"},
+			expect: configMethodDHCP{family: "ipv6"},
+		},
+		{
+			a:      configMethodDHCP{},
+			b:      configMethodDHCP{family: "ipv6", acceptRA: "true"},
+			expect: configMethodDHCP{acceptRA: "true"},
+		},
+		{
+			a: configMethodStatic{addresses: []net.IPNet{address4}, domains: []string{"example.com"}},
+			b: configMethodStatic{addresses: []net.IPNet{address6}, acceptRA: "false"},
+			expect: configMethodStatic{
+				addresses: []net.IPNet{address4, address6},
+				domains:   []string{"example.com"},
+				acceptRA:  "false",
+			},
+		},
+		{
+			a: configMethodStatic{addresses: []net.IPNet{address4}},
+			b: configMethodDHCP{family: "ipv6"},
+			expect: configMethodStatic{
+				addresses: []net.IPNet{address4},
+				dhcp:      "ipv6",
+			},
+		},
+		{
+			a: configMethodStatic{dhcp: "ipv6", acceptRA: "true"},
+			b: configMethodDHCP{},
+			expect: configMethodStatic{
+				dhcp:     "true",
+				acceptRA: "true",
+			},
+		},
+	} {
+		if c := mergeConfigMethods(tt.a, tt.b); !reflect.DeepEqual(c, tt.expect) {
+			t.Fatalf("bad config method (%d): want %#v, got %#v", i, tt.expect, c)
+		}
+	}
+}
+
 func TestParseInterfaceStanzaLoopback(t *testing.T) {
 	iface, err := parseInterfaceStanza([]string{"eth", "inet", "loopback"}, nil)
 	if err != nil {
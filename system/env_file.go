@@ -72,17 +72,30 @@ func mergeEnvContents(old []byte, pending map[string]string) []byte {
 // Existing ordering and any unknown formatting such as comments are
 // preserved. If no changes are required the file is untouched.
 func WriteEnvFile(ef *EnvFile, root string) error {
+	changed, err := MergeEnvFile(ef, root)
+	if err != nil || !changed {
+		return err
+	}
+
+	_, err = WriteFile(ef.File, root)
+	return err
+}
+
+// MergeEnvFile sets File.Content to the result of updating the existing env
+// file with the values provided in EnvFile.Vars, without writing it. It
+// returns whether or not the content differs from that of the existing file.
+func MergeEnvFile(ef *EnvFile, root string) (bool, error) {
 	// validate new keys, mergeEnvContents uses pending to track writes
 	pending := make(map[string]string, len(ef.Vars))
 	for key, value := range ef.Vars {
 		if !validKey.MatchString(key) {
-			return fmt.Errorf("Invalid name %q for %s", key, ef.Path)
+			return false, fmt.Errorf("Invalid name %q for %s", key, ef.Path)
 		}
 		pending[key] = value
 	}
 
 	if len(pending) == 0 {
-		return nil
+		return false, nil
 	}
 
 	oldContent, err := ioutil.ReadFile(path.Join(root, ef.Path))
@@ -90,18 +103,17 @@ func WriteEnvFile(ef *EnvFile, root string) error {
 		if os.IsNotExist(err) {
 			oldContent = []byte{}
 		} else {
-			return err
+			return false, err
 		}
 	}
 
 	newContent := mergeEnvContents(oldContent, pending)
 	if bytes.Equal(oldContent, newContent) {
-		return nil
+		return false, nil
 	}
 
 	ef.File.Content = string(newContent)
-	_, err = WriteFile(ef.File, root)
-	return err
+	return true, nil
 }
 
 // keys returns the keys of a map in sorted order
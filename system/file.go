@@ -15,6 +15,7 @@
 package system
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -100,6 +101,32 @@ func WriteFile(f *File, root string) (string, error) {
 	return fullpath, nil
 }
 
+// FileUnchanged returns whether or not writing the given file would leave the
+// existing file at its path untouched, in which case the write can be
+// skipped. Files with an owner are always considered changed since their
+// ownership isn't compared.
+func FileUnchanged(f *File, root string) bool {
+	if f.Owner != "" {
+		return false
+	}
+	content, err := config.DecodeContent(f.Content, f.Encoding)
+	if err != nil {
+		return false
+	}
+	perm, err := f.Permissions()
+	if err != nil {
+		return false
+	}
+
+	fullpath := path.Join(root, f.Path)
+	info, err := os.Lstat(fullpath)
+	if err != nil || !info.Mode().IsRegular() || info.Mode().Perm() != perm {
+		return false
+	}
+	existing, err := ioutil.ReadFile(fullpath)
+	return err == nil && bytes.Equal(existing, content)
+}
+
 func EnsureDirectoryExists(dir string) error {
 	info, err := os.Stat(dir)
 	if err == nil {
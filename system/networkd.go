@@ -16,10 +16,15 @@ package system
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"os/exec"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coreos/coreos-cloudinit/config"
 	"github.com/coreos/coreos-cloudinit/network"
@@ -27,21 +32,109 @@ import (
 	"github.com/coreos/coreos-cloudinit/Godeps/_workspace/src/github.com/dotcloud/docker/pkg/netlink"
 )
 
-func RestartNetwork(interfaces []network.InterfaceGenerator) (err error) {
-	defer func() {
-		if e := restartNetworkd(); e != nil {
-			err = e
+// PrepareNetwork prepares the interfaces whose configuration differs from that
+// in place under the given root to be reconfigured: those which are renamed or
+// enslaved to a bond are taken down, and the kernel modules they need are
+// loaded. The other interfaces are left up. It returns the names of the links
+// of the changed interfaces which exist on the system, to be reconfigured by
+// systemd-networkd once their configuration has been written (see
+// UnitManager.ReloadNetwork).
+func PrepareNetwork(root string, interfaces []network.InterfaceGenerator) ([]string, error) {
+	changed := ChangedNetworkInterfaces(root, interfaces)
+	if len(changed) == 0 {
+		log.Printf("Network configuration is unchanged")
+		return nil, nil
+	}
+
+	if err := downNetworkInterfaces(bondSlaves(changed)); err != nil {
+		return nil, err
+	}
+
+	if err := renameNetworkInterfaces(changed); err != nil {
+		return nil, err
+	}
+
+	if err := maybeProbe8012q(changed); err != nil {
+		return nil, err
+	}
+	if err := maybeProbeBonding(changed); err != nil {
+		return nil, err
+	}
+	return networkLinks(changed), nil
+}
+
+// networkLinks returns the names of the system interfaces matching the given
+// interfaces. Those which don't exist yet, such as bonds and VLANs which are
+// created by systemd-networkd, are left out.
+func networkLinks(interfaces []network.InterfaceGenerator) []string {
+	var links []string
+	for _, iface := range interfaces {
+		if systemInterface, err := findInterface(iface); err == nil {
+			links = append(links, systemInterface.Name)
+		}
+	}
+	return links
+}
+
+// ChangedNetworkInterfaces returns the interfaces whose netdev, link or
+// network file differs from the one in place under the given root, including
+// those which have no file in place yet. On the running system, the network
+// file is also compared with the one systemd-networkd is currently applying to
+// the interface, so that an interface which is already configured as wanted
+// isn't reported as changed.
+func ChangedNetworkInterfaces(root string, interfaces []network.InterfaceGenerator) []network.InterfaceGenerator {
+	var changed []network.InterfaceGenerator
+	for _, iface := range interfaces {
+		for _, file := range []struct {
+			ext     string
+			content string
+		}{
+			{"netdev", iface.Netdev()},
+			{"link", iface.Link()},
+			{"network", iface.Network()},
+		} {
+			unit := Unit{config.Unit{
+				Name:    fmt.Sprintf("%s.%s", iface.Filename(), file.ext),
+				Runtime: true,
+			}}
+			current, err := ioutil.ReadFile(unit.Destination(root))
+			if file.ext == "network" && path.Clean(root) == "/" && (err != nil || string(current) != file.content) {
+				current, err = appliedNetworkFile(iface)
+			}
+			if (err != nil && file.content != "") || (err == nil && string(current) != file.content) {
+				log.Printf("Configuration of interface %q changed (%s)", iface.Name(), unit.Name)
+				changed = append(changed, iface)
+				break
+			}
 		}
-	}()
+	}
+	return changed
+}
 
-	if err = downNetworkInterfaces(interfaces); err != nil {
-		return
+// appliedNetworkFile returns the content of the network file which
+// systemd-networkd is currently applying to the given interface.
+func appliedNetworkFile(iface network.InterfaceGenerator) ([]byte, error) {
+	_, state, err := linkState(iface)
+	if err != nil {
+		return nil, err
 	}
+	file, ok := state["NETWORK_FILE"]
+	if !ok {
+		return nil, fmt.Errorf("no network file applied to interface %q", iface.Name())
+	}
+	return ioutil.ReadFile(file)
+}
 
-	if err = maybeProbe8012q(interfaces); err != nil {
-		return
+// bondSlaves returns those of the given interfaces which are enslaved to a
+// bond. They have to be down for networkd to enslave them.
+func bondSlaves(interfaces []network.InterfaceGenerator) []network.InterfaceGenerator {
+	var slaves []network.InterfaceGenerator
+	for _, iface := range interfaces {
+		if strings.Contains(iface.Network(), "\nBond=") {
+			slaves = append(slaves, iface)
+		}
 	}
-	return maybeProbeBonding(interfaces)
+	return slaves
 }
 
 func downNetworkInterfaces(interfaces []network.InterfaceGenerator) error {
@@ -67,6 +160,38 @@ func downNetworkInterfaces(interfaces []network.InterfaceGenerator) error {
 	return nil
 }
 
+// renameNetworkInterfaces gives the interfaces which are named after their MAC
+// address by a link file their names right away, rather than on the next boot.
+// They are taken down first, since an interface can't be renamed while it is
+// up.
+func renameNetworkInterfaces(interfaces []network.InterfaceGenerator) error {
+	systemInterfaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	for _, iface := range interfaces {
+		if iface.Link() == "" || iface.Hwaddr() == nil || iface.Name() == "" {
+			continue
+		}
+		for _, systemInterface := range systemInterfaces {
+			systemInterface := systemInterface
+			if systemInterface.HardwareAddr.String() != iface.Hwaddr().String() || systemInterface.Name == iface.Name() {
+				continue
+			}
+			log.Printf("Renaming interface %q to %q\n", systemInterface.Name, iface.Name())
+			if err := netlink.NetworkLinkDown(&systemInterface); err != nil {
+				fmt.Printf("Error while downing interface %q (%s). Continuing...\n", systemInterface.Name, err)
+			}
+			if err := netlink.NetworkChangeName(&systemInterface, iface.Name()); err != nil {
+				fmt.Printf("Error while renaming interface %q (%s). Continuing...\n", systemInterface.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
 func maybeProbe8012q(interfaces []network.InterfaceGenerator) error {
 	for _, iface := range interfaces {
 		if iface.Type() == "vlan" {
@@ -77,10 +202,13 @@ func maybeProbe8012q(interfaces []network.InterfaceGenerator) error {
 	return nil
 }
 
+// maybeProbeBonding loads the bonding module if any of the interfaces is a
+// bond. The options of each bond are set by networkd, so the module is told
+// not to create a bond of its own.
 func maybeProbeBonding(interfaces []network.InterfaceGenerator) error {
 	for _, iface := range interfaces {
 		if iface.Type() == "bond" {
-			args := append([]string{"bonding"}, strings.Split(iface.ModprobeParams(), " ")...)
+			args := []string{"bonding", "max_bonds=0"}
 			log.Printf("Probing LKM %q (%q)\n", "bonding", args)
 			return exec.Command("modprobe", args...).Run()
 		}
@@ -88,9 +216,109 @@ func maybeProbeBonding(interfaces []network.InterfaceGenerator) error {
 	return nil
 }
 
-func restartNetworkd() error {
-	log.Printf("Restarting networkd.service\n")
-	networkd := Unit{config.Unit{Name: "systemd-networkd.service"}}
-	_, err := NewUnitManager("").RunUnitCommand(networkd, "restart")
-	return err
+// networkdLinksDir holds the state of the links managed by systemd-networkd,
+// in a file named after the index of each link.
+var networkdLinksDir = "/run/systemd/netif/links"
+
+// networkPollInterval is the interval at which the state of the links is
+// checked while waiting for them to be configured.
+const networkPollInterval = 500 * time.Millisecond
+
+// WaitForNetwork waits until systemd-networkd has configured each of the given
+// interfaces (e.g. acquired a DHCP lease and assigned the addresses), or until
+// the timeout expires. It returns the error of each interface, in the order
+// given, which is nil for those which were configured.
+func WaitForNetwork(interfaces []network.InterfaceGenerator, timeout time.Duration) []error {
+	errs := make([]error, len(interfaces))
+	deadline := time.Now().Add(timeout)
+	for i, iface := range interfaces {
+		for {
+			done, err := checkLink(iface)
+			if done {
+				errs[i] = err
+				break
+			}
+			if time.Now().After(deadline) {
+				errs[i] = fmt.Errorf("timed out waiting for the network: %v", err)
+				break
+			}
+			time.Sleep(networkPollInterval)
+		}
+	}
+	return errs
+}
+
+// checkLink returns whether or not systemd-networkd is done with the given
+// interface and, if it isn't configured, why.
+func checkLink(iface network.InterfaceGenerator) (bool, error) {
+	systemInterface, state, err := linkState(iface)
+	if err != nil {
+		return false, err
+	}
+	switch state["ADMIN_STATE"] {
+	case "configured":
+		log.Printf("Interface %q is configured (%s, addresses: %s)", systemInterface.Name, state["OPER_STATE"], interfaceAddresses(systemInterface))
+		return true, nil
+	case "failed", "unmanaged", "linger":
+		return true, fmt.Errorf("interface %q is %s", systemInterface.Name, state["ADMIN_STATE"])
+	default:
+		return false, fmt.Errorf("interface %q is %s", systemInterface.Name, state["ADMIN_STATE"])
+	}
+}
+
+// findInterface returns the system interface matching the given interface, by
+// name or else by MAC address.
+func findInterface(iface network.InterfaceGenerator) (*net.Interface, error) {
+	if iface.Name() != "" {
+		i, err := net.InterfaceByName(iface.Name())
+		if err != nil {
+			return nil, fmt.Errorf("interface %q not found", iface.Name())
+		}
+		return i, nil
+	}
+
+	systemInterfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range systemInterfaces {
+		if i.HardwareAddr.String() == iface.Hwaddr().String() {
+			i := i
+			return &i, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s not found", iface.Hwaddr())
+}
+
+// linkState returns the system interface matching the given interface, along
+// with the state systemd-networkd records for it.
+func linkState(iface network.InterfaceGenerator) (*net.Interface, map[string]string, error) {
+	systemInterface, err := findInterface(iface)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state := map[string]string{"ADMIN_STATE": "pending"}
+	content, err := ioutil.ReadFile(path.Join(networkdLinksDir, strconv.Itoa(systemInterface.Index)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if tokens := strings.SplitN(line, "=", 2); len(tokens) == 2 {
+			state[tokens[0]] = tokens[1]
+		}
+	}
+	return systemInterface, state, nil
+}
+
+func interfaceAddresses(iface *net.Interface) string {
+	addrs, err := iface.Addrs()
+	if err != nil || len(addrs) == 0 {
+		return "none"
+	}
+	list := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		list = append(list, addr.String())
+	}
+	return strings.Join(list, " ")
 }
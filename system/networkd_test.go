@@ -0,0 +1,187 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package system
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/coreos/coreos-cloudinit/network"
+)
+
+func TestChangedNetworkInterfaces(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	interfaces, err := network.ProcessDebianNetconf([]byte("iface eth0 inet dhcp\niface eth1 inet dhcp\niface eth2 inet dhcp\niface bond0 inet dhcp\n    bond-slaves eth3"))
+	if err != nil {
+		t.Fatalf("Unable to process network config: %v", err)
+	}
+
+	files := map[string]string{}
+	for _, iface := range interfaces {
+		switch iface.Name() {
+		case "eth0":
+			// Unchanged
+			files[iface.Filename()+".network"] = iface.Network()
+		case "eth1":
+			files[iface.Filename()+".network"] = "[Match]\nName=eth1\n"
+		case "bond0":
+			// Missing its netdev file
+			files[iface.Filename()+".network"] = iface.Network()
+		case "eth3":
+			files[iface.Filename()+".network"] = iface.Network()
+		}
+	}
+	unitDir := path.Join(dir, "run", "systemd", "network")
+	if err := os.MkdirAll(unitDir, 0755); err != nil {
+		t.Fatalf("Unable to create unit directory: %v", err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(unitDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write %s: %v", name, err)
+		}
+	}
+
+	var changed []string
+	for _, iface := range ChangedNetworkInterfaces(dir, interfaces) {
+		changed = append(changed, iface.Name())
+	}
+	if expect := []string{"bond0", "eth1", "eth2"}; !reflect.DeepEqual(changed, expect) {
+		t.Fatalf("bad changed interfaces: want %v, got %v", expect, changed)
+	}
+
+	var slaves []string
+	for _, iface := range bondSlaves(interfaces) {
+		slaves = append(slaves, iface.Name())
+	}
+	if expect := []string{"eth3"}; !reflect.DeepEqual(slaves, expect) {
+		t.Fatalf("bad bond slaves: want %v, got %v", expect, slaves)
+	}
+}
+
+func TestAppliedNetworkFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { networkdLinksDir = d }(networkdLinksDir)
+	networkdLinksDir = dir
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("No loopback interface: %v", err)
+	}
+	interfaces, err := network.ProcessDebianNetconf([]byte("iface lo inet manual"))
+	if err != nil {
+		t.Fatalf("Unable to process network config: %v", err)
+	}
+	state := path.Join(dir, strconv.Itoa(lo.Index))
+
+	if _, err := appliedNetworkFile(interfaces[0]); err == nil {
+		t.Fatalf("expected an error without a link state")
+	}
+
+	file := path.Join(dir, "lo.network")
+	if err := ioutil.WriteFile(file, []byte("[Match]\nName=lo\n"), 0644); err != nil {
+		t.Fatalf("Unable to write network file: %v", err)
+	}
+	if err := ioutil.WriteFile(state, []byte("ADMIN_STATE=configured\nNETWORK_FILE="+file+"\n"), 0644); err != nil {
+		t.Fatalf("Unable to write link state: %v", err)
+	}
+	content, err := appliedNetworkFile(interfaces[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(content) != "[Match]\nName=lo\n" {
+		t.Fatalf("bad applied network file: %q", content)
+	}
+}
+
+func TestWaitForNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { networkdLinksDir = d }(networkdLinksDir)
+	networkdLinksDir = dir
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("No loopback interface: %v", err)
+	}
+
+	for _, tt := range []struct {
+		config string
+		state  string
+		err    string
+	}{
+		{
+			config: "iface lo inet manual",
+			state:  "ADMIN_STATE=configured\nOPER_STATE=carrier\n",
+		},
+		{
+			config: "iface lo inet manual",
+			state:  "ADMIN_STATE=failed\nOPER_STATE=off\n",
+			err:    `interface "lo" is failed`,
+		},
+		{
+			config: "iface lo inet manual",
+			state:  "ADMIN_STATE=configuring\nOPER_STATE=carrier\n",
+			err:    `timed out waiting for the network: interface "lo" is configuring`,
+		},
+		{
+			config: "iface lo inet manual",
+			err:    `timed out waiting for the network: interface "lo" is pending`,
+		},
+		{
+			config: "iface nosuchif0 inet manual",
+			err:    `timed out waiting for the network: interface "nosuchif0" not found`,
+		},
+	} {
+		os.Remove(path.Join(dir, strconv.Itoa(lo.Index)))
+		if tt.state != "" {
+			if err := ioutil.WriteFile(path.Join(dir, strconv.Itoa(lo.Index)), []byte(tt.state), 0644); err != nil {
+				t.Fatalf("Unable to write link state: %v", err)
+			}
+		}
+		interfaces, err := network.ProcessDebianNetconf([]byte(tt.config))
+		if err != nil {
+			t.Fatalf("Unable to process network config: %v", err)
+		}
+
+		errs := WaitForNetwork(interfaces, 0)
+		if len(errs) != 1 {
+			t.Fatalf("bad number of errors (%q): want 1, got %d", tt.config, len(errs))
+		}
+		var got string
+		if errs[0] != nil {
+			got = errs[0].Error()
+		}
+		if got != tt.err {
+			t.Fatalf("bad error (%q, %q): want %q, got %q", tt.config, tt.state, tt.err, got)
+		}
+	}
+}
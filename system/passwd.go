@@ -0,0 +1,543 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package system
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/coreos-cloudinit/config"
+)
+
+const (
+	// baselayoutDir holds the read-only databases consulted through
+	// nss-altfiles, in which CoreOS keeps its default users and groups.
+	baselayoutDir = "usr/share/baselayout"
+
+	defaultShell = "/bin/bash"
+	// usersGID is the primary group of users created without a group of
+	// their own.
+	usersGID = 100
+)
+
+// offlineUsers is the UserManager of a system found under root which isn't
+// running. Rather than calling useradd and friends on the host, it edits the
+// passwd, group and shadow databases of root directly.
+type offlineUsers struct {
+	root string
+}
+
+func NewOfflineUserManager(root string) UserManager {
+	return &offlineUsers{root}
+}
+
+func (o *offlineUsers) UserExists(u *config.User) bool {
+	_, err := o.lookupUser(u.Name)
+	return err == nil
+}
+
+func (o *offlineUsers) CreateUser(u *config.User) error {
+	if strings.ContainsAny(u.Name+u.GECOS+u.Homedir+u.Shell, ":\n") {
+		return fmt.Errorf("user %q contains invalid characters", u.Name)
+	}
+
+	passwd, err := o.readDatabase("etc/passwd")
+	if err != nil {
+		return err
+	}
+	group, err := o.readDatabase("etc/group")
+	if err != nil {
+		return err
+	}
+	basePasswd, err := o.readDatabase(path.Join(baselayoutDir, "passwd"))
+	if err != nil {
+		return err
+	}
+	baseGroup, err := o.readDatabase(path.Join(baselayoutDir, "group"))
+	if err != nil {
+		return err
+	}
+	if findEntry(passwd, u.Name) >= 0 || findEntry(basePasswd, u.Name) >= 0 {
+		return fmt.Errorf("user %q already exists", u.Name)
+	}
+
+	min, max := 1000, 60000
+	if u.System {
+		min, max = 101, 999
+	}
+	uid, err := nextID(append(passwd, basePasswd...), min, max)
+	if err != nil {
+		return err
+	}
+
+	var newGroup []string
+	gid := usersGID
+	switch {
+	case u.PrimaryGroup != "":
+		entry := lookupGroup(u.PrimaryGroup, group, baseGroup)
+		if entry == nil {
+			return fmt.Errorf("group %q does not exist", u.PrimaryGroup)
+		}
+		gid, _ = strconv.Atoi(entry[2])
+	case !u.NoUserGroup:
+		if findEntry(group, u.Name) >= 0 || findEntry(baseGroup, u.Name) >= 0 {
+			return fmt.Errorf("group %q already exists", u.Name)
+		}
+		gid = uid
+		if idUsed(append(group, baseGroup...), gid) {
+			if gid, err = nextID(append(group, baseGroup...), min, max); err != nil {
+				return err
+			}
+		}
+		newGroup = []string{u.Name, "x", strconv.Itoa(gid), ""}
+		group = append(group, newGroup)
+	}
+
+	var groups []string
+	for _, name := range u.Groups {
+		i := findEntry(group, name)
+		if i < 0 {
+			// Groups found only in the baselayout are copied over so that
+			// their members can be changed.
+			j := findEntry(baseGroup, name)
+			if j < 0 {
+				return fmt.Errorf("group %q does not exist", name)
+			}
+			group = append(group, append([]string{}, baseGroup[j]...))
+			i = len(group) - 1
+		}
+		group[i] = addMember(group[i], 3, u.Name)
+		groups = append(groups, group[i][0])
+	}
+
+	home := u.Homedir
+	if home == "" {
+		home = path.Join("/home", u.Name)
+	}
+	shell := u.Shell
+	if shell == "" {
+		shell = defaultShell
+	}
+	hash := u.PasswordHash
+	if hash == "" {
+		hash = "*"
+	}
+
+	passwd = append(passwd, []string{u.Name, "x", strconv.Itoa(uid), strconv.Itoa(gid), u.GECOS, home, shell})
+	if err := o.writeDatabase("etc/group", group, 0644); err != nil {
+		return err
+	}
+	if err := o.updateGshadow(newGroup, groups, u.Name); err != nil {
+		return err
+	}
+	if err := o.writeDatabase("etc/passwd", passwd, 0644); err != nil {
+		return err
+	}
+	if err := o.SetUserPassword(u.Name, hash); err != nil {
+		return err
+	}
+
+	if !u.NoCreateHome {
+		return o.createHome(home, uid, gid)
+	}
+	return nil
+}
+
+func (o *offlineUsers) SetUserPassword(user, hash string) error {
+	if _, err := o.lookupUser(user); err != nil {
+		return err
+	}
+
+	shadow, err := o.readDatabase("etc/shadow")
+	if err != nil {
+		return err
+	}
+	i := findEntry(shadow, user)
+	if i < 0 {
+		shadow = append(shadow, []string{user, "", "", "0", "99999", "7", "", "", ""})
+		i = len(shadow) - 1
+	}
+	for len(shadow[i]) < 3 {
+		shadow[i] = append(shadow[i], "")
+	}
+	shadow[i][1] = hash
+	shadow[i][2] = strconv.FormatInt(time.Now().Unix()/(24*60*60), 10)
+	return o.writeDatabase("etc/shadow", shadow, 0600)
+}
+
+// AuthorizeSSHKeys writes the keys to ~/.ssh/authorized_keys.d/<keysName> and
+// regenerates ~/.ssh/authorized_keys from that directory, like
+// update-ssh-keys does.
+func (o *offlineUsers) AuthorizeSSHKeys(user string, keysName string, keys []string) error {
+	entry, err := o.lookupUser(user)
+	if err != nil {
+		return err
+	}
+	uid, _ := strconv.Atoi(entry[2])
+	gid, _ := strconv.Atoi(entry[3])
+
+	trimmed := make([]string, len(keys))
+	for i, key := range keys {
+		trimmed[i] = strings.TrimSpace(key)
+	}
+
+	sshDir, err := o.homePath(entry[5], ".ssh")
+	if err != nil {
+		return err
+	}
+	keysDir, err := o.homePath(entry[5], ".ssh", "authorized_keys.d")
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{sshDir, keysDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	keysFile, err := o.homePath(entry[5], ".ssh", "authorized_keys.d", keysName)
+	if err != nil {
+		return err
+	}
+	if err := writeOwnedFile(keysFile, fmt.Sprintf("%s\n", strings.Join(trimmed, "\n")), uid, gid); err != nil {
+		return err
+	}
+
+	infos, err := ioutil.ReadDir(keysDir)
+	if err != nil {
+		return err
+	}
+	var all []string
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(keysDir, info.Name()))
+		if err != nil {
+			return err
+		}
+		all = append(all, fmt.Sprintf("# %s\n%s", info.Name(), content))
+	}
+	authorizedKeys, err := o.homePath(entry[5], ".ssh", "authorized_keys")
+	if err != nil {
+		return err
+	}
+	return writeOwnedFile(authorizedKeys, strings.Join(all, ""), uid, gid)
+}
+
+// lookupUser returns the passwd entry of the given user, searching the
+// baselayout if the user isn't found in /etc/passwd.
+func (o *offlineUsers) lookupUser(name string) ([]string, error) {
+	for _, db := range []string{"etc/passwd", path.Join(baselayoutDir, "passwd")} {
+		entries, err := o.readDatabase(db)
+		if err != nil {
+			return nil, err
+		}
+		if i := findEntry(entries, name); i >= 0 && len(entries[i]) >= 7 {
+			return entries[i], nil
+		}
+	}
+	return nil, fmt.Errorf("user %q does not exist", name)
+}
+
+// updateGshadow adds newGroup, if any, to /etc/gshadow and adds user to the
+// given groups, provided that the system uses a gshadow database at all.
+func (o *offlineUsers) updateGshadow(newGroup []string, groups []string, user string) error {
+	gshadow, err := o.readDatabase("etc/gshadow")
+	if err != nil || gshadow == nil {
+		return err
+	}
+	if newGroup != nil {
+		gshadow = append(gshadow, []string{newGroup[0], "!", "", ""})
+	}
+	for _, name := range groups {
+		i := findEntry(gshadow, name)
+		if i < 0 {
+			gshadow = append(gshadow, []string{name, "!", "", ""})
+			i = len(gshadow) - 1
+		}
+		gshadow[i] = addMember(gshadow[i], 3, user)
+	}
+	return o.writeDatabase("etc/gshadow", gshadow, 0600)
+}
+
+// homePath returns the path below root of the given home directory, or of the
+// given path within it. Home directories which would lead outside of root are
+// rejected, and the symlinks along the path are resolved within root (see
+// resolvePath), so that files are never created outside of it.
+func (o *offlineUsers) homePath(home string, elem ...string) (string, error) {
+	root := path.Clean(o.root)
+	dir := path.Join(root, home)
+	if dir != root && !strings.HasPrefix(dir, strings.TrimSuffix(root, "/")+"/") {
+		return "", fmt.Errorf("home directory %q is outside of %s", home, o.root)
+	}
+	return resolvePath(root, path.Join(append([]string{home}, elem...)...))
+}
+
+// maxSymlinks is the number of symlinks resolvePath follows before giving up,
+// as the kernel does.
+const maxSymlinks = 40
+
+// resolvePath returns the path below root at which the given path is found
+// once each of its components which is a symlink has been resolved as if root
+// was /, so that the result is always below root. Components which don't
+// exist are taken as they are.
+func resolvePath(root, p string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(p, "/")
+	links := 0
+	for len(rest) > 0 {
+		component := rest[0]
+		rest = rest[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, component)
+		info, err := os.Lstat(path.Join(root, next))
+		if os.IsNotExist(err) || (err == nil && info.Mode()&os.ModeSymlink == 0) {
+			resolved = next
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %q", p)
+		}
+		target, err := os.Readlink(path.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return path.Join(root, resolved), nil
+}
+
+// createHome creates the given home directory, populated from /etc/skel,
+// owned by uid and gid.
+func (o *offlineUsers) createHome(home string, uid, gid int) error {
+	dir, err := o.homePath(home)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chown(dir, uid, gid); err != nil {
+		return err
+	}
+
+	skel := path.Join(o.root, "etc", "skel")
+	infos, err := ioutil.ReadDir(skel)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		src := path.Join(skel, info.Name())
+		dst, err := o.homePath(home, info.Name())
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(src)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, dst); err != nil {
+				return err
+			}
+			if err := os.Lchown(dst, uid, gid); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			content, err := ioutil.ReadFile(src)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(dst, content, info.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := os.Chown(dst, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readDatabase returns the entries of the colon-separated database found at
+// the given path relative to root, or nil if there is no such database.
+func (o *offlineUsers) readDatabase(db string) ([][]string, error) {
+	content, err := ioutil.ReadFile(path.Join(o.root, db))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries [][]string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, nil
+}
+
+// writeDatabase atomically replaces the database at the given path relative
+// to root. The permissions of an existing database are preserved.
+func (o *offlineUsers) writeDatabase(db string, entries [][]string, perm os.FileMode) error {
+	p := path.Join(o.root, db)
+	if info, err := os.Stat(p); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		lines = append(lines, strings.Join(entry, ":")+"\n")
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(p), "."+path.Base(p))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strings.Join(lines, "")); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// findEntry returns the index of the entry with the given name, or -1.
+func findEntry(entries [][]string, name string) int {
+	for i, entry := range entries {
+		if entry[0] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookupGroup returns the group entry with the given name or numeric ID from
+// the first database containing it.
+func lookupGroup(name string, dbs ...[][]string) []string {
+	for _, db := range dbs {
+		for _, entry := range db {
+			if len(entry) >= 3 && (entry[0] == name || entry[2] == name) {
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+// idUsed returns whether or not any of the entries uses the given ID.
+func idUsed(entries [][]string, id int) bool {
+	for _, entry := range entries {
+		if len(entry) >= 3 && entry[2] == strconv.Itoa(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextID returns the lowest ID in [min, max] not used by any of the entries.
+func nextID(entries [][]string, min, max int) (int, error) {
+	used := []int{}
+	for _, entry := range entries {
+		if len(entry) < 3 {
+			continue
+		}
+		if id, err := strconv.Atoi(entry[2]); err == nil {
+			used = append(used, id)
+		}
+	}
+	sort.Ints(used)
+
+	id := min
+	for _, u := range used {
+		if u == id {
+			id++
+		} else if u > id {
+			break
+		}
+	}
+	if id > max {
+		return 0, fmt.Errorf("no free ID in [%d, %d]", min, max)
+	}
+	return id, nil
+}
+
+// addMember adds name to the comma-separated list of members found in the
+// given field of entry.
+func addMember(entry []string, field int, name string) []string {
+	for len(entry) <= field {
+		entry = append(entry, "")
+	}
+	var members []string
+	if entry[field] != "" {
+		members = strings.Split(entry[field], ",")
+	}
+	for _, m := range members {
+		if m == name {
+			return entry
+		}
+	}
+	entry[field] = strings.Join(append(members, name), ",")
+	return entry
+}
+
+// writeOwnedFile writes content to the given path, readable only by uid.
+func writeOwnedFile(p, content string, uid, gid int) error {
+	if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+		return err
+	}
+	if err := os.Chmod(p, 0600); err != nil {
+		return err
+	}
+	return os.Chown(p, uid, gid)
+}
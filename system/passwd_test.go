@@ -0,0 +1,225 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/coreos-cloudinit/config"
+)
+
+func writeRootFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		p := path.Join(root, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatalf("Unable to create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write %q: %v", name, err)
+		}
+	}
+}
+
+func readRootFile(t *testing.T, root, name string) string {
+	content, err := ioutil.ReadFile(path.Join(root, name))
+	if err != nil {
+		t.Fatalf("Unable to read %q: %v", name, err)
+	}
+	return string(content)
+}
+
+func TestOfflineCreateUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of files requires root")
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeRootFiles(t, dir, map[string]string{
+		"etc/passwd":                  "root:x:0:0:root:/root:/bin/bash\nfirst:x:1000:1000::/home/first:/bin/bash\n",
+		"etc/group":                   "root:x:0:root\nfirst:x:1000:\n",
+		"etc/shadow":                  "root:*:15887:0:::::\n",
+		"usr/share/baselayout/passwd": "core:x:500:500:CoreOS Admin:/home/core:/bin/bash\n",
+		"usr/share/baselayout/group":  "docker:x:233:core\nwheel:x:10:root,core\n",
+		"etc/skel/.bashrc":            "# bashrc\n",
+	})
+
+	um := NewOfflineUserManager(dir)
+	u := config.User{
+		Name:         "elroy",
+		GECOS:        "Elroy Jetson",
+		PasswordHash: "$6$hash",
+		Groups:       []string{"docker", "first"},
+	}
+	if um.UserExists(&u) {
+		t.Fatalf("bad existence: want false, got true")
+	}
+	if err := um.CreateUser(&u); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	if !um.UserExists(&u) {
+		t.Fatalf("bad existence: want true, got false")
+	}
+	if err := um.CreateUser(&u); err == nil {
+		t.Fatalf("bad error creating existing user: want non-nil, got nil")
+	}
+
+	if expect, passwd := "root:x:0:0:root:/root:/bin/bash\nfirst:x:1000:1000::/home/first:/bin/bash\nelroy:x:1001:1001:Elroy Jetson:/home/elroy:/bin/bash\n", readRootFile(t, dir, "etc/passwd"); passwd != expect {
+		t.Errorf("bad passwd: want %q, got %q", expect, passwd)
+	}
+	if expect, group := "root:x:0:root\nfirst:x:1000:elroy\nelroy:x:1001:\ndocker:x:233:core,elroy\n", readRootFile(t, dir, "etc/group"); group != expect {
+		t.Errorf("bad group: want %q, got %q", expect, group)
+	}
+	shadow := strings.Split(strings.Split(readRootFile(t, dir, "etc/shadow"), "\n")[1], ":")
+	if shadow[0] != "elroy" || shadow[1] != "$6$hash" {
+		t.Errorf("bad shadow: want elroy with password %q, got %q", "$6$hash", shadow)
+	}
+	if bashrc := readRootFile(t, dir, "home/elroy/.bashrc"); bashrc != "# bashrc\n" {
+		t.Errorf("bad skeleton: want %q, got %q", "# bashrc\n", bashrc)
+	}
+
+	if err := um.SetUserPassword("core", "$6$core"); err != nil {
+		t.Fatalf("bad error setting password of baselayout user: want nil, got %v", err)
+	}
+	if shadow := readRootFile(t, dir, "etc/shadow"); !strings.Contains(shadow, "\ncore:$6$core:") {
+		t.Errorf("bad shadow: want entry for core, got %q", shadow)
+	}
+	if err := um.SetUserPassword("nobody", "$6$hash"); err == nil {
+		t.Errorf("bad error setting password of unknown user: want non-nil, got nil")
+	}
+}
+
+func TestOfflineAuthorizeSSHKeys(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of files requires root")
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeRootFiles(t, dir, map[string]string{
+		"usr/share/baselayout/passwd": "core:x:500:500:CoreOS Admin:/home/core:/bin/bash\n" +
+			"escape:x:501:501::/../../etc:/bin/bash\n",
+	})
+
+	um := NewOfflineUserManager(dir)
+	keys := []string{" key2 "}
+	if err := um.AuthorizeSSHKeys("core", "b", keys); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	if keys[0] != " key2 " {
+		t.Errorf("bad keys: want the caller's slice unchanged, got %q", keys)
+	}
+	if err := um.AuthorizeSSHKeys("core", "a", []string{"key1a", "key1b"}); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+
+	if expect, keys := "# a\nkey1a\nkey1b\n# b\nkey2\n", readRootFile(t, dir, "home/core/.ssh/authorized_keys"); keys != expect {
+		t.Errorf("bad authorized_keys: want %q, got %q", expect, keys)
+	}
+	info, err := os.Stat(path.Join(dir, "home/core/.ssh/authorized_keys"))
+	if err != nil {
+		t.Fatalf("Unable to stat authorized_keys: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("bad permissions: want %v, got %v", os.FileMode(0600), info.Mode().Perm())
+	}
+
+	if err := um.AuthorizeSSHKeys("nobody", "a", []string{"key"}); err == nil {
+		t.Errorf("bad error for unknown user: want non-nil, got nil")
+	}
+	if err := um.AuthorizeSSHKeys("escape", "a", []string{"key"}); err == nil {
+		t.Errorf("bad error for home outside of root: want non-nil, got nil")
+	}
+}
+
+func TestOfflineAuthorizeSSHKeysSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(outside)
+
+	writeRootFiles(t, dir, map[string]string{
+		"usr/share/baselayout/passwd": "core:x:500:500:CoreOS Admin:/home/core:/bin/bash\n" +
+			"ssh:x:501:501::/home/ssh:/bin/bash\n",
+	})
+	if err := os.MkdirAll(path.Join(dir, "home", "ssh"), 0755); err != nil {
+		t.Fatalf("Unable to create home: %v", err)
+	}
+	for link, target := range map[string]string{
+		"home/core":     outside,
+		"home/ssh/.ssh": "../../.." + outside,
+	} {
+		if err := os.Symlink(target, path.Join(dir, link)); err != nil {
+			t.Fatalf("Unable to create symlink: %v", err)
+		}
+	}
+
+	um := NewOfflineUserManager(dir)
+	for _, user := range []string{"core", "ssh"} {
+		if err := um.AuthorizeSSHKeys(user, "a", []string{"key"}); err != nil {
+			t.Fatalf("bad error (%s): want nil, got %v", user, err)
+		}
+	}
+
+	if infos, err := ioutil.ReadDir(outside); err != nil || len(infos) != 0 {
+		t.Errorf("bad directory outside of root: want it empty, got %v (%v)", infos, err)
+	}
+	for _, p := range []string{path.Join(outside, ".ssh", "authorized_keys"), path.Join(outside, "authorized_keys")} {
+		if expect, keys := "# a\nkey\n", readRootFile(t, dir, p); keys != expect {
+			t.Errorf("bad authorized_keys %s: want %q, got %q", p, expect, keys)
+		}
+	}
+}
+
+func TestNextID(t *testing.T) {
+	for i, tt := range []struct {
+		entries  [][]string
+		min, max int
+
+		id  int
+		err bool
+	}{
+		{nil, 1000, 60000, 1000, false},
+		{[][]string{{"a", "x", "1000"}, {"b", "x", "1002"}, {"c", "x", "0"}}, 1000, 60000, 1001, false},
+		{[][]string{{"a", "x", "1000"}, {"b", "x", "1001"}}, 1000, 1001, 0, true},
+	} {
+		id, err := nextID(tt.entries, tt.min, tt.max)
+		if (err != nil) != tt.err {
+			t.Errorf("bad error (%d): want %t, got %v", i, tt.err, err)
+		}
+		if !reflect.DeepEqual(tt.id, id) {
+			t.Errorf("bad ID (%d): want %d, got %d", i, tt.id, id)
+		}
+	}
+}
@@ -21,9 +21,13 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/coreos/coreos-cloudinit/Godeps/_workspace/src/github.com/coreos/go-systemd/dbus"
+	godbus "github.com/coreos/coreos-cloudinit/Godeps/_workspace/src/github.com/guelfey/go.dbus"
 	"github.com/coreos/coreos-cloudinit/config"
 )
 
@@ -39,6 +43,13 @@ type systemd struct {
 // never be used as a true MachineID
 const fakeMachineID = "42000000000000000000000000000042"
 
+// bootIDPath is the location of the kernel's identifier for the current boot.
+var bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// JobTimeout is how long RunUnitCommand waits for the job of a unit command
+// to finish.
+var JobTimeout = 5 * time.Minute
+
 // PlaceUnit writes a unit file at its desired destination, creating parent
 // directories as necessary.
 func (s *systemd) PlaceUnit(u Unit) error {
@@ -76,33 +87,157 @@ func (s *systemd) EnableUnitFile(u Unit) error {
 	return err
 }
 
-func (s *systemd) RunUnitCommand(u Unit, c string) (string, error) {
+func (s *systemd) DisableUnitFile(u Unit) error {
 	conn, err := dbus.New()
 	if err != nil {
+		return err
+	}
+
+	_, err = conn.DisableUnitFiles([]string{u.Name}, u.Runtime)
+	return err
+}
+
+// PresetUnitFile enables or disables the unit according to the preset policy
+// of the system, analogous to `systemctl preset`.
+func (s *systemd) PresetUnitFile(u Unit) error {
+	conn, err := godbus.SystemBus()
+	if err != nil {
+		return err
+	}
+
+	obj := conn.Object("org.freedesktop.systemd1", godbus.ObjectPath("/org/freedesktop/systemd1"))
+	return obj.Call("org.freedesktop.systemd1.Manager.PresetUnitFiles", 0, []string{u.Name}, u.Runtime, true).Err
+}
+
+// unitCommandMethods maps the unit commands to the methods of the systemd
+// manager which queue their jobs.
+var unitCommandMethods = map[string]string{
+	"start":                 "StartUnit",
+	"stop":                  "StopUnit",
+	"restart":               "RestartUnit",
+	"reload":                "ReloadUnit",
+	"try-restart":           "TryRestartUnit",
+	"reload-or-restart":     "ReloadOrRestartUnit",
+	"reload-or-try-restart": "ReloadOrTryRestartUnit",
+}
+
+// RunUnitCommand queues a job for the given command on the unit and waits
+// for it to finish, for at most JobTimeout. The returned status holds the
+// result of the job ("timeout" if it didn't finish in time) and the state the
+// unit was left in. An error is only returned if the job couldn't be queued;
+// it is up to the caller to decide whether a result other than "done" or
+// "skipped" is a failure.
+func (s *systemd) RunUnitCommand(u Unit, c string) (UnitStatus, error) {
+	status := UnitStatus{}
+
+	method, ok := unitCommandMethods[c]
+	if !ok {
+		return status, fmt.Errorf("Unsupported systemd command %q", c)
+	}
+
+	// A private connection is used so that closing it stops the delivery of
+	// signals once the job finished or timed out.
+	conn, err := systemBus()
+	if err != nil {
+		return status, err
+	}
+	defer conn.Close()
+
+	if status.Result, err = runJob(conn, JobTimeout, method, u.Name, "replace"); err != nil {
+		return status, err
+	}
+
+	if v, err := unitProperty(conn, u.Name, "Unit", "ActiveState"); err == nil {
+		status.ActiveState, _ = v.Value().(string)
+	}
+	if v, err := unitProperty(conn, u.Name, "Unit", "SubState"); err == nil {
+		status.SubState, _ = v.Value().(string)
+	}
+	return status, nil
+}
+
+// runJob queues a job through the given method of the systemd manager, whose
+// arguments start with the name of the unit, and waits for it to finish, for
+// at most timeout unless it is 0. It returns the result of the job, which is
+// "timeout" if it didn't finish in time. An error is only returned if the job
+// couldn't be queued or the connection was lost.
+func runJob(conn *godbus.Conn, timeout time.Duration, method string, args ...interface{}) (string, error) {
+	if err := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0,
+		"type='signal',interface='org.freedesktop.systemd1.Manager',member='JobRemoved'").Err; err != nil {
 		return "", err
 	}
+	signals := make(chan *godbus.Signal, 32)
+	conn.Signal(signals)
 
-	var fn func(string, string) (string, error)
-	switch c {
-	case "start":
-		fn = conn.StartUnit
-	case "stop":
-		fn = conn.StopUnit
-	case "restart":
-		fn = conn.RestartUnit
-	case "reload":
-		fn = conn.ReloadUnit
-	case "try-restart":
-		fn = conn.TryRestartUnit
-	case "reload-or-restart":
-		fn = conn.ReloadOrRestartUnit
-	case "reload-or-try-restart":
-		fn = conn.ReloadOrTryRestartUnit
-	default:
-		return "", fmt.Errorf("Unsupported systemd command %q", c)
+	manager := conn.Object("org.freedesktop.systemd1", godbus.ObjectPath("/org/freedesktop/systemd1"))
+	var job godbus.ObjectPath
+	if err := manager.Call("org.freedesktop.systemd1.Manager."+method, 0, args...).Store(&job); err != nil {
+		return "", err
 	}
 
-	return fn(u.Name, "replace")
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	for {
+		select {
+		case signal, ok := <-signals:
+			if !ok {
+				return "", fmt.Errorf("connection to systemd closed while waiting for %s job for unit %v", method, args[0])
+			}
+			if signal.Name != "org.freedesktop.systemd1.Manager.JobRemoved" || len(signal.Body) != 4 {
+				continue
+			}
+			if path, _ := signal.Body[1].(godbus.ObjectPath); path == job {
+				result, _ := signal.Body[3].(string)
+				return result, nil
+			}
+		case <-expired:
+			return "timeout", nil
+		}
+	}
+}
+
+// unitProperty returns the given property of the loaded unit, from the
+// interface of the given type (e.g. "Unit" or "Service").
+func unitProperty(conn *godbus.Conn, name, unitType, property string) (godbus.Variant, error) {
+	manager := conn.Object("org.freedesktop.systemd1", godbus.ObjectPath("/org/freedesktop/systemd1"))
+	var unit godbus.ObjectPath
+	if err := manager.Call("org.freedesktop.systemd1.Manager.GetUnit", 0, name).Store(&unit); err != nil {
+		return godbus.Variant{}, err
+	}
+	return conn.Object("org.freedesktop.systemd1", unit).GetProperty("org.freedesktop.systemd1." + unitType + "." + property)
+}
+
+// systemBus returns a private, authenticated connection to the system bus,
+// which the caller must close.
+func systemBus() (*godbus.Conn, error) {
+	conn, err := godbus.SystemBusPrivate()
+	if err != nil {
+		return nil, err
+	}
+
+	methods := []godbus.Auth{godbus.AuthExternal(strconv.Itoa(os.Getuid()))}
+	if err := conn.Auth(methods); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.Hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// SystemBusAvailable returns whether or not the system bus, through which
+// systemd is reached, can be connected to.
+func SystemBusAvailable() bool {
+	conn, err := systemBus()
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
 }
 
 func (s *systemd) DaemonReload() error {
@@ -148,6 +283,15 @@ func (s *systemd) UnmaskUnit(u Unit) error {
 	return os.Remove(masked)
 }
 
+// RemoveUnit removes the unit file of the given Unit and its drop-in
+// directory, along with every drop-in found in it.
+func (s *systemd) RemoveUnit(u Unit) error {
+	if err := os.Remove(u.Destination(s.root)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(u.DropInDestination(s.root, config.UnitDropIn{}))
+}
+
 // nullOrEmpty checks whether a given path appears to be an empty regular file
 // or a symlink to /dev/null
 func nullOrEmpty(path string) (bool, error) {
@@ -165,10 +309,16 @@ func nullOrEmpty(path string) (bool, error) {
 	return false, nil
 }
 
-func ExecuteScript(scriptPath string) (string, error) {
+// ExecuteScript starts the script at the given path in a transient unit, with
+// the given "KEY=value" environment, without waiting for it to finish. The
+// script is executed directly, so the kernel will honour its "#!" line.
+func ExecuteScript(scriptPath string, env []string) (string, error) {
 	props := []dbus.Property{
 		dbus.PropDescription("Unit generated and executed by coreos-cloudinit on behalf of user"),
-		dbus.PropExecStart([]string{"/bin/bash", scriptPath}, false),
+		dbus.PropExecStart([]string{scriptPath}, false),
+	}
+	if len(env) > 0 {
+		props = append(props, dbus.Property{Name: "Environment", Value: godbus.MakeVariant(env)})
 	}
 
 	base := path.Base(scriptPath)
@@ -185,10 +335,132 @@ func ExecuteScript(scriptPath string) (string, error) {
 	return name, err
 }
 
+// TransientCommand describes a command which is run to completion in a
+// transient oneshot service.
+type TransientCommand struct {
+	Name        string
+	Description string
+	Command     []string
+	Output      string
+	Environment []string
+	Timeout     time.Duration
+}
+
+// CommandResult describes the outcome of a TransientCommand.
+type CommandResult struct {
+	Unit       string
+	Result     string
+	ExitStatus int
+}
+
+// RunTransientCommand runs the command in a transient oneshot unit and waits
+// for it to exit. Since the start job of a oneshot unit only completes once
+// its process has exited, the result of the job reflects the success of the
+// command. The unit remains loaded after exiting so that the exit status of
+// the command can be retrieved, and is then stopped, or reset if it failed,
+// so that it doesn't stay loaded. If Output is set, the command's stdout and
+// stderr are written to that path. If Timeout is non-zero and the command
+// hasn't exited in time, the unit is killed and an error is returned.
+func RunTransientCommand(c TransientCommand) (CommandResult, error) {
+	res := CommandResult{Unit: c.Name, ExitStatus: -1}
+
+	command := c.Command
+	if c.Output != "" {
+		command = append([]string{"/bin/sh", "-c", `exec >"$0" 2>&1; exec "$@"`, c.Output}, command...)
+	}
+
+	props := []dbus.Property{
+		dbus.PropDescription(c.Description),
+		dbus.PropExecStart(command, false),
+		dbus.PropRemainAfterExit(true),
+		dbus.Property{Name: "Type", Value: godbus.MakeVariant("oneshot")},
+	}
+	if len(c.Environment) > 0 {
+		props = append(props, dbus.Property{Name: "Environment", Value: godbus.MakeVariant(c.Environment)})
+	}
+
+	log.Printf("Creating transient systemd unit '%s'", c.Name)
+
+	conn, err := systemBus()
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close()
+
+	if res.Result, err = runJob(conn, c.Timeout, "StartTransientUnit", c.Name, "replace", props, []dbus.PropertyCollection{}); err != nil {
+		return res, err
+	}
+	defer releaseUnit(conn, c.Name, res.Result)
+
+	if res.Result == "timeout" {
+		log.Printf("Unit '%s' did not finish within %s, killing it", c.Name, c.Timeout)
+		manager := conn.Object("org.freedesktop.systemd1", godbus.ObjectPath("/org/freedesktop/systemd1"))
+		manager.Call("org.freedesktop.systemd1.Manager.KillUnit", 0, c.Name, "all", int32(syscall.SIGKILL))
+		return res, fmt.Errorf("unit %q did not finish within %s", c.Name, c.Timeout)
+	}
+
+	if v, err := unitProperty(conn, c.Name, "Service", "ExecMainStatus"); err == nil {
+		if status, ok := v.Value().(int32); ok {
+			res.ExitStatus = int(status)
+		}
+	}
+
+	if res.Result != "done" {
+		return res, fmt.Errorf("unit %q finished with result %q (exit status %d)", c.Name, res.Result, res.ExitStatus)
+	}
+	return res, nil
+}
+
+// releaseUnit unloads the transient unit left by RunTransientCommand, given
+// the result of its start job: a unit which exited successfully is stopped,
+// while one which failed or was killed is stopped and its failed state reset.
+func releaseUnit(conn *godbus.Conn, name, result string) {
+	if r, err := runJob(conn, JobTimeout, "StopUnit", name, "replace"); err != nil || r != "done" {
+		log.Printf("Failed stopping unit '%s': %v (%s)", name, err, r)
+	}
+	if result == "done" {
+		return
+	}
+	manager := conn.Object("org.freedesktop.systemd1", godbus.ObjectPath("/org/freedesktop/systemd1"))
+	if err := manager.Call("org.freedesktop.systemd1.Manager.ResetFailedUnit", 0, name).Err; err != nil {
+		log.Printf("Failed resetting unit '%s': %v", name, err)
+	}
+}
+
+// ReloadNetwork makes systemd-networkd reload its configuration, which
+// reconfigures the links whose network file was added, changed or removed, and
+// then reconfigures the given links, whose netdev or link file may have
+// changed too. The other links are left alone.
+func (s *systemd) ReloadNetwork(links []string) error {
+	if out, err := exec.Command("networkctl", "reload").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed reloading systemd-networkd: %v (%s)", err, strings.TrimSpace(string(out)))
+	}
+	if len(links) == 0 {
+		return nil
+	}
+	args := append([]string{"reconfigure"}, links...)
+	if out, err := exec.Command("networkctl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed reconfiguring %s: %v (%s)", strings.Join(links, ", "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
 func SetHostname(hostname string) error {
 	return exec.Command("hostnamectl", "set-hostname", hostname).Run()
 }
 
+// WriteHostname sets the static hostname of the system found under root by
+// writing its /etc/hostname.
+func WriteHostname(root, hostname string) error {
+	file := File{config.File{
+		Path:               "/etc/hostname",
+		Content:            hostname + "\n",
+		RawFilePermissions: "0644",
+	}}
+	_, err := WriteFile(&file, root)
+	return err
+}
+
 func Hostname() (string, error) {
 	return os.Hostname()
 }
@@ -203,3 +475,16 @@ func MachineID(root string) string {
 
 	return id
 }
+
+// BootID returns the kernel's random identifier of the current boot.
+func BootID() (string, error) {
+	contents, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(string(contents))
+	if id == "" {
+		return "", fmt.Errorf("boot ID in %s is empty", bootIDPath)
+	}
+	return id, nil
+}
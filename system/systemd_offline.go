@@ -0,0 +1,374 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package system
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/coreos/coreos-cloudinit/config"
+)
+
+// unitSearchPath lists the directories, relative to the root, in which unit
+// files are looked up, in order of precedence.
+var unitSearchPath = []string{
+	"etc/systemd/system",
+	"run/systemd/system",
+	"usr/lib/systemd/system",
+	"lib/systemd/system",
+}
+
+// presetSearchPath lists the directories, relative to the root, in which
+// preset files are looked up, in order of precedence.
+var presetSearchPath = []string{
+	"etc/systemd/system-preset",
+	"run/systemd/system-preset",
+	"usr/lib/systemd/system-preset",
+	"lib/systemd/system-preset",
+}
+
+// offlineSystemd is the UnitManager of a system whose systemd can't be
+// reached, either because it isn't running (e.g. an image found under root)
+// or because its system bus is unreachable (e.g. in a container or chroot).
+// Units are placed and masked like they are by systemd, but they are enabled
+// by creating the symlinks described by their [Install] sections directly,
+// and runtime commands are queued in a file, if one is given, to be run once
+// systemd can be reached; otherwise they are skipped.
+type offlineSystemd struct {
+	systemd
+	queue string
+}
+
+func NewOfflineUnitManager(root, queue string) UnitManager {
+	return &offlineSystemd{systemd{root}, queue}
+}
+
+// EnableUnitFile creates the symlinks listed by the WantedBy, RequiredBy and
+// Alias options of the unit's [Install] section, and enables the units
+// listed by its Also option, analogous to `systemctl enable`.
+func (s *offlineSystemd) EnableUnitFile(u Unit) error {
+	return s.enable(u, map[string]bool{})
+}
+
+func (s *offlineSystemd) enable(u Unit, seen map[string]bool) error {
+	if seen[u.Name] {
+		return nil
+	}
+	seen[u.Name] = true
+
+	source, content, err := s.unitFile(u)
+	if err != nil {
+		return err
+	}
+
+	install := parseSection(content, "Install")
+	base := s.linkDir(u)
+
+	linked := false
+	for option, suffix := range map[string]string{"WantedBy": ".wants", "RequiredBy": ".requires"} {
+		for _, target := range install[option] {
+			if err := symlink(source, path.Join(base, target+suffix, u.Name)); err != nil {
+				return err
+			}
+			linked = true
+		}
+	}
+	for _, alias := range install["Alias"] {
+		if err := symlink(source, path.Join(base, alias)); err != nil {
+			return err
+		}
+		linked = true
+	}
+	for _, also := range install["Also"] {
+		if err := s.enable(Unit{config.Unit{Name: also, Runtime: u.Runtime}}, seen); err != nil {
+			return err
+		}
+		linked = true
+	}
+	if !linked {
+		log.Printf("Unit %q has no installation config, not enabling", u.Name)
+	}
+	return nil
+}
+
+// DisableUnitFile removes the symlinks to the unit from the .wants and
+// .requires directories and its aliases, and disables the units listed by
+// the Also option of its [Install] section, analogous to `systemctl disable`.
+func (s *offlineSystemd) DisableUnitFile(u Unit) error {
+	return s.disable(u, map[string]bool{})
+}
+
+func (s *offlineSystemd) disable(u Unit, seen map[string]bool) error {
+	if seen[u.Name] {
+		return nil
+	}
+	seen[u.Name] = true
+
+	base := s.linkDir(u)
+	links := []string{}
+	for _, suffix := range []string{".wants", ".requires"} {
+		matches, err := filepath.Glob(path.Join(base, "*"+suffix, u.Name))
+		if err != nil {
+			return err
+		}
+		links = append(links, matches...)
+	}
+
+	var also []string
+	if _, content, err := s.unitFile(u); err == nil {
+		install := parseSection(content, "Install")
+		for _, alias := range install["Alias"] {
+			links = append(links, path.Join(base, alias))
+		}
+		also = install["Also"]
+	}
+
+	for _, link := range links {
+		if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, name := range also {
+		if err := s.disable(Unit{config.Unit{Name: name, Runtime: u.Runtime}}, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkDir returns the directory in which the symlinks enabling the unit are
+// created.
+func (s *offlineSystemd) linkDir(u Unit) string {
+	dir := "etc"
+	if u.Runtime {
+		dir = "run"
+	}
+	return path.Join(s.root, dir, "systemd", "system")
+}
+
+// PresetUnitFile enables or disables the unit according to the preset files
+// found under the root, analogous to `systemctl preset`.
+func (s *offlineSystemd) PresetUnitFile(u Unit) error {
+	enable, err := presetPolicy(s.root, u.Name)
+	if err != nil {
+		return err
+	}
+	if enable {
+		log.Printf("Preset enables unit %q", u.Name)
+		return s.EnableUnitFile(u)
+	}
+	log.Printf("Preset disables unit %q", u.Name)
+	return s.DisableUnitFile(u)
+}
+
+// RunUnitCommand appends the command to the queue, if there is one, and
+// skips it otherwise.
+func (s *offlineSystemd) RunUnitCommand(u Unit, c string) (UnitStatus, error) {
+	if s.queue == "" {
+		log.Printf("Skipping %q on %q since systemd can't be reached", c, u.Name)
+		return UnitStatus{Result: "skipped"}, nil
+	}
+
+	log.Printf("Queueing %q on %q since systemd can't be reached", c, u.Name)
+	if err := os.MkdirAll(path.Dir(s.queue), 0755); err != nil {
+		return UnitStatus{}, err
+	}
+	f, err := os.OpenFile(s.queue, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return UnitStatus{}, err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %s\n", c, u.Name); err != nil {
+		return UnitStatus{}, err
+	}
+	return UnitStatus{Result: "queued"}, nil
+}
+
+// QueuedCommand is a unit command queued by an offline UnitManager.
+type QueuedCommand struct {
+	Unit    string
+	Command string
+}
+
+// ReadQueuedCommands returns the commands found in the given queue, in the
+// order in which they were queued.
+func ReadQueuedCommands(queue string) ([]QueuedCommand, error) {
+	content, err := ioutil.ReadFile(queue)
+	if err != nil {
+		return nil, err
+	}
+	var commands []QueuedCommand
+	for _, line := range strings.Split(string(content), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			commands = append(commands, QueuedCommand{Unit: fields[1], Command: fields[0]})
+		}
+	}
+	return commands, nil
+}
+
+// WriteQueuedCommands replaces the commands in the given queue, removing the
+// queue if there are none left.
+func WriteQueuedCommands(queue string, commands []QueuedCommand) error {
+	if len(commands) == 0 {
+		if err := os.Remove(queue); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var content string
+	for _, c := range commands {
+		content += fmt.Sprintf("%s %s\n", c.Command, c.Unit)
+	}
+	tmp := queue + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, queue)
+}
+
+func (s *offlineSystemd) DaemonReload() error {
+	return nil
+}
+
+func (s *offlineSystemd) ReloadNetwork(links []string) error {
+	return nil
+}
+
+// unitFile returns the path, as seen from within the root, and the contents
+// of the file of the given unit.
+func (s *offlineSystemd) unitFile(u Unit) (string, string, error) {
+	if u.Content != "" {
+		return u.Destination("/"), u.Content, nil
+	}
+	return findUnitFile(s.root, u.Name)
+}
+
+// findUnitFile returns the path, as seen from within the root, and the
+// contents of the file of the named unit found in the unit search path. The
+// file of an instance of a template unit is that of the template, unless the
+// instance has a file of its own.
+func findUnitFile(root, name string) (string, string, error) {
+	for _, dir := range unitSearchPath {
+		content, err := ioutil.ReadFile(path.Join(root, dir, name))
+		if err == nil {
+			return path.Join("/", dir, name), string(content), nil
+		} else if !os.IsNotExist(err) {
+			return "", "", err
+		}
+	}
+	if template := (Unit{config.Unit{Name: name}}).Template(); template != "" && template != name {
+		return findUnitFile(root, template)
+	}
+	return "", "", fmt.Errorf("unit %q not found", name)
+}
+
+// parseSection returns the options of the given section of the given unit
+// file, keyed by name. Options which may be repeated have their
+// space-separated values accumulated, and are reset by an empty assignment.
+func parseSection(content, name string) map[string][]string {
+	options := map[string][]string{}
+	section := ""
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+			i++
+			line = strings.TrimSuffix(line, "\\") + " " + strings.TrimSpace(lines[i])
+		}
+
+		switch {
+		case line == "", strings.HasPrefix(line, "#"), strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = line[1 : len(line)-1]
+		case section == name:
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			key := strings.TrimSpace(parts[0])
+			if values := strings.Fields(parts[1]); len(values) > 0 {
+				options[key] = append(options[key], values...)
+			} else {
+				delete(options, key)
+			}
+		}
+	}
+	return options
+}
+
+// presetPolicy returns whether or not the named unit is enabled by the preset
+// files found under root. The files are read in the lexical order of their
+// names, a file hiding those with the same name found later in the search
+// path, and the first rule matching the unit wins. Units which aren't matched
+// by any rule are enabled.
+func presetPolicy(root, name string) (bool, error) {
+	files := map[string]string{}
+	var names []string
+	for _, dir := range presetSearchPath {
+		matches, err := filepath.Glob(path.Join(root, dir, "*.preset"))
+		if err != nil {
+			return false, err
+		}
+		for _, m := range matches {
+			if _, ok := files[path.Base(m)]; !ok {
+				files[path.Base(m)] = m
+				names = append(names, path.Base(m))
+			}
+		}
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		content, err := ioutil.ReadFile(files[n])
+		if err != nil {
+			return false, err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+				continue
+			}
+			if ok, _ := path.Match(fields[1], name); !ok {
+				continue
+			}
+			switch fields[0] {
+			case "enable":
+				return true, nil
+			case "disable":
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// symlink creates a symlink to target at the given path, replacing any
+// existing file and creating parent directories as necessary.
+func symlink(target, p string) error {
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, p)
+}
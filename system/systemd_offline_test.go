@@ -0,0 +1,254 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/coreos-cloudinit/config"
+)
+
+func TestParseSection(t *testing.T) {
+	for i, tt := range []struct {
+		content string
+		options map[string][]string
+	}{
+		{"", map[string][]string{}},
+		{"[Service]\nExecStart=/bin/true\n", map[string][]string{}},
+		{
+			"[Unit]\nDescription=test\n\n[Install]\n# comment\nWantedBy=multi-user.target\nWantedBy=a.target \\\n  b.target\nRequiredBy=c.target\n",
+			map[string][]string{
+				"WantedBy":   {"multi-user.target", "a.target", "b.target"},
+				"RequiredBy": {"c.target"},
+			},
+		},
+		{
+			"[Unit]\nAfter=a.service\n[Install]\nWantedBy=a.target\nWantedBy=\nWantedBy=b.target\n",
+			map[string][]string{
+				"WantedBy": {"b.target"},
+			},
+		},
+	} {
+		if options := parseSection(tt.content, "Install"); !reflect.DeepEqual(tt.options, options) {
+			t.Errorf("bad options (%d): want %q, got %q", i, tt.options, options)
+		}
+	}
+}
+
+func TestOfflineEnableUnitFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	vendor := path.Join(dir, "usr/lib/systemd/system")
+	if err := os.MkdirAll(vendor, 0755); err != nil {
+		t.Fatalf("Unable to create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(vendor, "vendor.service"), []byte("[Install]\nRequiredBy=b.target\n"), 0644); err != nil {
+		t.Fatalf("Unable to write unit: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(vendor, "vendor@.service"), []byte("[Install]\nWantedBy=c.target\n"), 0644); err != nil {
+		t.Fatalf("Unable to write unit: %v", err)
+	}
+
+	um := NewOfflineUnitManager(dir, "")
+	for _, tt := range []struct {
+		unit config.Unit
+		link string
+		dest string
+	}{
+		{
+			config.Unit{Name: "foo.service", Content: "[Install]\nWantedBy=a.target\n"},
+			"etc/systemd/system/a.target.wants/foo.service",
+			"/etc/systemd/system/foo.service",
+		},
+		{
+			config.Unit{Name: "bar.service", Runtime: true, Content: "[Install]\nWantedBy=a.target\n"},
+			"run/systemd/system/a.target.wants/bar.service",
+			"/run/systemd/system/bar.service",
+		},
+		{
+			config.Unit{Name: "vendor.service"},
+			"etc/systemd/system/b.target.requires/vendor.service",
+			"/usr/lib/systemd/system/vendor.service",
+		},
+		{
+			config.Unit{Name: "vendor@a.service"},
+			"etc/systemd/system/c.target.wants/vendor@a.service",
+			"/usr/lib/systemd/system/vendor@.service",
+		},
+	} {
+		if err := um.EnableUnitFile(Unit{tt.unit}); err != nil {
+			t.Fatalf("bad error (%q): want nil, got %v", tt.unit.Name, err)
+		}
+		dest, err := os.Readlink(path.Join(dir, tt.link))
+		if err != nil {
+			t.Fatalf("bad link (%q): want %q, got %v", tt.unit.Name, tt.link, err)
+		}
+		if dest != tt.dest {
+			t.Errorf("bad destination (%q): want %q, got %q", tt.unit.Name, tt.dest, dest)
+		}
+	}
+
+	if err := um.EnableUnitFile(Unit{config.Unit{Name: "missing.service"}}); err == nil {
+		t.Errorf("bad error for missing unit: want non-nil, got nil")
+	}
+	if res, err := um.RunUnitCommand(Unit{config.Unit{Name: "foo.service"}}, "start"); err != nil || res.Result != "skipped" {
+		t.Errorf("bad command result: want %q, got %q (%v)", "skipped", res, err)
+	}
+}
+
+func TestOfflinePresetUnitFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for p, content := range map[string]string{
+		"usr/lib/systemd/system-preset/90-default.preset": "# default\nenable a.service\ndisable *\n",
+		"usr/lib/systemd/system-preset/10-vendor.preset":  "disable a.service\n",
+		"etc/systemd/system-preset/10-vendor.preset":      "enable b.service\n",
+	} {
+		if err := os.MkdirAll(path.Dir(path.Join(dir, p)), 0755); err != nil {
+			t.Fatalf("Unable to create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, p), []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write preset: %v", err)
+		}
+	}
+
+	um := NewOfflineUnitManager(dir, "")
+	for _, tt := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"a.service", true},
+		{"b.service", true},
+		{"c.service", false},
+	} {
+		u := Unit{config.Unit{Name: tt.name, Content: "[Install]\nWantedBy=a.target\n"}}
+		link := path.Join(dir, "etc/systemd/system/a.target.wants", tt.name)
+		if err := symlink("/dev/null", link); err != nil {
+			t.Fatalf("Unable to create link: %v", err)
+		}
+		if err := um.PresetUnitFile(u); err != nil {
+			t.Fatalf("bad error (%q): want nil, got %v", tt.name, err)
+		}
+		if _, err := os.Lstat(link); (err == nil) != tt.enabled {
+			t.Errorf("bad enablement (%q): want %t, got %v", tt.name, tt.enabled, err)
+		}
+	}
+}
+
+func TestRemoveUnit(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := Unit{config.Unit{Name: "foo.service", Content: "[Service]\n", DropIns: []config.UnitDropIn{{Name: "10-foo.conf", Content: "[Service]\n"}}}}
+	um := NewOfflineUnitManager(dir, "")
+	if err := um.PlaceUnit(u); err != nil {
+		t.Fatalf("Unable to place unit: %v", err)
+	}
+	if err := um.PlaceUnitDropIn(u, u.DropIns[0]); err != nil {
+		t.Fatalf("Unable to place drop-in: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := um.RemoveUnit(Unit{config.Unit{Name: "foo.service"}}); err != nil {
+			t.Fatalf("bad error (%d): want nil, got %v", i, err)
+		}
+	}
+	for _, p := range []string{u.Destination(dir), u.DropInDestination(dir, u.DropIns[0])} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("bad removal (%s): want not exist, got %v", p, err)
+		}
+	}
+}
+
+func TestOfflineEnableAliasAlso(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	vendor := path.Join(dir, "usr/lib/systemd/system")
+	if err := os.MkdirAll(vendor, 0755); err != nil {
+		t.Fatalf("Unable to create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(vendor, "foo.socket"), []byte("[Install]\nWantedBy=sockets.target\nAlso=foo.service\n"), 0644); err != nil {
+		t.Fatalf("Unable to write unit: %v", err)
+	}
+
+	um := NewOfflineUnitManager(dir, "")
+	u := Unit{config.Unit{Name: "foo.service", Content: "[Install]\nWantedBy=a.target\nAlias=bar.service\nAlso=foo.socket\n"}}
+	if err := um.EnableUnitFile(u); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+
+	links := map[string]string{
+		"etc/systemd/system/a.target.wants/foo.service":      "/etc/systemd/system/foo.service",
+		"etc/systemd/system/bar.service":                     "/etc/systemd/system/foo.service",
+		"etc/systemd/system/sockets.target.wants/foo.socket": "/usr/lib/systemd/system/foo.socket",
+	}
+	for link, want := range links {
+		if dest, err := os.Readlink(path.Join(dir, link)); err != nil || dest != want {
+			t.Errorf("bad link (%s): want %q, got %q (%v)", link, want, dest, err)
+		}
+	}
+
+	if err := um.PlaceUnit(u); err != nil {
+		t.Fatalf("Unable to place unit: %v", err)
+	}
+	if err := um.DisableUnitFile(Unit{config.Unit{Name: "foo.service"}}); err != nil {
+		t.Fatalf("bad error: want nil, got %v", err)
+	}
+	for link := range links {
+		if _, err := os.Lstat(path.Join(dir, link)); !os.IsNotExist(err) {
+			t.Errorf("bad link (%s): want removed, got %v", link, err)
+		}
+	}
+}
+
+func TestOfflineQueueUnitCommands(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue := path.Join(dir, "var/lib/coreos-cloudinit/queued-unit-commands")
+	um := NewOfflineUnitManager(dir, queue)
+	for _, c := range []QueuedCommand{{"foo.service", "start"}, {"bar.service", "restart"}} {
+		if res, err := um.RunUnitCommand(Unit{config.Unit{Name: c.Unit}}, c.Command); err != nil || res.Result != "queued" {
+			t.Fatalf("bad command result (%+v): want %q, got %q (%v)", c, "queued", res, err)
+		}
+	}
+
+	want := []QueuedCommand{{"foo.service", "start"}, {"bar.service", "restart"}}
+	if commands, err := ReadQueuedCommands(queue); err != nil || !reflect.DeepEqual(want, commands) {
+		t.Errorf("bad queued commands: want %+v, got %+v (%v)", want, commands, err)
+	}
+}
@@ -145,6 +145,27 @@ func TestMachineID(t *testing.T) {
 	}
 }
 
+func TestBootID(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { bootIDPath = p }(bootIDPath)
+
+	bootIDPath = path.Join(dir, "boot_id")
+	ioutil.WriteFile(bootIDPath, []byte("c6b5a9a6-3f27-4f6b-a9b8-2b0d7d3a1c5e\n"), os.FileMode(0444))
+
+	if id, err := BootID(); err != nil || id != "c6b5a9a6-3f27-4f6b-a9b8-2b0d7d3a1c5e" {
+		t.Fatalf("File has incorrect contents: %q (%v)", id, err)
+	}
+
+	os.Remove(bootIDPath)
+	if id, err := BootID(); err == nil {
+		t.Fatalf("Expected an error for a missing boot ID, got %q", id)
+	}
+}
+
 func TestMaskUnit(t *testing.T) {
 	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
 	if err != nil {
@@ -27,10 +27,45 @@ type UnitManager interface {
 	PlaceUnit(unit Unit) error
 	PlaceUnitDropIn(unit Unit, dropIn config.UnitDropIn) error
 	EnableUnitFile(unit Unit) error
-	RunUnitCommand(unit Unit, command string) (string, error)
+	DisableUnitFile(unit Unit) error
+	PresetUnitFile(unit Unit) error
+	RunUnitCommand(unit Unit, command string) (UnitStatus, error)
 	MaskUnit(unit Unit) error
 	UnmaskUnit(unit Unit) error
+	RemoveUnit(unit Unit) error
 	DaemonReload() error
+	ReloadNetwork(links []string) error
+}
+
+// UnitStatus describes the outcome of a command run on a unit: the result of
+// its job (e.g. "done", "failed", "timeout" or "dependency") and the state
+// the unit was left in.
+type UnitStatus struct {
+	Result      string
+	ActiveState string
+	SubState    string
+}
+
+// Succeeded returns whether or not the job finished successfully, or had
+// nothing to do.
+func (s UnitStatus) Succeeded() bool {
+	return s.Result == "done" || s.Result == "skipped"
+}
+
+// State returns the active state and sub-state of the unit, in the form
+// "active/running".
+func (s UnitStatus) State() string {
+	if s.ActiveState == "" {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s/%s", s.ActiveState, s.SubState)
+}
+
+func (s UnitStatus) String() string {
+	if s.ActiveState == "" {
+		return s.Result
+	}
+	return fmt.Sprintf("%s, %s", s.Result, s.State())
 }
 
 // Unit is a top-level structure which embeds its underlying configuration,
@@ -73,6 +108,62 @@ func (u Unit) DropInDestination(root string, dropIn config.UnitDropIn) string {
 	return path.Join(u.prefix(root), fmt.Sprintf("%s.d", u.Name), dropIn.Name)
 }
 
+// Template returns the name of the template unit (e.g. "foo@.service") of an
+// instance of a template unit (e.g. "foo@bar.service"), or of a template unit
+// itself. It returns an empty string for any other unit.
+func (u Unit) Template() string {
+	at := strings.Index(u.Name, "@")
+	if at < 0 {
+		return ""
+	}
+	return u.Name[:at+1] + path.Ext(u.Name)
+}
+
+// IsTemplate returns whether or not the unit is a template unit, as opposed
+// to an instance of one.
+func (u Unit) IsTemplate() bool {
+	return u.Template() != "" && u.Template() == u.Name
+}
+
+// Expand returns the units which the unit stands for. A template unit stands
+// for each of the instances it lists and an instance stands for itself and
+// any further instances it lists. In both cases, the template unit, holding
+// the content, comes first, followed by the instances, to which everything
+// else (e.g. drop-ins, enabling and commands) applies. Any other unit stands
+// for itself.
+func (u Unit) Expand() []Unit {
+	template := u.Template()
+	if template == "" || (u.IsTemplate() && len(u.Instances) == 0) {
+		return []Unit{u}
+	}
+
+	var units []Unit
+	if u.Content != "" {
+		units = append(units, Unit{config.Unit{
+			Name:            template,
+			Runtime:         u.Runtime,
+			Content:         u.Content,
+			OncePerInstance: u.OncePerInstance,
+		}})
+	}
+
+	var names []string
+	if !u.IsTemplate() {
+		names = append(names, u.Name)
+	}
+	for _, instance := range u.Instances {
+		names = append(names, strings.TrimSuffix(template, path.Ext(template))+instance+path.Ext(template))
+	}
+	for _, name := range names {
+		instance := u
+		instance.Name = name
+		instance.Content = ""
+		instance.Instances = nil
+		units = append(units, Unit{instance.Unit})
+	}
+	return units
+}
+
 func (u Unit) prefix(root string) string {
 	dir := "etc"
 	if u.Runtime {
@@ -80,3 +171,38 @@ func (u Unit) prefix(root string) string {
 	}
 	return path.Join(root, dir, "systemd", u.Group())
 }
+
+// Dependencies lists the units which a unit is ordered after or before, and
+// those it requires.
+type Dependencies struct {
+	After    []string
+	Before   []string
+	Requires []string
+}
+
+// Dependencies returns the dependencies declared by the [Unit] sections of
+// the unit and its drop-ins. If the unit has no content, that of its unit
+// file found under root is used instead.
+func (u Unit) Dependencies(root string) Dependencies {
+	content := u.Content
+	if content == "" {
+		_, content, _ = findUnitFile(root, u.Name)
+	}
+	for _, dropIn := range u.DropIns {
+		content += "\n" + dropIn.Content
+	}
+
+	options := parseSection(content, "Unit")
+	return Dependencies{
+		After:    options["After"],
+		Before:   options["Before"],
+		Requires: append(options["Requires"], options["BindsTo"]...),
+	}
+}
+
+// UnitExists returns whether or not a unit file for the named unit, or for
+// the template it is an instance of, can be found under root.
+func UnitExists(root, name string) bool {
+	_, _, err := findUnitFile(root, name)
+	return err == nil
+}
@@ -15,6 +15,10 @@
 package system
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
 	"testing"
 
 	"github.com/coreos/coreos-cloudinit/config"
@@ -134,3 +138,117 @@ func TestDropInDestination(t *testing.T) {
 		}
 	}
 }
+
+func TestDependencies(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "coreos-cloudinit-")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(path.Join(dir, "usr/lib/systemd/system"), 0755); err != nil {
+		t.Fatalf("Unable to create unit directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "usr/lib/systemd/system/vendor.service"), []byte("[Unit]\nAfter=etcd2.service\n"), 0644); err != nil {
+		t.Fatalf("Unable to write unit file: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "usr/lib/systemd/system/getty@.service"), []byte("[Service]\n"), 0644); err != nil {
+		t.Fatalf("Unable to write unit file: %v", err)
+	}
+
+	tests := []struct {
+		unit config.Unit
+
+		deps Dependencies
+	}{
+		{
+			unit: config.Unit{Name: "foo.service"},
+		},
+		{
+			unit: config.Unit{Name: "vendor.service"},
+			deps: Dependencies{After: []string{"etcd2.service"}},
+		},
+		{
+			unit: config.Unit{
+				Name:    "foo.service",
+				Content: "[Unit]\nAfter=a.service b.service\nRequires=a.service\nBindsTo=c.service\nBefore=d.service\n\n[Service]\nAfter=e.service\n",
+			},
+			deps: Dependencies{
+				After:    []string{"a.service", "b.service"},
+				Before:   []string{"d.service"},
+				Requires: []string{"a.service", "c.service"},
+			},
+		},
+		{
+			unit: config.Unit{
+				Name:    "vendor.service",
+				DropIns: []config.UnitDropIn{{Name: "10-after.conf", Content: "[Unit]\nAfter=\nAfter=fleet.service\n"}},
+			},
+			deps: Dependencies{After: []string{"fleet.service"}},
+		},
+	}
+
+	for _, tt := range tests {
+		if deps := (Unit{tt.unit}).Dependencies(dir); !reflect.DeepEqual(tt.deps, deps) {
+			t.Errorf("bad dependencies (%+v): want %+v, got %+v", tt.unit, tt.deps, deps)
+		}
+	}
+
+	for name, exists := range map[string]bool{
+		"vendor.service":     true,
+		"vendor@foo.service": false,
+		"getty@tty1.service": true,
+		"other.service":      false,
+	} {
+		if e := UnitExists(dir, name); e != exists {
+			t.Errorf("bad existence (%s): want %t, got %t", name, exists, e)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		unit config.Unit
+
+		units []config.Unit
+	}{
+		{
+			unit:  config.Unit{Name: "foo.service", Content: "[Service]"},
+			units: []config.Unit{{Name: "foo.service", Content: "[Service]"}},
+		},
+		{
+			unit:  config.Unit{Name: "foo@.service", Content: "[Service]"},
+			units: []config.Unit{{Name: "foo@.service", Content: "[Service]"}},
+		},
+		{
+			unit: config.Unit{Name: "foo@.service", Content: "[Service]", Enable: true, Command: "start", Instances: []string{"a", "b"}},
+			units: []config.Unit{
+				{Name: "foo@.service", Content: "[Service]"},
+				{Name: "foo@a.service", Enable: true, Command: "start"},
+				{Name: "foo@b.service", Enable: true, Command: "start"},
+			},
+		},
+		{
+			unit: config.Unit{Name: "foo@a.timer", Runtime: true, Content: "[Timer]", DropIns: []config.UnitDropIn{{Name: "10-foo.conf"}}, Instances: []string{"b"}},
+			units: []config.Unit{
+				{Name: "foo@.timer", Runtime: true, Content: "[Timer]"},
+				{Name: "foo@a.timer", Runtime: true, DropIns: []config.UnitDropIn{{Name: "10-foo.conf"}}},
+				{Name: "foo@b.timer", Runtime: true, DropIns: []config.UnitDropIn{{Name: "10-foo.conf"}}},
+			},
+		},
+		{
+			unit:  config.Unit{Name: "getty@tty1.service", Command: "start"},
+			units: []config.Unit{{Name: "getty@tty1.service", Command: "start"}},
+		},
+	}
+
+	for _, tt := range tests {
+		var units []config.Unit
+		for _, u := range (Unit{tt.unit}).Expand() {
+			units = append(units, u.Unit)
+		}
+		if !reflect.DeepEqual(tt.units, units) {
+			t.Errorf("bad units (%+v): want %+v, got %+v", tt.unit, tt.units, units)
+		}
+	}
+}
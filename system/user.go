@@ -24,6 +24,38 @@ import (
 	"github.com/coreos/coreos-cloudinit/config"
 )
 
+// UserManager creates users and manages their passwords and SSH keys.
+type UserManager interface {
+	UserExists(u *config.User) bool
+	CreateUser(u *config.User) error
+	SetUserPassword(user, hash string) error
+	AuthorizeSSHKeys(user string, keysName string, keys []string) error
+}
+
+// hostUsers is the UserManager of the running system, which uses the
+// system's tools to manage users.
+type hostUsers struct{}
+
+func NewUserManager() UserManager {
+	return hostUsers{}
+}
+
+func (hostUsers) UserExists(u *config.User) bool {
+	return UserExists(u)
+}
+
+func (hostUsers) CreateUser(u *config.User) error {
+	return CreateUser(u)
+}
+
+func (hostUsers) SetUserPassword(user, hash string) error {
+	return SetUserPassword(user, hash)
+}
+
+func (hostUsers) AuthorizeSSHKeys(user string, keysName string, keys []string) error {
+	return AuthorizeSSHKeys(user, keysName, keys)
+}
+
 func UserExists(u *config.User) bool {
 	_, err := user.Lookup(u.Name)
 	return err == nil